@@ -0,0 +1,132 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package bus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+)
+
+type (
+	// Authorizer decides whether a principal may emit to a topic and
+	// subscribe to the topics of a handler
+	//
+	// The subscriptions of the handlers to the topics registered later are
+	// also authorized once, when the topic is registered, with the ctx of the
+	// handler registration and under the lock of the bus, so the
+	// implementations must not call the bus.
+	Authorizer interface {
+		// AuthorizeEmit returns a non-nil error to reject the emit
+		AuthorizeEmit(ctx context.Context, r EmitRequest) error
+
+		// AuthorizeSubscribe returns a non-nil error to reject the handler
+		// registration or its subscription to a later registered topic
+		AuthorizeSubscribe(ctx context.Context, r SubscribeRequest) error
+	}
+
+	// EmitRequest is an emit to authorize
+	EmitRequest struct {
+		Principal string // principal of the ctx
+		Source    string // source of the event
+		Tenant    string // tenant of the event
+		Topic     string // topic of the event
+	}
+
+	// SubscribeRequest is a handler subscription to authorize
+	SubscribeRequest struct {
+		Principal  string   // principal of the ctx of the registration
+		HandlerKey string   // key of the handler
+		Matcher    string   // topic matcher of the handler
+		Topics     []string // topics the handler subscribes to, sorted
+	}
+)
+
+// CtxKeyPrincipal principal context key
+const CtxKeyPrincipal = ctxKey(119)
+
+var (
+	// ErrEmitDenied is wrapped by the errors of the emits rejected by the
+	// authorizer
+	ErrEmitDenied = errors.New("emit denied")
+
+	// ErrSubscribeDenied is wrapped by the errors of the handler
+	// registrations rejected by the authorizer
+	ErrSubscribeDenied = errors.New("subscribe denied")
+)
+
+// WithAuthorizer returns an option to authorize the emits and the handler
+// registrations of the bus; the namespace buses inherit the authorizer
+func WithAuthorizer(a Authorizer) Option {
+	return func(b *Bus) error {
+		if a == nil {
+			return fmt.Errorf("bus: authorizer can't be nil")
+		}
+		b.auth = a
+		return nil
+	}
+}
+
+// authorizeEmit authorizes the emit of the event for the principal of the
+// ctx
+func (b *Bus) authorizeEmit(ctx context.Context, e Event) error {
+	principal, _ := ctx.Value(CtxKeyPrincipal).(string)
+	r := EmitRequest{Principal: principal, Source: e.Source, Tenant: e.Tenant, Topic: e.Topic}
+	if err := b.auth.AuthorizeEmit(ctx, r); err != nil {
+		return fmt.Errorf("bus: topic(%s) %w: %v", e.Topic, ErrEmitDenied, err)
+	}
+	return nil
+}
+
+// authorizeSubscribe authorizes the current subscriptions of the handler for
+// the principal of the ctx and returns the func authorizing its subscriptions
+// to the topics registered later with the same ctx
+func (b *Bus) authorizeSubscribe(ctx context.Context, h Handler) (func(topic string) bool, error) {
+	topics := make([]string, 0)
+	if re, err := regexp.Compile(h.Matcher); err == nil {
+		b.mutex.RLock()
+		for topic := range b.topics {
+			if re.MatchString(topic) {
+				topics = append(topics, topic)
+			}
+		}
+		b.mutex.RUnlock()
+	}
+	sort.Strings(topics)
+
+	principal, _ := ctx.Value(CtxKeyPrincipal).(string)
+	r := SubscribeRequest{Principal: principal, HandlerKey: h.key, Matcher: h.Matcher, Topics: topics}
+	if err := b.auth.AuthorizeSubscribe(ctx, r); err != nil {
+		return nil, fmt.Errorf("bus: handler(%s) %w: %v", h.key, ErrSubscribeDenied, err)
+	}
+
+	granted := make(map[string]struct{}, len(topics))
+	for _, topic := range topics {
+		granted[topic] = struct{}{}
+	}
+
+	auth := b.auth
+	return func(topic string) bool {
+		if _, ok := granted[topic]; ok {
+			return true
+		}
+
+		r := r
+		r.Topics = []string{topic}
+		return auth.AuthorizeSubscribe(ctx, r) == nil
+	}, nil
+}
+
+// subscribes tells whether the handler subscribes to the topic; it is only
+// asked when the subscription is created, the subscriptions are kept in the
+// topic handlers
+func (h Handler) subscribes(topic string) bool {
+	if matched, _ := regexp.MatchString(h.Matcher, topic); !matched {
+		return false
+	}
+	return h.allow == nil || h.allow(topic)
+}
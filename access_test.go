@@ -0,0 +1,208 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package bus_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/mustafaturan/bus/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeAuthorizer struct {
+	emits      []bus.EmitRequest
+	subscribes []bus.SubscribeRequest
+	principals []interface{} // principals of the subscribe ctx
+	denied     string        // topic denied to emit
+	err        error
+}
+
+func TestWithAuthorizer(t *testing.T) {
+	_, err := bus.NewBus(bus.Next(func() string { return "fakeid" }), bus.WithAuthorizer(nil))
+	assert.EqualError(t, err, "bus: authorizer can't be nil")
+}
+
+func TestAuthorizeEmit(t *testing.T) {
+	a := &fakeAuthorizer{}
+	b := setupAccess(t, a, topicCommentCreated)
+
+	r := &fakeRecorder{}
+	b.RegisterHandler("test.handler", bus.Handler{Handle: r.record, Matcher: ".*"})
+
+	ctx := context.WithValue(context.Background(), bus.CtxKeyPrincipal, "plugin")
+	ctx = context.WithValue(ctx, bus.CtxKeySource, "/comments")
+	ctx = context.WithValue(ctx, bus.CtxKeyTenant, "acme")
+
+	t.Run("allowed", func(t *testing.T) {
+		require.Nil(t, b.Emit(ctx, topicCommentCreated, 1))
+		require.Nil(t, b.EmitWithOpts(ctx, topicCommentCreated, 2, bus.WithSource("/admin")))
+
+		assert.Equal(t, []bus.EmitRequest{
+			{Principal: "plugin", Source: "/comments", Tenant: "acme", Topic: topicCommentCreated},
+			{Principal: "plugin", Source: "/admin", Tenant: "acme", Topic: topicCommentCreated},
+		}, a.emits)
+		assert.Equal(t, []interface{}{1, 2}, r.received())
+	})
+
+	t.Run("denied", func(t *testing.T) {
+		a.err = errors.New("not allowed")
+
+		err := b.Emit(ctx, topicCommentCreated, 3)
+		assert.True(t, errors.Is(err, bus.ErrEmitDenied))
+		assert.EqualError(t, err, "bus: topic(comment.created) emit denied: not allowed")
+
+		err = b.EmitWithOpts(ctx, topicCommentCreated, 4)
+		assert.True(t, errors.Is(err, bus.ErrEmitDenied))
+		assert.Equal(t, []interface{}{1, 2}, r.received())
+	})
+
+	t.Run("denied before the auto registration", func(t *testing.T) {
+		var warnings []string
+		b, err := bus.NewBus(
+			bus.Next(func() string { return "fakeid" }),
+			bus.WithAuthorizer(a),
+			bus.WithAutoRegister(".*"),
+			bus.WithWarnFunc(func(_ context.Context, _, msg string) { warnings = append(warnings, msg) }),
+		)
+		require.Nil(t, err)
+		var changes []bus.Change
+		b.RegisterHook("test.hook", func(c bus.Change) { changes = append(changes, c) })
+		b.RegisterTopicWithOpts(topicCommentDeleted, bus.WithDeprecation("use comment.removed"))
+		changes = nil
+
+		require.NotNil(t, b.Emit(ctx, topicCommentCreated, 1))
+		require.NotNil(t, b.EmitWithOpts(ctx, topicCommentUpdated, 2))
+		assert.Equal(t, []string{topicCommentDeleted}, b.Topics())
+		assert.Empty(t, changes)
+
+		require.NotNil(t, b.Emit(ctx, topicCommentDeleted, 3))
+		require.NotNil(t, b.EmitWithOpts(ctx, topicCommentDeleted, 4))
+		assert.Empty(t, warnings)
+	})
+}
+
+func TestAuthorizeSubscribe(t *testing.T) {
+	a := &fakeAuthorizer{}
+	b := setupAccess(t, a, topicCommentDeleted, topicCommentCreated)
+	ctx := context.WithValue(context.Background(), bus.CtxKeyPrincipal, "plugin")
+
+	t.Run("allowed", func(t *testing.T) {
+		err := b.RegisterHandlerWithContext(ctx, "test.handler", fakeHandler("^comment"))
+		require.Nil(t, err)
+
+		assert.Equal(t, []bus.SubscribeRequest{{
+			Principal:  "plugin",
+			HandlerKey: "test.handler",
+			Matcher:    "^comment",
+			Topics:     []string{topicCommentCreated, topicCommentDeleted},
+		}}, a.subscribes)
+		assert.ElementsMatch(t, []string{topicCommentCreated, topicCommentDeleted}, b.HandlerTopicSubscriptions("test.handler"))
+	})
+
+	t.Run("denied", func(t *testing.T) {
+		a.err = errors.New("not allowed")
+
+		err := b.RegisterHandlerWithContext(ctx, "test.denied", fakeHandler(".*"))
+		assert.True(t, errors.Is(err, bus.ErrSubscribeDenied))
+		assert.EqualError(t, err, "bus: handler(test.denied) subscribe denied: not allowed")
+		assert.NotContains(t, b.HandlerKeys(), "test.denied")
+	})
+
+	t.Run("later registered topics", func(t *testing.T) {
+		b.RegisterTopics(topicCommentUpdated)
+		assert.NotContains(t, b.TopicHandlerKeys(topicCommentUpdated), "test.handler")
+		assert.NotContains(t, b.HandlerTopicSubscriptions("test.handler"), topicCommentUpdated)
+
+		a.err = nil
+		b.DeregisterTopics(topicCommentUpdated)
+		b.RegisterTopics(topicCommentUpdated)
+		assert.Contains(t, b.TopicHandlerKeys(topicCommentUpdated), "test.handler")
+		assert.Equal(t, "plugin", a.principals[len(a.principals)-1])
+	})
+
+	t.Run("deregister after the authorizer changes", func(t *testing.T) {
+		a.err = errors.New("not allowed")
+		assert.ElementsMatch(t, []string{topicCommentCreated, topicCommentDeleted, topicCommentUpdated}, b.HandlerTopicSubscriptions("test.handler"))
+
+		b.DeregisterHandler("test.handler")
+		assert.Empty(t, b.TopicHandlerKeys(topicCommentUpdated))
+		assert.Empty(t, b.HandlerTopicSubscriptions("test.handler"))
+	})
+}
+
+func TestRegisterHandlerDenied(t *testing.T) {
+	var warnings []string
+	a := &fakeAuthorizer{err: errors.New("not allowed")}
+	b, err := bus.NewBus(
+		bus.Next(func() string { return "fakeid" }),
+		bus.WithAuthorizer(a),
+		bus.WithWarnFunc(func(_ context.Context, _, msg string) { warnings = append(warnings, msg) }),
+	)
+	require.Nil(t, err)
+
+	b.RegisterHandler("test.handler", fakeHandler(".*"))
+	assert.Empty(t, b.HandlerKeys())
+	assert.Equal(t, []string{"bus: handler(test.handler) subscribe denied: not allowed"}, warnings)
+}
+
+func TestNamespaceAuthorizer(t *testing.T) {
+	a := &fakeAuthorizer{}
+	b := setupAccess(t, a)
+
+	orders, err := b.Namespace("orders")
+	require.Nil(t, err)
+	orders.RegisterTopics("created")
+
+	a.err = errors.New("not allowed")
+	err = orders.Emit(context.Background(), "created", 1)
+	assert.True(t, errors.Is(err, bus.ErrEmitDenied))
+
+	t.Run("authorizes the forwarded topics", func(t *testing.T) {
+		a := &fakeAuthorizer{denied: "orders.created"}
+		b := setupAccess(t, a)
+		orders, err := b.Namespace("orders", bus.WithForward(".*"), bus.WithAuthorizer(&fakeAuthorizer{}))
+		require.Nil(t, err)
+		orders.RegisterTopics("created", "updated")
+
+		err = orders.Emit(context.Background(), "created", 1)
+		assert.True(t, errors.Is(err, bus.ErrEmitDenied))
+		assert.EqualError(t, err, "bus: topic(created) forward failed: bus: topic(orders.created) emit denied: not allowed")
+		assert.Empty(t, b.Topics())
+
+		require.Nil(t, orders.Emit(context.Background(), "updated", 2))
+		assert.Equal(t, []string{"orders.updated"}, b.Topics())
+		assert.Equal(t, []bus.EmitRequest{{Topic: "created"}, {Topic: "updated"}, {Topic: "orders.updated"}}, a.emits)
+	})
+}
+
+func setupAccess(t *testing.T, a bus.Authorizer, topicNames ...string) *bus.Bus {
+	b, err := bus.NewBus(bus.Next(func() string { return "fakeid" }), bus.WithAuthorizer(a))
+	require.Nil(t, err)
+	b.RegisterTopics(topicNames...)
+	return b
+}
+
+func (a *fakeAuthorizer) AuthorizeEmit(_ context.Context, r bus.EmitRequest) error {
+	if a.err != nil {
+		return a.err
+	}
+	if r.Topic == a.denied {
+		return errors.New("not allowed")
+	}
+	a.emits = append(a.emits, r)
+	return nil
+}
+
+func (a *fakeAuthorizer) AuthorizeSubscribe(ctx context.Context, r bus.SubscribeRequest) error {
+	if a.err != nil {
+		return a.err
+	}
+	a.principals = append(a.principals, ctx.Value(bus.CtxKeyPrincipal))
+	a.subscribes = append(a.subscribes, r)
+	return nil
+}
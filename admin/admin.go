@@ -0,0 +1,221 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+/*
+Package admin provides an optional http.Handler to inspect and control a bus
+in a running service
+
+Every request is guarded by the Authorizer hook. The handler serves the
+following endpoints; mount it with http.StripPrefix to serve under a path:
+
+	GET    /topology                topics, handlers and subscriptions
+	GET    /topics                  registered topics with their metadata
+	GET    /handlers                handlers with subscriptions and metrics
+	GET    /handlers?key=k          a single handler
+	DELETE /handlers?key=k          deregisters the handler
+	POST   /handlers/pause?key=k    pauses the handler
+	POST   /handlers/resume?key=k   resumes the handler
+*/
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/mustafaturan/bus/v3"
+)
+
+type (
+	// Authorizer guards the admin endpoints; a non-nil error rejects the
+	// request with 403 Forbidden
+	Authorizer func(r *http.Request) error
+
+	// HandlerInfo is the admin representation of a registered handler
+	HandlerInfo struct {
+		Key           string           `json:"key"`
+		Matcher       string           `json:"matcher"`
+		Group         string           `json:"group,omitempty"`
+		Tenant        string           `json:"tenant,omitempty"`
+		Subscriptions []string         `json:"subscriptions"`
+		Stats         bus.HandlerStats `json:"stats"`
+	}
+
+	admin struct {
+		bus  *bus.Bus
+		auth Authorizer
+		mux  *http.ServeMux
+	}
+
+	errorResponse struct {
+		Error string `json:"error"`
+	}
+)
+
+const paramKey = "key"
+
+// NewHandler inits a new admin http.Handler for the bus
+func NewHandler(b *bus.Bus, auth Authorizer) (http.Handler, error) {
+	if b == nil {
+		return nil, fmt.Errorf("admin: bus can't be nil")
+	}
+	if auth == nil {
+		return nil, fmt.Errorf("admin: authorizer can't be nil")
+	}
+
+	a := &admin{bus: b, auth: auth, mux: http.NewServeMux()}
+	a.mux.HandleFunc("/topology", a.topology)
+	a.mux.HandleFunc("/topics", a.topics)
+	a.mux.HandleFunc("/handlers", a.handlers)
+	a.mux.HandleFunc("/handlers/pause", a.pause)
+	a.mux.HandleFunc("/handlers/resume", a.resume)
+	return a, nil
+}
+
+// ServeHTTP authorizes and dispatches the request
+func (a *admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := a.auth(r); err != nil {
+		writeError(w, http.StatusForbidden, err)
+		return
+	}
+	a.mux.ServeHTTP(w, r)
+}
+
+func (a *admin) topology(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, a.bus.Topology())
+}
+
+func (a *admin) topics(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, a.bus.Topology().Topics)
+}
+
+func (a *admin) handlers(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodDelete) {
+		return
+	}
+
+	key := r.URL.Query().Get(paramKey)
+	if key == "" {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("admin: %s param is required", paramKey))
+			return
+		}
+		writeJSON(w, http.StatusOK, a.handlerInfos())
+		return
+	}
+
+	info, ok := a.handlerInfo(key)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("admin: handler(%s) not found", key))
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		a.bus.DeregisterHandler(key)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+func (a *admin) pause(w http.ResponseWriter, r *http.Request) {
+	a.control(w, r, func(key string) error { return a.bus.PauseHandler(key) })
+}
+
+func (a *admin) resume(w http.ResponseWriter, r *http.Request) {
+	a.control(w, r, a.bus.ResumeHandler)
+}
+
+func (a *admin) control(w http.ResponseWriter, r *http.Request, fn func(key string) error) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+
+	key := r.URL.Query().Get(paramKey)
+	if key == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("admin: %s param is required", paramKey))
+		return
+	}
+
+	if err := fn(key); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+
+	info, ok := a.handlerInfo(key)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("admin: handler(%s) not found", key))
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+func (a *admin) handlerInfos() []HandlerInfo {
+	nodes := a.bus.Topology().Handlers
+	infos := make([]HandlerInfo, 0, len(nodes))
+	for _, n := range nodes {
+		if info, ok := a.newHandlerInfo(n); ok {
+			infos = append(infos, info)
+		}
+	}
+	return infos
+}
+
+func (a *admin) handlerInfo(key string) (HandlerInfo, bool) {
+	for _, n := range a.bus.Topology().Handlers {
+		if n.Key == key {
+			return a.newHandlerInfo(n)
+		}
+	}
+	return HandlerInfo{}, false
+}
+
+func (a *admin) newHandlerInfo(n bus.HandlerNode) (HandlerInfo, bool) {
+	stats, ok := a.bus.HandlerStats(n.Key)
+	if !ok {
+		return HandlerInfo{}, false
+	}
+
+	subscriptions := a.bus.HandlerTopicSubscriptions(n.Key)
+	if subscriptions == nil {
+		subscriptions = []string{}
+	}
+	sort.Strings(subscriptions)
+
+	return HandlerInfo{
+		Key:           n.Key,
+		Matcher:       n.Matcher,
+		Group:         n.Group,
+		Tenant:        n.Tenant,
+		Subscriptions: subscriptions,
+		Stats:         stats,
+	}, true
+}
+
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("admin: method(%s) is not allowed", r.Method))
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
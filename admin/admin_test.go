@@ -0,0 +1,178 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package admin_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mustafaturan/bus/v3"
+	"github.com/mustafaturan/bus/v3/admin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const token = "secret"
+
+func TestNewHandler(t *testing.T) {
+	b := setup(t)
+
+	t.Run("with nil bus", func(t *testing.T) {
+		_, err := admin.NewHandler(nil, authorize)
+		assert.EqualError(t, err, "admin: bus can't be nil")
+	})
+
+	t.Run("with nil authorizer", func(t *testing.T) {
+		_, err := admin.NewHandler(b, nil)
+		assert.EqualError(t, err, "admin: authorizer can't be nil")
+	})
+}
+
+func TestHandlerAuth(t *testing.T) {
+	h := newHandler(t, setup(t))
+
+	r := httptest.NewRequest(http.MethodGet, "/topology", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.JSONEq(t, `{"error":"invalid token"}`, w.Body.String())
+}
+
+func TestHandlerTopology(t *testing.T) {
+	b := setup(t)
+	h := newHandler(t, b)
+
+	w := serve(h, http.MethodGet, "/topology")
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var got bus.Topology
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &got))
+	assert.Equal(t, b.Topology(), got)
+
+	w = serve(h, http.MethodPost, "/topology")
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestHandlerTopics(t *testing.T) {
+	h := newHandler(t, setup(t))
+
+	w := serve(h, http.MethodGet, "/topics")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `[
+		{"name":"order.created","owner":"checkout"},
+		{"name":"order.shipped"}
+	]`, w.Body.String())
+}
+
+func TestHandlerHandlers(t *testing.T) {
+	b := setup(t)
+	h := newHandler(t, b)
+	require.Nil(t, b.Emit(context.Background(), "order.created", "1"))
+
+	t.Run("lists handlers", func(t *testing.T) {
+		w := serve(h, http.MethodGet, "/handlers")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `[
+			{"key":"audit","matcher":".*","subscriptions":["order.created","order.shipped"],"stats":{"delivered":1,"dropped":0,"throttled":0,"inFlight":0,"queued":0,"paused":false}},
+			{"key":"mailer","matcher":"shipped$","subscriptions":["order.shipped"],"stats":{"delivered":0,"dropped":0,"throttled":0,"inFlight":0,"queued":0,"paused":false}}
+		]`, w.Body.String())
+	})
+
+	t.Run("shows a handler", func(t *testing.T) {
+		w := serve(h, http.MethodGet, "/handlers?key=mailer")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{"key":"mailer","matcher":"shipped$","subscriptions":["order.shipped"],"stats":{"delivered":0,"dropped":0,"throttled":0,"inFlight":0,"queued":0,"paused":false}}`, w.Body.String())
+	})
+
+	t.Run("with unknown handler", func(t *testing.T) {
+		w := serve(h, http.MethodGet, "/handlers?key=unknown")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		assert.JSONEq(t, `{"error":"admin: handler(unknown) not found"}`, w.Body.String())
+	})
+
+	t.Run("deregisters a handler", func(t *testing.T) {
+		w := serve(h, http.MethodDelete, "/handlers?key=mailer")
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.Equal(t, []string{"audit"}, b.HandlerKeys())
+	})
+
+	t.Run("without key on delete", func(t *testing.T) {
+		w := serve(h, http.MethodDelete, "/handlers")
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+func TestHandlerPauseResume(t *testing.T) {
+	b := setup(t)
+	h := newHandler(t, b)
+	ctx := context.Background()
+
+	w := serve(h, http.MethodPost, "/handlers/pause?key=mailer")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"key":"mailer","matcher":"shipped$","subscriptions":["order.shipped"],"stats":{"delivered":0,"dropped":0,"throttled":0,"inFlight":0,"queued":0,"paused":true}}`, w.Body.String())
+
+	require.Nil(t, b.Emit(ctx, "order.shipped", "1"))
+	stats, _ := b.HandlerStats("mailer")
+	assert.Equal(t, 1, stats.Queued)
+
+	w = serve(h, http.MethodPost, "/handlers/resume?key=mailer")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"key":"mailer","matcher":"shipped$","subscriptions":["order.shipped"],"stats":{"delivered":1,"dropped":0,"throttled":0,"inFlight":0,"queued":0,"paused":false}}`, w.Body.String())
+
+	t.Run("with unknown handler", func(t *testing.T) {
+		w := serve(h, http.MethodPost, "/handlers/pause?key=unknown")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		assert.JSONEq(t, `{"error":"bus: handler(unknown) not found"}`, w.Body.String())
+	})
+
+	t.Run("without key", func(t *testing.T) {
+		w := serve(h, http.MethodPost, "/handlers/resume")
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("with get", func(t *testing.T) {
+		w := serve(h, http.MethodGet, "/handlers/pause?key=mailer")
+		assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	})
+}
+
+func setup(t *testing.T) *bus.Bus {
+	b, err := bus.NewBus(bus.Next(func() string { return "fakeid" }))
+	require.Nil(t, err)
+
+	b.RegisterTopicWithOpts("order.created", bus.WithOwner("checkout"))
+	b.RegisterTopics("order.shipped")
+
+	noop := func(context.Context, bus.Event) {}
+	b.RegisterHandler("audit", bus.Handler{Handle: noop, Matcher: ".*"})
+	b.RegisterHandler("mailer", bus.Handler{Handle: noop, Matcher: "shipped$"})
+	return b
+}
+
+func newHandler(t *testing.T, b *bus.Bus) http.Handler {
+	h, err := admin.NewHandler(b, authorize)
+	require.Nil(t, err)
+	return h
+}
+
+func authorize(r *http.Request) error {
+	if r.Header.Get("Authorization") != "Bearer "+token {
+		return errors.New("invalid token")
+	}
+	return nil
+}
+
+func serve(h http.Handler, method, target string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
@@ -0,0 +1,118 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package bus
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+type (
+	// BatchHandler processes a batch of events
+	BatchHandler func(ctx context.Context, events []Event)
+
+	// BatchConfig holds the batching options
+	BatchConfig struct {
+		Size   int           // flushes when the batch has Size events
+		Window time.Duration // flushes Window after the first event of the batch
+		Clock  Clock         // defaults to SystemClock
+	}
+
+	// Batcher is a handler adapter accumulating events up to a size or a time
+	// window before calling the batch handler
+	//
+	// Size flushes run on the emitter goroutine with the emit ctx, window
+	// flushes run on the clock timer goroutine with a background ctx. The
+	// batches are handled one at a time in order.
+	Batcher struct {
+		config BatchConfig
+		handle BatchHandler
+
+		flushMutex sync.Mutex // serializes the batch handler calls
+		mutex      sync.Mutex
+		events     []Event
+		timer      Timer
+		generation uint64
+	}
+)
+
+// NewBatcher inits a new batcher
+func NewBatcher(c BatchConfig, fn BatchHandler) (*Batcher, error) {
+	if fn == nil {
+		return nil, fmt.Errorf("bus: batch handler func can't be nil")
+	}
+	if c.Size < 1 && c.Window <= 0 {
+		return nil, fmt.Errorf("bus: batch size or window must be positive")
+	}
+	if c.Clock == nil {
+		c.Clock = SystemClock
+	}
+	return &Batcher{config: c, handle: fn}, nil
+}
+
+// Handler returns a bus handler for the matcher delivering the events to the
+// batcher and flushing it on bus close
+func (bt *Batcher) Handler(matcher string) Handler {
+	return Handler{Handle: bt.Handle, Flush: bt.Flush, Matcher: matcher}
+}
+
+// Handle adds the event to the current batch
+func (bt *Batcher) Handle(ctx context.Context, e Event) {
+	bt.mutex.Lock()
+	bt.events = append(bt.events, e)
+	generation := bt.generation
+
+	if len(bt.events) == 1 && bt.config.Window > 0 {
+		bt.timer = bt.config.Clock.AfterFunc(bt.config.Window, func() {
+			bt.flush(context.Background(), generation, true)
+		})
+	}
+
+	full := bt.config.Size > 0 && len(bt.events) >= bt.config.Size
+	bt.mutex.Unlock()
+
+	if full {
+		bt.flush(ctx, generation, true)
+	}
+}
+
+// Flush handles the current batch right away
+func (bt *Batcher) Flush(ctx context.Context) {
+	bt.flush(ctx, 0, false)
+}
+
+// Pending returns the number of events in the current batch
+func (bt *Batcher) Pending() int {
+	bt.mutex.Lock()
+	defer bt.mutex.Unlock()
+
+	return len(bt.events)
+}
+
+// flush handles the current batch; with the generation check the batch is
+// only handled if it is still the batch of the given generation
+func (bt *Batcher) flush(ctx context.Context, generation uint64, check bool) {
+	bt.flushMutex.Lock()
+	defer bt.flushMutex.Unlock()
+
+	bt.mutex.Lock()
+	if (check && generation != bt.generation) || len(bt.events) == 0 {
+		bt.mutex.Unlock()
+		return
+	}
+
+	events := bt.events
+	bt.events = nil
+	bt.generation++
+	if bt.timer != nil {
+		bt.timer.Stop()
+		bt.timer = nil
+	}
+	bt.mutex.Unlock()
+
+	bt.handle(ctx, events)
+}
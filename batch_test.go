@@ -0,0 +1,133 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package bus_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mustafaturan/bus/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeBatchRecorder struct {
+	mutex   sync.Mutex
+	batches [][]interface{}
+}
+
+func TestNewBatcher(t *testing.T) {
+	r := &fakeBatchRecorder{}
+
+	t.Run("with nil func", func(t *testing.T) {
+		_, err := bus.NewBatcher(bus.BatchConfig{Size: 1}, nil)
+		assert.EqualError(t, err, "bus: batch handler func can't be nil")
+	})
+
+	t.Run("without size and window", func(t *testing.T) {
+		_, err := bus.NewBatcher(bus.BatchConfig{}, r.record)
+		assert.EqualError(t, err, "bus: batch size or window must be positive")
+	})
+}
+
+func TestBatcher(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("flushes on size", func(t *testing.T) {
+		r := &fakeBatchRecorder{}
+		bt, err := bus.NewBatcher(bus.BatchConfig{Size: 2}, r.record)
+		require.Nil(t, err)
+
+		for i := 0; i < 5; i++ {
+			bt.Handle(ctx, bus.Event{Data: i})
+		}
+		assert.Equal(t, [][]interface{}{{0, 1}, {2, 3}}, r.received())
+		assert.Equal(t, 1, bt.Pending())
+	})
+
+	t.Run("flushes on window", func(t *testing.T) {
+		clock := newFakeClock()
+		r := &fakeBatchRecorder{}
+		bt, err := bus.NewBatcher(bus.BatchConfig{Size: 3, Window: time.Second, Clock: clock}, r.record)
+		require.Nil(t, err)
+
+		bt.Handle(ctx, bus.Event{Data: 0})
+		clock.Advance(500 * time.Millisecond)
+		bt.Handle(ctx, bus.Event{Data: 1})
+		assert.Empty(t, r.received())
+
+		clock.Advance(500 * time.Millisecond)
+		assert.Equal(t, [][]interface{}{{0, 1}}, r.received())
+	})
+
+	t.Run("ignores the window of a flushed batch", func(t *testing.T) {
+		clock := newFakeClock()
+		r := &fakeBatchRecorder{}
+		bt, err := bus.NewBatcher(bus.BatchConfig{Size: 2, Window: time.Second, Clock: clock}, r.record)
+		require.Nil(t, err)
+
+		bt.Handle(ctx, bus.Event{Data: 0})
+		bt.Handle(ctx, bus.Event{Data: 1})
+		clock.Advance(500 * time.Millisecond)
+		bt.Handle(ctx, bus.Event{Data: 2})
+
+		clock.Advance(500 * time.Millisecond)
+		assert.Equal(t, [][]interface{}{{0, 1}}, r.received())
+
+		clock.Advance(500 * time.Millisecond)
+		assert.Equal(t, [][]interface{}{{0, 1}, {2}}, r.received())
+	})
+
+	t.Run("flushes on demand", func(t *testing.T) {
+		r := &fakeBatchRecorder{}
+		bt, err := bus.NewBatcher(bus.BatchConfig{Size: 10}, r.record)
+		require.Nil(t, err)
+
+		bt.Flush(ctx)
+		assert.Empty(t, r.received())
+
+		bt.Handle(ctx, bus.Event{Data: 0})
+		bt.Flush(ctx)
+		assert.Equal(t, [][]interface{}{{0}}, r.received())
+		assert.Equal(t, 0, bt.Pending())
+	})
+}
+
+func TestBatcherHandler(t *testing.T) {
+	b := setup(topicCommentCreated)
+
+	r := &fakeBatchRecorder{}
+	bt, err := bus.NewBatcher(bus.BatchConfig{Size: 10}, r.record)
+	require.Nil(t, err)
+	b.RegisterHandler("test.batcher", bt.Handler(".*"))
+
+	ctx := context.Background()
+	require.Nil(t, b.Emit(ctx, topicCommentCreated, 1))
+	require.Nil(t, b.Emit(ctx, topicCommentCreated, 2))
+	assert.Empty(t, r.received())
+
+	require.Nil(t, b.Close(ctx))
+	assert.Equal(t, [][]interface{}{{1, 2}}, r.received())
+}
+
+func (r *fakeBatchRecorder) record(_ context.Context, events []bus.Event) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	batch := make([]interface{}, len(events))
+	for i, e := range events {
+		batch[i] = e.Data
+	}
+	r.batches = append(r.batches, batch)
+}
+
+func (r *fakeBatchRecorder) received() [][]interface{} {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return append([][]interface{}(nil), r.batches...)
+}
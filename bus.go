@@ -6,8 +6,10 @@ package bus
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"regexp"
+	"sort"
 	"sync"
 	"time"
 )
@@ -19,8 +21,40 @@ type (
 		idgen    Next
 		topics   map[string][]Handler
 		handlers map[string]Handler
+
+		descriptors map[string]TopicDescriptor
+		upcasters   map[string]upcasterChain
+
+		warn         WarnFunc
+		autoRegister *regexp.Regexp // allowlist of the auto registered topics
+		hooks        []hook
+		clock        Clock
+		limiters     map[string]*limiter // topic emit rate limiters
+		closed       bool
+
+		routes map[string][]route // delivery routes of the topics
+		groups map[string]*group  // consumer groups
+
+		store   EventStore   // appends the emitted events, optional
+		offsets OffsetStore  // committed offsets of durable handlers, optional
+		appends sync.RWMutex // held exclusively by the conditional batches
+
+		parent   *Bus            // parent of a namespace bus
+		prefix   string          // topic prefix in the parent bus
+		forward  *regexp.Regexp  // allowlist of the topics forwarded to parent
+		children map[string]*Bus // namespace buses by prefix
+
+		tenants *tenantQuotas // per tenant quotas, shared with the handlers
+		auth    Authorizer    // authorizes the emits and subscriptions, optional
 	}
 
+	// Option is a function type to configure the bus
+	Option func(*Bus) error
+
+	// WarnFunc receives the non-fatal warnings of the bus like deprecated
+	// topic emits
+	WarnFunc func(ctx context.Context, topic, msg string)
+
 	// Next is a sequential unique id generator func type
 	Next func() string
 
@@ -37,22 +71,64 @@ type (
 		Source     string      // source of the event
 		OccurredAt time.Time   // creation time in nanoseconds
 		Data       interface{} // actual event data
+		Key        string      // entity key, nil Data with a key is a tombstone
+		Tenant     string      // tenant of the event, empty when not scoped
+
+		SchemaVersion int    // payload schema version, 0 for unversioned
+		Seq           uint64 // event store sequence number, 0 when not stored
 	}
 
 	// Handler is a receiver for event reference with the given regex pattern
 	Handler struct {
-		key string
+		key   string
+		state *handlerState
 
 		// handler func to process events
 		Handle func(ctx context.Context, e Event)
 
+		// queues the event to be processed asynchronously instead of Handle,
+		// optional; commit is nil unless the handler is durable in
+		// CommitAuto mode and must be called after the event is processed
+		Queue func(ctx context.Context, e Event, commit func(ctx context.Context, e Event))
+
 		// topic matcher as regex pattern
 		Matcher string
+
+		// delivery rate limit of the handler, optional
+		RateLimit *RateLimit
+		limiter   *limiter
+
+		// flushes the buffered events of the handler on bus close, optional
+		Flush func(ctx context.Context)
+
+		// consumer group of the handler, each event is delivered to one
+		// member of the group, optional
+		Group string
+
+		// offset commit mode of a durable handler, optional
+		Commit CommitMode
+		commit func(ctx context.Context, e Event)
+
+		// tenant of the handler receiving only the events of the tenant,
+		// optional; the handlers without a tenant receive all events
+		Tenant  string
+		tenants *tenantQuotas
+
+		// authorizes the subscriptions to the topics registered later
+		allow func(topic string) bool
 	}
 
 	// EventOption is a function type to mutate event fields
 	EventOption = func(Event) Event
 
+	// emitTarget is the topic state read under the lock for an emit
+	emitTarget struct {
+		routes     []route
+		descriptor TopicDescriptor
+		upcasters  upcasterChain
+		limiter    *limiter
+	}
+
 	ctxKey int8
 )
 
@@ -63,23 +139,74 @@ const (
 	// CtxKeySource source context key
 	CtxKeySource = ctxKey(117)
 
+	// CtxKeyTenant tenant context key
+	CtxKeyTenant = ctxKey(118)
+
 	// Version syncs with package version
 	Version = "3.0.3"
 
 	empty = ""
 )
 
+// ErrClosed is returned on emits to a closed bus
+var ErrClosed = errors.New("bus: closed")
+
 // NewBus inits a new bus
-func NewBus(g IDGenerator) (*Bus, error) {
+func NewBus(g IDGenerator, opts ...Option) (*Bus, error) {
 	if g == nil {
 		return nil, fmt.Errorf("bus: Next() id generator func can't be nil")
 	}
 
-	return &Bus{
+	b := &Bus{
 		idgen:    g.Generate,
 		topics:   make(map[string][]Handler),
 		handlers: make(map[string]Handler),
-	}, nil
+
+		descriptors: make(map[string]TopicDescriptor),
+		upcasters:   make(map[string]upcasterChain),
+
+		warn:     func(context.Context, string, string) {},
+		clock:    SystemClock,
+		limiters: make(map[string]*limiter),
+
+		routes: make(map[string][]route),
+		groups: make(map[string]*group),
+
+		children: make(map[string]*Bus),
+
+		tenants: newTenantQuotas(),
+	}
+	for _, o := range opts {
+		if err := o(b); err != nil {
+			return nil, err
+		}
+	}
+	if b.forward != nil && b.parent == nil {
+		return nil, fmt.Errorf("bus: forward is only allowed for namespace buses")
+	}
+	return b, nil
+}
+
+// WithWarnFunc returns an option to receive the bus warnings
+func WithWarnFunc(fn WarnFunc) Option {
+	return func(b *Bus) error {
+		b.warn = fn
+		return nil
+	}
+}
+
+// WithAutoRegister returns an option to switch the bus from the strict mode
+// to the auto register mode; emits to the unregistered topics matching the
+// allowlist regex pattern register the topic on first use instead of failing
+func WithAutoRegister(allowlist string) Option {
+	return func(b *Bus) error {
+		re, err := regexp.Compile(allowlist)
+		if err != nil {
+			return fmt.Errorf("bus: auto register allowlist(%s) is invalid: %w", allowlist, err)
+		}
+		b.autoRegister = re
+		return nil
+	}
 }
 
 // WithID returns an option to set event's id field
@@ -114,18 +241,51 @@ func WithOccurredAt(time time.Time) EventOption {
 	}
 }
 
+// WithKey returns an option to set event's key field
+func WithKey(key string) EventOption {
+	return func(e Event) Event {
+		e.Key = key
+		return e
+	}
+}
+
+// WithTenant returns an option to set event's tenant field
+func WithTenant(tenant string) EventOption {
+	return func(e Event) Event {
+		e.Tenant = tenant
+		return e
+	}
+}
+
+// WithSchemaVersion returns an option to set event's schemaVersion field
+func WithSchemaVersion(version int) EventOption {
+	return func(e Event) Event {
+		e.SchemaVersion = version
+		return e
+	}
+}
+
 // Emit inits a new event and delivers to the interested in handlers with
 // sync safety
 func (b *Bus) Emit(ctx context.Context, topic string, data interface{}) error {
-	b.mutex.RLock()
-	handlers, ok := b.topics[topic]
-	b.mutex.RUnlock()
+	source, _ := ctx.Value(CtxKeySource).(string)
+	tenant, _ := ctx.Value(CtxKeyTenant).(string)
+	// authorized before the auto registration and the payload checks
+	if b.auth != nil {
+		if err := b.authorizeEmit(ctx, Event{Topic: topic, Source: source, Tenant: tenant}); err != nil {
+			return err
+		}
+	}
 
-	if !ok {
-		return fmt.Errorf("bus: topic(%s) not found", topic)
+	t, err := b.target(topic)
+	if err != nil {
+		return err
+	}
+
+	if err := b.checkPayload(ctx, t.descriptor, topic, data, false); err != nil {
+		return err
 	}
 
-	source, _ := ctx.Value(CtxKeySource).(string)
 	txID, _ := ctx.Value(CtxKeyTxID).(string)
 	if txID == empty {
 		txID = b.idgen()
@@ -139,29 +299,68 @@ func (b *Bus) Emit(ctx context.Context, topic string, data interface{}) error {
 		OccurredAt: time.Now(),
 		TxID:       txID,
 		Source:     source,
-	}
+		Tenant:     tenant,
 
-	for _, h := range handlers {
-		h.Handle(ctx, e)
+		SchemaVersion: t.upcasters.version,
+	}
+	if data != nil && t.descriptor.KeyFunc != nil {
+		e.Key = t.descriptor.KeyFunc(e)
 	}
 
-	return nil
+	return b.publish(ctx, t, e)
 }
 
 // EmitWithOpts inits a new event and delivers to the interested in handlers
-// with sync safety and options
+// with sync safety and options; the tenant defaults to the tenant of the ctx
+// and the tenant option can't differ from a non-empty ctx tenant
 func (b *Bus) EmitWithOpts(ctx context.Context, topic string, data interface{}, opts ...EventOption) error {
-	b.mutex.RLock()
-	handlers, ok := b.topics[topic]
-	b.mutex.RUnlock()
+	tenant, _ := ctx.Value(CtxKeyTenant).(string)
+	e := Event{Topic: topic, Data: data, Tenant: tenant}
+	for _, o := range opts {
+		e = o(e)
+	}
 
-	if !ok {
-		return fmt.Errorf("bus: topic(%s) not found", topic)
+	ctx, t, e, err := b.prepare(ctx, e)
+	if err != nil {
+		return err
 	}
+	return b.publish(ctx, t, e)
+}
 
-	e := Event{Topic: topic, Data: data}
-	for _, o := range opts {
-		e = o(e)
+// prepare checks the tenant of the event against the ctx tenant, authorizes
+// it, registers its topic in the auto register mode and applies the topic
+// options; returns the ctx of the handlers with the tenant of the event
+func (b *Bus) prepare(ctx context.Context, e Event) (context.Context, emitTarget, Event, error) {
+	tenant, _ := ctx.Value(CtxKeyTenant).(string)
+	if tenant != empty && e.Tenant != tenant {
+		return ctx, emitTarget{}, e, fmt.Errorf("bus: topic(%s) tenant(%s) does not match the ctx tenant(%s)", e.Topic, e.Tenant, tenant)
+	}
+	// the handlers emit on behalf of the tenant of the event
+	if e.Tenant != tenant {
+		ctx = context.WithValue(ctx, CtxKeyTenant, e.Tenant)
+	}
+	// authorized before the auto registration and the payload checks
+	if b.auth != nil {
+		if err := b.authorizeEmit(ctx, e); err != nil {
+			return ctx, emitTarget{}, e, err
+		}
+	}
+
+	t, err := b.target(e.Topic)
+	if err != nil {
+		return ctx, t, e, err
+	}
+
+	e, err = t.upcasters.upcast(e)
+	if err != nil {
+		return ctx, t, e, err
+	}
+
+	if err := b.checkPayload(ctx, t.descriptor, e.Topic, e.Data, e.IsTombstone()); err != nil {
+		return ctx, t, e, err
+	}
+	if e.Key == empty && e.Data != nil && t.descriptor.KeyFunc != nil {
+		e.Key = t.descriptor.KeyFunc(e)
 	}
 
 	if e.TxID == empty {
@@ -173,12 +372,7 @@ func (b *Bus) EmitWithOpts(ctx context.Context, topic string, data interface{},
 	if e.OccurredAt.IsZero() {
 		e.OccurredAt = time.Now()
 	}
-
-	for _, h := range handlers {
-		h.Handle(ctx, e)
-	}
-
-	return nil
+	return ctx, t, e, nil
 }
 
 // Topics lists the all registered topics
@@ -198,21 +392,31 @@ func (b *Bus) Topics() []string {
 // RegisterTopics registers topics and fullfills handlers
 func (b *Bus) RegisterTopics(topics ...string) {
 	b.mutex.Lock()
-	defer b.mutex.Unlock()
-
+	changes := make([]Change, 0, len(topics))
 	for _, n := range topics {
-		b.registerTopic(n)
+		if c, ok := b.registerTopic(n); ok {
+			changes = append(changes, c)
+		}
 	}
+	hooks := b.hooks
+	b.mutex.Unlock()
+
+	notifyHooks(hooks, changes...)
 }
 
 // DeregisterTopics deletes topic
 func (b *Bus) DeregisterTopics(topics ...string) {
 	b.mutex.Lock()
-	defer b.mutex.Unlock()
-
+	changes := make([]Change, 0, len(topics))
 	for _, n := range topics {
-		b.deregisterTopic(n)
+		if c, ok := b.deregisterTopic(n); ok {
+			changes = append(changes, c)
+		}
 	}
+	hooks := b.hooks
+	b.mutex.Unlock()
+
+	notifyHooks(hooks, changes...)
 }
 
 // TopicHandlerKeys returns all handlers for the topic
@@ -252,21 +456,114 @@ func (b *Bus) HandlerTopicSubscriptions(handlerKey string) []string {
 	return b.handlerTopicSubscriptions(handlerKey)
 }
 
-// RegisterHandler re/register the handler to the registry
+// RegisterHandler re/register the handler to the registry; a durable handler
+// catches up from its committed offset before receiving the live events
+//
+// On a bus with an authorizer, a denied handler is not registered and the
+// denial is passed to the warn func; see RegisterHandlerWithContext.
 func (b *Bus) RegisterHandler(key string, h Handler) {
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
+	ctx := context.Background()
+	if err := b.RegisterHandlerWithContext(ctx, key, h); err != nil {
+		b.warn(ctx, empty, err.Error())
+	}
+}
 
+// RegisterHandlerWithContext re/register the handler to the registry like
+// RegisterHandler authorizing its subscriptions for the principal of the ctx;
+// a denial returns an error wrapping ErrSubscribeDenied
+func (b *Bus) RegisterHandlerWithContext(ctx context.Context, key string, h Handler) error {
 	h.key = key
-	b.registerHandler(h)
+	h.allow = nil
+	if b.auth != nil {
+		allow, err := b.authorizeSubscribe(ctx, h)
+		if err != nil {
+			return err
+		}
+		h.allow = allow
+	}
+
+	b.mutex.Lock()
+	c := b.registerHandler(h)
+	h = b.handlers[key]
+	last, held, err := b.hold(h)
+	var granted map[string]struct{}
+	if held && h.allow != nil {
+		// the catch up of an authorized handler is limited to its
+		// subscriptions
+		granted = make(map[string]struct{})
+		for _, topic := range b.handlerTopicSubscriptions(key) {
+			granted[topic] = struct{}{}
+		}
+	}
+	hooks := b.hooks
+	b.mutex.Unlock()
+
+	notifyHooks(hooks, c)
+
+	if err != nil {
+		b.warn(ctx, empty, err.Error())
+	}
+	if held {
+		b.catchUp(h, last, granted)
+	}
+	return nil
 }
 
 // DeregisterHandler deletes handler from the registry
 func (b *Bus) DeregisterHandler(key string) {
 	b.mutex.Lock()
-	defer b.mutex.Unlock()
+	c, ok := b.deregisterHandler(key)
+	hooks := b.hooks
+	b.mutex.Unlock()
+
+	if ok {
+		notifyHooks(hooks, c)
+	}
+}
+
+// Close closes the namespace buses, flushes the handlers with a Flush func in
+// handler key order and rejects the further emits with ErrClosed
+func (b *Bus) Close(ctx context.Context) error {
+	// the children first, so their flushes can still forward to the bus
+	for _, child := range b.namespaces() {
+		if err := child.Close(ctx); err != nil {
+			return err
+		}
+	}
+
+	b.mutex.Lock()
+	if b.closed {
+		b.mutex.Unlock()
+		return nil
+	}
+	b.closed = true
+
+	keys := make([]string, 0, len(b.handlers))
+	for k, h := range b.handlers {
+		if h.Flush != nil {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	flushes := make([]func(context.Context), len(keys))
+	for i, k := range keys {
+		flushes[i] = b.handlers[k].Flush
+	}
+	b.mutex.Unlock()
+
+	for _, flush := range flushes {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		flush(ctx)
+	}
+	return nil
+}
 
-	b.deregisterHandler(key)
+// IsTombstone tells whether the event marks the deletion of its key
+func (e Event) IsTombstone() bool {
+	return e.Data == nil && e.Key != empty
 }
 
 // Generate is an implementation of IDGenerator for bus.Next fn type
@@ -274,25 +571,112 @@ func (n Next) Generate() string {
 	return n()
 }
 
-func (b *Bus) registerHandler(h Handler) {
+// target returns the emit target of the topic, registering the topic first
+// when the bus is in the auto register mode
+func (b *Bus) target(topic string) (emitTarget, error) {
+	b.mutex.RLock()
+	t, ok := b.targetLocked(topic)
+	closed := b.closed
+	b.mutex.RUnlock()
+
+	if closed {
+		return t, ErrClosed
+	}
+	if ok {
+		return t, nil
+	}
+
+	if b.autoRegister == nil || !b.autoRegister.MatchString(topic) {
+		return t, fmt.Errorf("bus: topic(%s) not found", topic)
+	}
+	return b.registerTarget(topic), nil
+}
+
+// registerTarget registers the topic unless registered meanwhile and returns
+// its emit target
+func (b *Bus) registerTarget(topic string) emitTarget {
+	b.mutex.Lock()
+	c, registered := b.registerTopic(topic)
+	t, _ := b.targetLocked(topic)
+	hooks := b.hooks
+	b.mutex.Unlock()
+
+	if registered {
+		notifyHooks(hooks, c)
+	}
+	return t
+}
+
+func (t emitTarget) deliver(ctx context.Context, e Event) {
+	for _, r := range t.routes {
+		r.deliver(ctx, e)
+	}
+}
+
+func (b *Bus) targetLocked(topic string) (emitTarget, bool) {
+	_, ok := b.topics[topic]
+	return emitTarget{
+		routes:     b.routes[topic],
+		descriptor: b.descriptors[topic],
+		upcasters:  b.upcasters[topic],
+		limiter:    b.limiters[topic],
+	}, ok
+}
+
+func (b *Bus) registerHandler(h Handler) Change {
+	// re-registered handlers keep their metrics and pause buffer
+	if prev, ok := b.handlers[h.key]; ok {
+		h.state = prev.state
+	} else {
+		h.state = &handlerState{}
+	}
+	h.limiter = newLimiter(b.clock, h.RateLimit)
+	h.commit = b.autoCommit(h)
+	h.tenants = b.tenants
+
+	before := b.handlerTopicSubscriptions(h.key)
 	b.deregisterHandler(h.key)
 	b.handlers[h.key] = h
-	for _, t := range b.handlerTopicSubscriptions(h.key) {
+
+	var after []string
+	for topic := range b.topics {
+		if h.subscribes(topic) {
+			after = append(after, topic)
+		}
+	}
+	for _, t := range after {
 		b.registerTopicHandler(t, h)
 	}
+
+	return Change{
+		Kind:       HandlerRegistered,
+		HandlerKey: h.key,
+		Added:      handlerSubscriptionDiff(h.key, after, before),
+		Removed:    handlerSubscriptionDiff(h.key, before, after),
+	}
 }
 
-func (b *Bus) deregisterHandler(handlerKey string) {
-	if _, ok := b.handlers[handlerKey]; ok {
-		for _, t := range b.handlerTopicSubscriptions(handlerKey) {
-			b.deregisterTopicHandler(t, handlerKey)
-		}
-		delete(b.handlers, handlerKey)
+func (b *Bus) deregisterHandler(handlerKey string) (Change, bool) {
+	if _, ok := b.handlers[handlerKey]; !ok {
+		return Change{}, false
+	}
+
+	topics := b.handlerTopicSubscriptions(handlerKey)
+	for _, t := range topics {
+		b.deregisterTopicHandler(t, handlerKey)
 	}
+	delete(b.handlers, handlerKey)
+
+	return Change{
+		Kind:       HandlerDeregistered,
+		HandlerKey: handlerKey,
+		Removed:    handlerSubscriptionDiff(handlerKey, topics, nil),
+	}, true
 }
 
 func (b *Bus) registerTopicHandler(topic string, h Handler) {
 	b.topics[topic] = append(b.topics[topic], h)
+	b.route(topic)
 }
 
 func (b *Bus) deregisterTopicHandler(topic, handlerKey string) {
@@ -304,40 +688,63 @@ func (b *Bus) deregisterTopicHandler(topic, handlerKey string) {
 			break
 		}
 	}
+	b.route(topic)
 }
 
-func (b *Bus) registerTopic(topic string) {
+func (b *Bus) registerTopic(topic string) (Change, bool) {
 	if _, ok := b.topics[topic]; ok {
-		return
+		return Change{}, false
 	}
 
-	b.topics[topic] = b.buildHandlers(topic)
+	handlers := b.buildHandlers(topic)
+	b.topics[topic] = handlers
+	b.route(topic)
+
+	return Change{
+		Kind:  TopicRegistered,
+		Topic: topic,
+		Added: topicSubscriptions(topic, handlers),
+	}, true
 }
 
-func (b *Bus) deregisterTopic(topic string) {
+func (b *Bus) deregisterTopic(topic string) (Change, bool) {
+	handlers, ok := b.topics[topic]
+	if !ok {
+		return Change{}, false
+	}
+
 	delete(b.topics, topic)
+	delete(b.descriptors, topic)
+	delete(b.limiters, topic)
+	delete(b.routes, topic)
+
+	return Change{
+		Kind:    TopicDeregistered,
+		Topic:   topic,
+		Removed: topicSubscriptions(topic, handlers),
+	}, true
 }
 
 func (b *Bus) buildHandlers(topic string) []Handler {
 	handlers := make([]Handler, 0)
 	for _, h := range b.handlers {
-		if matched, _ := regexp.MatchString(h.Matcher, topic); matched {
+		if h.subscribes(topic) {
 			handlers = append(handlers, h)
 		}
 	}
 	return handlers
 }
 
+// handlerTopicSubscriptions returns the topics having the handler in their
+// handlers
 func (b *Bus) handlerTopicSubscriptions(handlerKey string) []string {
 	var subscriptions []string
-	h, ok := b.handlers[handlerKey]
-	if !ok {
-		return subscriptions
-	}
-
-	for topic := range b.topics {
-		if matched, _ := regexp.MatchString(h.Matcher, topic); matched {
-			subscriptions = append(subscriptions, topic)
+	for topic, handlers := range b.topics {
+		for _, h := range handlers {
+			if h.key == handlerKey {
+				subscriptions = append(subscriptions, topic)
+				break
+			}
 		}
 	}
 	return subscriptions
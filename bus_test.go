@@ -40,6 +40,14 @@ func TestNew(t *testing.T) {
 		assert.IsType(t, &bus.Bus{}, b)
 	})
 
+	t.Run("with invalid option", func(t *testing.T) {
+		b, err := bus.NewBus(fn, bus.WithAutoRegister("["))
+		require.Nil(t, b)
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "bus: auto register allowlist([) is invalid")
+		}
+	})
+
 	t.Run("with invalid generator", func(t *testing.T) {
 		b, err := bus.NewBus(nil)
 		require.Nil(t, b)
@@ -140,6 +148,37 @@ func TestEmitWithOpts(t *testing.T) {
 	})
 }
 
+func TestEmitAutoRegister(t *testing.T) {
+	var fn bus.Next = func() string { return "fakeid" }
+	b, err := bus.NewBus(fn, bus.WithAutoRegister(`^tenant\.[a-z]+\.created$`))
+	require.Nil(t, err)
+
+	var received []string
+	b.RegisterHandler("test.handler", bus.Handler{
+		Handle:  func(_ context.Context, e bus.Event) { received = append(received, e.Topic) },
+		Matcher: ".*created$",
+	})
+	defer b.DeregisterHandler("test.handler")
+
+	ctx := context.Background()
+
+	t.Run("registers allowed topics on first use", func(t *testing.T) {
+		require.Nil(t, b.Emit(ctx, "tenant.acme.created", "1"))
+		require.Nil(t, b.EmitWithOpts(ctx, "tenant.globex.created", "2"))
+		require.Nil(t, b.Emit(ctx, "tenant.acme.created", "3"))
+
+		assert.ElementsMatch(t, []string{"tenant.acme.created", "tenant.globex.created"}, b.Topics())
+		assert.Equal(t, []string{"tenant.acme.created", "tenant.globex.created", "tenant.acme.created"}, received)
+		assert.True(t, isTopicHandler(b, "tenant.acme.created", "test.handler"))
+	})
+
+	t.Run("rejects topics out of the allowlist", func(t *testing.T) {
+		err := b.Emit(ctx, "tenant.acme.deleted", "4")
+		assert.EqualError(t, err, "bus: topic(tenant.acme.deleted) not found")
+		assert.Len(t, b.Topics(), 2)
+	})
+}
+
 func TestTopics(t *testing.T) {
 	topicNames := []string{topicUserCreated, topicUserDeleted}
 	b := setup(topicNames...)
@@ -278,6 +317,49 @@ func TestDeregisterHandler(t *testing.T) {
 	})
 }
 
+func TestClose(t *testing.T) {
+	b := setup(topicCommentCreated)
+	ctx := context.Background()
+
+	var flushed []string
+	for _, key := range []string{"test.handler.2", "test.handler.1", "test.handler.3"} {
+		key := key
+		h := fakeHandler(".*")
+		if key != "test.handler.3" {
+			h.Flush = func(context.Context) { flushed = append(flushed, key) }
+		}
+		b.RegisterHandler(key, h)
+	}
+
+	t.Run("flushes handlers", func(t *testing.T) {
+		require.Nil(t, b.Close(ctx))
+		assert.Equal(t, []string{"test.handler.1", "test.handler.2"}, flushed)
+	})
+
+	t.Run("rejects emits", func(t *testing.T) {
+		assert.Equal(t, bus.ErrClosed, b.Emit(ctx, topicCommentCreated, "data"))
+		assert.Equal(t, bus.ErrClosed, b.EmitWithOpts(ctx, topicCommentCreated, "data"))
+	})
+
+	t.Run("closes once", func(t *testing.T) {
+		require.Nil(t, b.Close(ctx))
+		assert.Len(t, flushed, 2)
+	})
+
+	t.Run("with cancelled ctx", func(t *testing.T) {
+		b := setup()
+		b.RegisterHandler("test.handler", bus.Handler{
+			Handle:  func(context.Context, bus.Event) {},
+			Flush:   func(context.Context) { t.Fatal("flushed") },
+			Matcher: ".*",
+		})
+
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+		assert.Equal(t, context.Canceled, b.Close(ctx))
+	})
+}
+
 func setup(topicNames ...string) *bus.Bus {
 	var fn bus.Next = func() string { return "fakeid" }
 	b, _ := bus.NewBus(fn)
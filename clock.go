@@ -0,0 +1,68 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package bus
+
+import (
+	"context"
+	"time"
+)
+
+type (
+	// Clock is the time source of the time based features like rate limits,
+	// it can be replaced to make them testable
+	Clock interface {
+		Now() time.Time
+
+		// AfterFunc calls the func in its own goroutine after the duration
+		AfterFunc(d time.Duration, f func()) Timer
+	}
+
+	// Timer is a scheduled func call of a Clock
+	Timer interface {
+		// Stop prevents the call, returns false if the call already happened
+		Stop() bool
+	}
+
+	systemClock struct{}
+)
+
+// SystemClock is the Clock implementation using the time package
+var SystemClock Clock = systemClock{}
+
+// WithClock returns an option to set the clock of the bus
+func WithClock(c Clock) Option {
+	return func(b *Bus) error {
+		if c == nil {
+			return errNilClock
+		}
+		b.clock = c
+		return nil
+	}
+}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// sleep waits for the duration on the clock or until the ctx is done
+func sleep(ctx context.Context, c Clock, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+
+	done := make(chan struct{})
+	t := c.AfterFunc(d, func() { close(done) })
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		t.Stop()
+		return ctx.Err()
+	}
+}
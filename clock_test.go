@@ -0,0 +1,118 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package bus_test
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mustafaturan/bus/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type (
+	fakeClock struct {
+		mutex  sync.Mutex
+		now    time.Time
+		timers []*fakeTimer
+	}
+
+	fakeTimer struct {
+		clock *fakeClock
+		at    time.Time
+		f     func()
+	}
+)
+
+func TestWithClock(t *testing.T) {
+	var fn bus.Next = func() string { return "fakeid" }
+
+	t.Run("with nil clock", func(t *testing.T) {
+		_, err := bus.NewBus(fn, bus.WithClock(nil))
+		assert.EqualError(t, err, "bus: clock can't be nil")
+	})
+
+	t.Run("with clock", func(t *testing.T) {
+		_, err := bus.NewBus(fn, bus.WithClock(newFakeClock()))
+		assert.Nil(t, err)
+	})
+}
+
+func TestSystemClock(t *testing.T) {
+	done := make(chan struct{})
+	bus.SystemClock.AfterFunc(time.Millisecond, func() { close(done) })
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("timer did not fire")
+	}
+	assert.WithinDuration(t, time.Now(), bus.SystemClock.Now(), time.Second)
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) bus.Timer {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	t := &fakeTimer{clock: c, at: c.now.Add(d), f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the clock and calls the due timer funcs in order on the
+// caller goroutine
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	c.now = c.now.Add(d)
+	sort.SliceStable(c.timers, func(i, j int) bool { return c.timers[i].at.Before(c.timers[j].at) })
+
+	var due []*fakeTimer
+	for len(c.timers) > 0 && !c.timers[0].at.After(c.now) {
+		due = append(due, c.timers[0])
+		c.timers = c.timers[1:]
+	}
+	c.mutex.Unlock()
+
+	for _, t := range due {
+		t.f()
+	}
+}
+
+// WaitTimers blocks until the given number of timers are scheduled
+func (c *fakeClock) WaitTimers(t *testing.T, n int) {
+	require.Eventually(t, func() bool {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+
+		return len(c.timers) >= n
+	}, time.Second, time.Millisecond)
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+
+	for i, timer := range t.clock.timers {
+		if timer == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,315 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package bus
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type (
+	// CloudEvent is the CloudEvents 1.0 representation of an Event
+	CloudEvent struct {
+		SpecVersion     string          `json:"specversion"`
+		ID              string          `json:"id"`
+		Source          string          `json:"source"`
+		Type            string          `json:"type"`
+		Time            time.Time       `json:"time,omitempty"`
+		DataContentType string          `json:"datacontenttype,omitempty"`
+		TxID            string          `json:"txid,omitempty"`
+		SchemaVersion   int             `json:"schemaversion,omitempty"`
+		PartitionKey    string          `json:"partitionkey,omitempty"`
+		Tenant          string          `json:"tenant,omitempty"`
+		Data            json.RawMessage `json:"data,omitempty"`
+	}
+)
+
+const (
+	// CloudEventsSpecVersion is the supported CloudEvents spec version
+	CloudEventsSpecVersion = "1.0"
+
+	// CloudEventsContentType is the structured mode JSON content type
+	CloudEventsContentType = "application/cloudevents+json"
+
+	// CloudEventsDataContentType is the content type of the event data
+	CloudEventsDataContentType = "application/json"
+
+	ceHeaderPrefix      = "ce-"
+	ceHeaderSpecVersion = ceHeaderPrefix + "specversion"
+	ceHeaderID          = ceHeaderPrefix + "id"
+	ceHeaderSource      = ceHeaderPrefix + "source"
+	ceHeaderType        = ceHeaderPrefix + "type"
+	ceHeaderTime        = ceHeaderPrefix + "time"
+	ceHeaderTxID        = ceHeaderPrefix + "txid"
+	ceHeaderSchemaVer   = ceHeaderPrefix + "schemaversion"
+	ceHeaderKey         = ceHeaderPrefix + "partitionkey"
+	ceHeaderTenant      = ceHeaderPrefix + "tenant"
+	headerContentType   = "Content-Type"
+)
+
+// NewCloudEvent maps the event to a CloudEvent; the event data is encoded as
+// JSON unless it is already a json.RawMessage, the events without a source
+// are rejected since it is a required attribute
+func NewCloudEvent(e Event) (CloudEvent, error) {
+	data, err := encodeCloudEventData(e.Data)
+	if err != nil {
+		return CloudEvent{}, err
+	}
+
+	ce := CloudEvent{
+		SpecVersion: CloudEventsSpecVersion,
+		ID:          e.ID,
+		Source:      e.Source,
+		Type:        e.Topic,
+		Time:        e.OccurredAt,
+		TxID:        e.TxID,
+		Data:        data,
+
+		SchemaVersion: e.SchemaVersion,
+		PartitionKey:  e.Key,
+		Tenant:        e.Tenant,
+	}
+	if data != nil {
+		ce.DataContentType = CloudEventsDataContentType
+	}
+	if err := ce.Validate(); err != nil {
+		return CloudEvent{}, err
+	}
+	return ce, nil
+}
+
+// MarshalJSON encodes the CloudEvent omitting the zero time, since the
+// encoding/json omitempty option doesn't apply to the structs
+func (ce CloudEvent) MarshalJSON() ([]byte, error) {
+	type plain CloudEvent
+	var t *time.Time
+	if !ce.Time.IsZero() {
+		t = &ce.Time
+	}
+	return json.Marshal(struct {
+		plain
+		Time *time.Time `json:"time,omitempty"`
+	}{plain: plain(ce), Time: t})
+}
+
+// Event maps the CloudEvent back to an event; the data is kept as
+// json.RawMessage so the caller can decode it into the topic payload type
+func (ce CloudEvent) Event() Event {
+	e := Event{
+		ID:         ce.ID,
+		TxID:       ce.TxID,
+		Topic:      ce.Type,
+		Source:     ce.Source,
+		OccurredAt: ce.Time,
+		Key:        ce.PartitionKey,
+		Tenant:     ce.Tenant,
+
+		SchemaVersion: ce.SchemaVersion,
+	}
+	if ce.Data != nil {
+		e.Data = ce.Data
+	}
+	return e
+}
+
+// Validate checks the required CloudEvents attributes
+func (ce CloudEvent) Validate() error {
+	if ce.SpecVersion != CloudEventsSpecVersion {
+		return fmt.Errorf("bus: cloudevents specversion(%s) is not supported", ce.SpecVersion)
+	}
+	if ce.ID == empty {
+		return fmt.Errorf("bus: cloudevents id can't be empty")
+	}
+	if ce.Source == empty {
+		return fmt.Errorf("bus: cloudevents source can't be empty")
+	}
+	if ce.Type == empty {
+		return fmt.Errorf("bus: cloudevents type can't be empty")
+	}
+	return nil
+}
+
+// MarshalCloudEvent encodes the event in CloudEvents structured JSON mode
+func MarshalCloudEvent(e Event) ([]byte, error) {
+	ce, err := NewCloudEvent(e)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(ce)
+}
+
+// UnmarshalCloudEvent decodes an event from CloudEvents structured JSON mode
+func UnmarshalCloudEvent(data []byte) (Event, error) {
+	var ce CloudEvent
+	if err := json.Unmarshal(data, &ce); err != nil {
+		return Event{}, fmt.Errorf("bus: cloudevents decode failed: %w", err)
+	}
+	if err := ce.Validate(); err != nil {
+		return Event{}, err
+	}
+	return ce.Event(), nil
+}
+
+// EncodeCloudEventBinary writes the event attributes into the headers in
+// CloudEvents binary mode and returns the encoded data as the body; the
+// attribute values are percent-encoded as the HTTP binding requires
+func EncodeCloudEventBinary(e Event, h http.Header) ([]byte, error) {
+	ce, err := NewCloudEvent(e)
+	if err != nil {
+		return nil, err
+	}
+
+	h.Set(ceHeaderSpecVersion, ce.SpecVersion)
+	h.Set(ceHeaderID, encodeCloudEventHeader(ce.ID))
+	h.Set(ceHeaderSource, encodeCloudEventHeader(ce.Source))
+	h.Set(ceHeaderType, encodeCloudEventHeader(ce.Type))
+	if !ce.Time.IsZero() {
+		h.Set(ceHeaderTime, ce.Time.Format(time.RFC3339Nano))
+	}
+	if ce.TxID != empty {
+		h.Set(ceHeaderTxID, encodeCloudEventHeader(ce.TxID))
+	}
+	if ce.SchemaVersion != 0 {
+		h.Set(ceHeaderSchemaVer, strconv.Itoa(ce.SchemaVersion))
+	}
+	if ce.PartitionKey != empty {
+		h.Set(ceHeaderKey, encodeCloudEventHeader(ce.PartitionKey))
+	}
+	if ce.Tenant != empty {
+		h.Set(ceHeaderTenant, encodeCloudEventHeader(ce.Tenant))
+	}
+	if ce.DataContentType != empty {
+		h.Set(headerContentType, ce.DataContentType)
+	}
+	return ce.Data, nil
+}
+
+// DecodeCloudEventBinary reads an event from headers and body encoded in
+// CloudEvents binary mode
+func DecodeCloudEventBinary(h http.Header, body []byte) (Event, error) {
+	ce := CloudEvent{
+		SpecVersion:     h.Get(ceHeaderSpecVersion),
+		DataContentType: h.Get(headerContentType),
+	}
+	attributes := []struct {
+		header string
+		value  *string
+	}{
+		{ceHeaderID, &ce.ID},
+		{ceHeaderSource, &ce.Source},
+		{ceHeaderType, &ce.Type},
+		{ceHeaderTxID, &ce.TxID},
+		{ceHeaderKey, &ce.PartitionKey},
+		{ceHeaderTenant, &ce.Tenant},
+	}
+	for _, a := range attributes {
+		v, err := url.PathUnescape(h.Get(a.header))
+		if err != nil {
+			return Event{}, fmt.Errorf("bus: cloudevents header(%s) is invalid: %w", a.header, err)
+		}
+		*a.value = v
+	}
+	if err := ce.Validate(); err != nil {
+		return Event{}, err
+	}
+
+	if t := h.Get(ceHeaderTime); t != empty {
+		occurredAt, err := time.Parse(time.RFC3339Nano, t)
+		if err != nil {
+			return Event{}, fmt.Errorf("bus: cloudevents time(%s) is invalid: %w", t, err)
+		}
+		ce.Time = occurredAt
+	}
+	if v := h.Get(ceHeaderSchemaVer); v != empty {
+		version, err := strconv.Atoi(v)
+		if err != nil {
+			return Event{}, fmt.Errorf("bus: cloudevents schemaversion(%s) is invalid: %w", v, err)
+		}
+		ce.SchemaVersion = version
+	}
+	if len(body) > 0 {
+		ce.Data = json.RawMessage(body)
+	}
+	return ce.Event(), nil
+}
+
+// WriteCloudEventRequest sets the request headers and body for the event in
+// either structured or binary CloudEvents HTTP mode
+func WriteCloudEventRequest(r *http.Request, e Event, structured bool) error {
+	var (
+		body []byte
+		err  error
+	)
+	if structured {
+		body, err = MarshalCloudEvent(e)
+		r.Header.Set(headerContentType, CloudEventsContentType)
+	} else {
+		body, err = EncodeCloudEventBinary(e, r.Header)
+	}
+	if err != nil {
+		return err
+	}
+
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+	return nil
+}
+
+// ReadCloudEventRequest decodes the event from the request, detecting the
+// structured or binary CloudEvents HTTP mode from the content type
+func ReadCloudEventRequest(r *http.Request) (Event, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return Event{}, fmt.Errorf("bus: cloudevents read failed: %w", err)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get(headerContentType))
+	if mediaType == CloudEventsContentType {
+		return UnmarshalCloudEvent(body)
+	}
+	return DecodeCloudEventBinary(r.Header, body)
+}
+
+// encodeCloudEventHeader percent-encodes the space, double quote, percent and
+// the bytes outside the printable ASCII range of the header value
+func encodeCloudEventHeader(v string) string {
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		if c <= ' ' || c > '~' || c == '"' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+func encodeCloudEventData(data interface{}) (json.RawMessage, error) {
+	switch d := data.(type) {
+	case nil:
+		return nil, nil
+	case json.RawMessage:
+		return d, nil
+	}
+
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("bus: cloudevents data encode failed: %w", err)
+	}
+	return encoded, nil
+}
@@ -0,0 +1,208 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package bus_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mustafaturan/bus/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewCloudEvent(t *testing.T) {
+	e := fakeCloudEventsEvent()
+
+	ce, err := bus.NewCloudEvent(e)
+	require.Nil(t, err)
+
+	assert := assert.New(t)
+	assert.Equal(bus.CloudEventsSpecVersion, ce.SpecVersion)
+	assert.Equal(e.ID, ce.ID)
+	assert.Equal(e.Source, ce.Source)
+	assert.Equal(e.Topic, ce.Type)
+	assert.Equal(e.TxID, ce.TxID)
+	assert.Equal(e.SchemaVersion, ce.SchemaVersion)
+	assert.True(e.OccurredAt.Equal(ce.Time))
+	assert.Equal(bus.CloudEventsDataContentType, ce.DataContentType)
+	assert.JSONEq(`{"orderID":"123456"}`, string(ce.Data))
+
+	t.Run("with empty source", func(t *testing.T) {
+		e := e
+		e.Source = ""
+		_, err := bus.NewCloudEvent(e)
+		assert.EqualError(err, "bus: cloudevents source can't be empty")
+	})
+}
+
+func TestMarshalCloudEvent(t *testing.T) {
+	e := fakeCloudEventsEvent()
+
+	t.Run("round trips the event", func(t *testing.T) {
+		data, err := bus.MarshalCloudEvent(e)
+		require.Nil(t, err)
+
+		got, err := bus.UnmarshalCloudEvent(data)
+		require.Nil(t, err)
+		assertCloudEventsEvent(t, e, got)
+	})
+
+	t.Run("with nil data", func(t *testing.T) {
+		e := e
+		e.Data = nil
+
+		data, err := bus.MarshalCloudEvent(e)
+		require.Nil(t, err)
+		assert.NotContains(t, string(data), "datacontenttype")
+
+		got, err := bus.UnmarshalCloudEvent(data)
+		require.Nil(t, err)
+		assert.Nil(t, got.Data)
+	})
+
+	t.Run("with zero time", func(t *testing.T) {
+		e := e
+		e.OccurredAt = time.Time{}
+
+		data, err := bus.MarshalCloudEvent(e)
+		require.Nil(t, err)
+		assert.NotContains(t, string(data), `"time"`)
+
+		got, err := bus.UnmarshalCloudEvent(data)
+		require.Nil(t, err)
+		assert.True(t, got.OccurredAt.IsZero())
+	})
+
+	t.Run("with unsupported spec version", func(t *testing.T) {
+		_, err := bus.UnmarshalCloudEvent([]byte(`{"specversion":"0.3","id":"1","type":"t"}`))
+		if assert.Error(t, err) {
+			assert.Equal(t, "bus: cloudevents specversion(0.3) is not supported", err.Error())
+		}
+	})
+
+	t.Run("with missing id", func(t *testing.T) {
+		_, err := bus.UnmarshalCloudEvent([]byte(`{"specversion":"1.0","type":"t"}`))
+		if assert.Error(t, err) {
+			assert.Equal(t, "bus: cloudevents id can't be empty", err.Error())
+		}
+	})
+
+	t.Run("with missing source", func(t *testing.T) {
+		_, err := bus.UnmarshalCloudEvent([]byte(`{"specversion":"1.0","id":"1","type":"t"}`))
+		assert.EqualError(t, err, "bus: cloudevents source can't be empty")
+	})
+}
+
+func TestEncodeCloudEventBinary(t *testing.T) {
+	e := fakeCloudEventsEvent()
+
+	h := make(http.Header)
+	body, err := bus.EncodeCloudEventBinary(e, h)
+	require.Nil(t, err)
+
+	assert := assert.New(t)
+	assert.Equal("1.0", h.Get("ce-specversion"))
+	assert.Equal(e.ID, h.Get("ce-id"))
+	assert.Equal(e.Topic, h.Get("ce-type"))
+	assert.Equal(e.TxID, h.Get("ce-txid"))
+	assert.Equal("2", h.Get("ce-schemaversion"))
+	assert.Equal(e.Key, h.Get("ce-partitionkey"))
+	assert.Equal(e.Tenant, h.Get("ce-tenant"))
+	assert.Equal(bus.CloudEventsDataContentType, h.Get("Content-Type"))
+
+	got, err := bus.DecodeCloudEventBinary(h, body)
+	require.Nil(t, err)
+	assertCloudEventsEvent(t, e, got)
+
+	t.Run("percent-encodes the attributes", func(t *testing.T) {
+		e := e
+		e.Source, e.Tenant, e.Key = "/orders 100%", "acme \"ü\"", "a\r\nb"
+		h := make(http.Header)
+		body, err := bus.EncodeCloudEventBinary(e, h)
+		require.Nil(t, err)
+
+		assert.Equal("/orders%20100%25", h.Get("ce-source"))
+		assert.Equal("acme%20%22%C3%BC%22", h.Get("ce-tenant"))
+		assert.Equal("a%0D%0Ab", h.Get("ce-partitionkey"))
+
+		got, err := bus.DecodeCloudEventBinary(h, body)
+		require.Nil(t, err)
+		assertCloudEventsEvent(t, e, got)
+	})
+
+	t.Run("with zero time", func(t *testing.T) {
+		e := e
+		e.OccurredAt = time.Time{}
+		h := make(http.Header)
+		_, err := bus.EncodeCloudEventBinary(e, h)
+		require.Nil(t, err)
+		assert.Empty(h.Get("ce-time"))
+	})
+
+	t.Run("with invalid percent-encoding", func(t *testing.T) {
+		h := h.Clone()
+		h.Set("ce-tenant", "%zz")
+		_, err := bus.DecodeCloudEventBinary(h, body)
+		assert.EqualError(err, `bus: cloudevents header(ce-tenant) is invalid: invalid URL escape "%zz"`)
+	})
+
+	t.Run("with invalid time", func(t *testing.T) {
+		h.Set("ce-time", "yesterday")
+		_, err := bus.DecodeCloudEventBinary(h, body)
+		assert.Error(err)
+	})
+}
+
+func TestCloudEventRequest(t *testing.T) {
+	e := fakeCloudEventsEvent()
+
+	for _, structured := range []bool{true, false} {
+		r, err := http.NewRequest(http.MethodPost, "http://localhost/events", nil)
+		require.Nil(t, err)
+
+		require.Nil(t, bus.WriteCloudEventRequest(r, e, structured))
+		if structured {
+			assert.Equal(t, bus.CloudEventsContentType, r.Header.Get("Content-Type"))
+		}
+
+		got, err := bus.ReadCloudEventRequest(r)
+		require.Nil(t, err)
+		assertCloudEventsEvent(t, e, got)
+	}
+}
+
+func fakeCloudEventsEvent() bus.Event {
+	return bus.Event{
+		ID:         "id",
+		TxID:       "tx",
+		Topic:      "order.received",
+		Source:     "/orders",
+		OccurredAt: time.Date(2021, 2, 3, 4, 5, 6, 7, time.UTC),
+		Data:       map[string]string{"orderID": "123456"},
+		Key:        "123456",
+		Tenant:     "acme",
+
+		SchemaVersion: 2,
+	}
+}
+
+func assertCloudEventsEvent(t *testing.T, want, got bus.Event) {
+	assert := assert.New(t)
+	assert.Equal(want.ID, got.ID)
+	assert.Equal(want.TxID, got.TxID)
+	assert.Equal(want.Topic, got.Topic)
+	assert.Equal(want.Source, got.Source)
+	assert.Equal(want.SchemaVersion, got.SchemaVersion)
+	assert.Equal(want.Key, got.Key)
+	assert.Equal(want.Tenant, got.Tenant)
+	assert.True(want.OccurredAt.Equal(got.OccurredAt))
+
+	var data map[string]string
+	require.Nil(t, json.Unmarshal(got.Data.(json.RawMessage), &data))
+	assert.Equal(want.Data, data)
+}
@@ -0,0 +1,222 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package bus
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sync"
+)
+
+type (
+	// Codec encodes and decodes event payloads
+	Codec interface {
+		// Name is the unique codec name stored in the event envelopes
+		Name() string
+		Marshal(v interface{}) ([]byte, error)
+		Unmarshal(data []byte, v interface{}) error
+	}
+
+	// JSONCodec is a Codec implementation using encoding/json
+	JSONCodec struct{}
+
+	// GobCodec is a Codec implementation using encoding/gob
+	GobCodec struct{}
+
+	// BinaryCodec is a compact Codec implementation for scalar, string and
+	// byte slice payloads and the types implementing encoding.BinaryMarshaler
+	// and encoding.BinaryUnmarshaler
+	//
+	// The struct, map and other slice payloads can't be encoded unless they
+	// implement both interfaces; Marshal returns an error for them.
+	BinaryCodec struct{}
+
+	// TypeRegistry maps topics to payload types for decoding
+	TypeRegistry struct {
+		mutex sync.RWMutex
+		types map[string]reflect.Type
+	}
+)
+
+const (
+	codecNameJSON   = "json"
+	codecNameGob    = "gob"
+	codecNameBinary = "binary"
+)
+
+// Name returns the codec name
+func (JSONCodec) Name() string {
+	return codecNameJSON
+}
+
+// Marshal encodes the value as JSON
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal decodes the JSON data into the value
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// Name returns the codec name
+func (GobCodec) Name() string {
+	return codecNameGob
+}
+
+// Marshal encodes the value with gob
+func (GobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal decodes the gob data into the value
+func (GobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// Name returns the codec name
+func (BinaryCodec) Name() string {
+	return codecNameBinary
+}
+
+// Marshal encodes the value in a compact binary form
+func (BinaryCodec) Marshal(v interface{}) ([]byte, error) {
+	if m, ok := v.(encoding.BinaryMarshaler); ok {
+		return m.MarshalBinary()
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.String:
+		return []byte(rv.String()), nil
+	case reflect.Slice:
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			return append([]byte(nil), rv.Bytes()...), nil
+		}
+	case reflect.Bool:
+		if rv.Bool() {
+			return []byte{1}, nil
+		}
+		return []byte{0}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		buf := make([]byte, binary.MaxVarintLen64)
+		return buf[:binary.PutVarint(buf, rv.Int())], nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		buf := make([]byte, binary.MaxVarintLen64)
+		return buf[:binary.PutUvarint(buf, rv.Uint())], nil
+	case reflect.Float32:
+		buf := make([]byte, 4)
+		binary.BigEndian.PutUint32(buf, math.Float32bits(float32(rv.Float())))
+		return buf, nil
+	case reflect.Float64:
+		buf := make([]byte, 8)
+		binary.BigEndian.PutUint64(buf, math.Float64bits(rv.Float()))
+		return buf, nil
+	}
+	return nil, fmt.Errorf("bus: binary codec does not support type(%T)", v)
+}
+
+// Unmarshal decodes the compact binary data into the value
+func (BinaryCodec) Unmarshal(data []byte, v interface{}) error {
+	if u, ok := v.(encoding.BinaryUnmarshaler); ok {
+		return u.UnmarshalBinary(data)
+	}
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("bus: binary codec requires a non-nil pointer, got type(%T)", v)
+	}
+
+	rv = rv.Elem()
+	switch rv.Kind() {
+	case reflect.String:
+		rv.SetString(string(data))
+		return nil
+	case reflect.Slice:
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			rv.SetBytes(append([]byte(nil), data...))
+			return nil
+		}
+	case reflect.Bool:
+		if len(data) != 1 {
+			return fmt.Errorf("bus: binary codec invalid bool length(%d)", len(data))
+		}
+		rv.SetBool(data[0] == 1)
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, n := binary.Varint(data)
+		if n <= 0 || n != len(data) || rv.OverflowInt(i) {
+			return fmt.Errorf("bus: binary codec invalid int for type(%s)", rv.Type())
+		}
+		rv.SetInt(i)
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, n := binary.Uvarint(data)
+		if n <= 0 || n != len(data) || rv.OverflowUint(u) {
+			return fmt.Errorf("bus: binary codec invalid uint for type(%s)", rv.Type())
+		}
+		rv.SetUint(u)
+		return nil
+	case reflect.Float32:
+		if len(data) != 4 {
+			return fmt.Errorf("bus: binary codec invalid float32 length(%d)", len(data))
+		}
+		rv.SetFloat(float64(math.Float32frombits(binary.BigEndian.Uint32(data))))
+		return nil
+	case reflect.Float64:
+		if len(data) != 8 {
+			return fmt.Errorf("bus: binary codec invalid float64 length(%d)", len(data))
+		}
+		rv.SetFloat(math.Float64frombits(binary.BigEndian.Uint64(data)))
+		return nil
+	}
+	return fmt.Errorf("bus: binary codec does not support type(%s)", rv.Type())
+}
+
+// NewTypeRegistry inits a new payload type registry
+func NewTypeRegistry() *TypeRegistry {
+	return &TypeRegistry{types: make(map[string]reflect.Type)}
+}
+
+// Register maps the topic to the type of the given sample payload; it panics
+// on a nil sample, since its type can't be decoded into
+func (r *TypeRegistry) Register(topic string, sample interface{}) {
+	if sample == nil {
+		panic(fmt.Sprintf("bus: topic(%s) payload sample can't be nil", topic))
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.types[topic] = reflect.TypeOf(sample)
+}
+
+// Type returns the registered payload type of the topic
+func (r *TypeRegistry) Type(topic string) (reflect.Type, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	t, ok := r.types[topic]
+	return t, ok
+}
+
+// New returns a pointer to a new zero value of the topic payload type
+func (r *TypeRegistry) New(topic string) (interface{}, bool) {
+	t, ok := r.Type(topic)
+	if !ok {
+		return nil, false
+	}
+	return reflect.New(t).Interface(), true
+}
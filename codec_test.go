@@ -0,0 +1,95 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package bus_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mustafaturan/bus/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeOrder struct {
+	ID     string
+	Amount float64
+}
+
+func TestCodecs(t *testing.T) {
+	codecs := []bus.Codec{bus.JSONCodec{}, bus.GobCodec{}}
+	for _, c := range codecs {
+		t.Run(c.Name(), func(t *testing.T) {
+			data, err := c.Marshal(fakeOrder{ID: "1", Amount: 11.2})
+			require.Nil(t, err)
+
+			var got fakeOrder
+			require.Nil(t, c.Unmarshal(data, &got))
+			assert.Equal(t, fakeOrder{ID: "1", Amount: 11.2}, got)
+		})
+	}
+}
+
+func TestBinaryCodec(t *testing.T) {
+	c := bus.BinaryCodec{}
+	assert.Equal(t, "binary", c.Name())
+
+	tests := []interface{}{
+		"a string", []byte("bytes"), true, false, -42, int8(-8), uint(42),
+		uint16(65535), float32(1.5), 3.14, time.Date(2021, 1, 2, 3, 4, 5, 6, time.UTC),
+	}
+	for _, want := range tests {
+		data, err := c.Marshal(want)
+		require.Nil(t, err)
+
+		got := reflect.New(reflect.TypeOf(want))
+		require.Nil(t, c.Unmarshal(data, got.Interface()))
+		assert.Equal(t, want, got.Elem().Interface())
+	}
+
+	t.Run("with unsupported type", func(t *testing.T) {
+		_, err := c.Marshal(fakeOrder{})
+		if assert.Error(t, err) {
+			assert.Equal(t, "bus: binary codec does not support type(bus_test.fakeOrder)", err.Error())
+		}
+	})
+
+	t.Run("with overflow", func(t *testing.T) {
+		data, err := c.Marshal(1024)
+		require.Nil(t, err)
+
+		var got int8
+		assert.Error(t, c.Unmarshal(data, &got))
+	})
+
+	t.Run("with non pointer", func(t *testing.T) {
+		assert.Error(t, c.Unmarshal([]byte{1}, true))
+	})
+}
+
+func TestTypeRegistry(t *testing.T) {
+	r := bus.NewTypeRegistry()
+	r.Register(topicCommentCreated, fakeOrder{})
+
+	typ, ok := r.Type(topicCommentCreated)
+	assert.True(t, ok)
+	assert.Equal(t, reflect.TypeOf(fakeOrder{}), typ)
+
+	v, ok := r.New(topicCommentCreated)
+	assert.True(t, ok)
+	assert.IsType(t, &fakeOrder{}, v)
+
+	_, ok = r.New(topicCommentDeleted)
+	assert.False(t, ok)
+
+	t.Run("with nil sample", func(t *testing.T) {
+		assert.PanicsWithValue(t, "bus: topic(comment.deleted) payload sample can't be nil", func() {
+			r.Register(topicCommentDeleted, nil)
+		})
+		_, ok := r.Type(topicCommentDeleted)
+		assert.False(t, ok)
+	})
+}
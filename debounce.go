@@ -0,0 +1,226 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package bus
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+type (
+	// KeyFunc extracts a grouping key from the event, i.e. an entity id
+	KeyFunc func(e Event) string
+
+	// WindowConfig holds the options of the per key window operators
+	WindowConfig struct {
+		Window time.Duration
+		Key    KeyFunc
+		Clock  Clock // defaults to SystemClock
+	}
+
+	// Debouncer is a handler adapter delivering only the latest event of a
+	// key once no other event arrived for the key within the window
+	//
+	// The events are delivered on the clock timer goroutine with a
+	// background ctx.
+	Debouncer struct {
+		config  WindowConfig
+		handle  func(ctx context.Context, e Event)
+		mutex   sync.Mutex
+		pending map[string]*debounced
+	}
+
+	// Throttler is a handler adapter delivering the first event of a key
+	// right away and then at most one event, the latest, per window
+	//
+	// The first events are delivered on the emitter goroutine, the latest
+	// events on the clock timer goroutine with a background ctx.
+	Throttler struct {
+		config  WindowConfig
+		handle  func(ctx context.Context, e Event)
+		mutex   sync.Mutex
+		windows map[string]*throttled
+	}
+
+	debounced struct {
+		e     Event
+		timer Timer
+	}
+
+	throttled struct {
+		latest  Event
+		pending bool
+		timer   Timer
+	}
+)
+
+// NewDebouncer inits a new debouncer
+func NewDebouncer(c WindowConfig, fn func(ctx context.Context, e Event)) (*Debouncer, error) {
+	c, err := c.normalize(fn)
+	if err != nil {
+		return nil, err
+	}
+	return &Debouncer{config: c, handle: fn, pending: make(map[string]*debounced)}, nil
+}
+
+// Handler returns a bus handler for the matcher delivering the events to the
+// debouncer and flushing it on bus close
+func (d *Debouncer) Handler(matcher string) Handler {
+	return Handler{Handle: d.Handle, Flush: d.Flush, Matcher: matcher}
+}
+
+// Handle replaces the pending event of the key and restarts its window
+func (d *Debouncer) Handle(_ context.Context, e Event) {
+	key := d.config.Key(e)
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if prev, ok := d.pending[key]; ok {
+		prev.timer.Stop()
+	}
+
+	p := &debounced{e: e}
+	p.timer = d.config.Clock.AfterFunc(d.config.Window, func() { d.fire(key, p) })
+	d.pending[key] = p
+}
+
+// Flush delivers the pending events right away in key order
+func (d *Debouncer) Flush(ctx context.Context) {
+	d.mutex.Lock()
+	keys := make([]string, 0, len(d.pending))
+	for k, p := range d.pending {
+		p.timer.Stop()
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	events := make([]Event, len(keys))
+	for i, k := range keys {
+		events[i] = d.pending[k].e
+		delete(d.pending, k)
+	}
+	d.mutex.Unlock()
+
+	for _, e := range events {
+		d.handle(ctx, e)
+	}
+}
+
+func (d *Debouncer) fire(key string, p *debounced) {
+	d.mutex.Lock()
+	// the timer of a replaced or flushed event
+	if d.pending[key] != p {
+		d.mutex.Unlock()
+		return
+	}
+	delete(d.pending, key)
+	d.mutex.Unlock()
+
+	d.handle(context.Background(), p.e)
+}
+
+// NewThrottler inits a new throttler
+func NewThrottler(c WindowConfig, fn func(ctx context.Context, e Event)) (*Throttler, error) {
+	c, err := c.normalize(fn)
+	if err != nil {
+		return nil, err
+	}
+	return &Throttler{config: c, handle: fn, windows: make(map[string]*throttled)}, nil
+}
+
+// Handler returns a bus handler for the matcher delivering the events to the
+// throttler and flushing it on bus close
+func (t *Throttler) Handler(matcher string) Handler {
+	return Handler{Handle: t.Handle, Flush: t.Flush, Matcher: matcher}
+}
+
+// Handle delivers the event if the key has no open window, otherwise keeps it
+// as the latest event of the window
+func (t *Throttler) Handle(ctx context.Context, e Event) {
+	key := t.config.Key(e)
+
+	t.mutex.Lock()
+	if w, ok := t.windows[key]; ok {
+		w.latest, w.pending = e, true
+		t.mutex.Unlock()
+		return
+	}
+	t.open(key)
+	t.mutex.Unlock()
+
+	t.handle(ctx, e)
+}
+
+// Flush delivers the latest events of the open windows right away in key
+// order and closes the windows
+func (t *Throttler) Flush(ctx context.Context) {
+	t.mutex.Lock()
+	keys := make([]string, 0, len(t.windows))
+	for k, w := range t.windows {
+		w.timer.Stop()
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	events := make([]Event, 0, len(keys))
+	for _, k := range keys {
+		if w := t.windows[k]; w.pending {
+			events = append(events, w.latest)
+		}
+		delete(t.windows, k)
+	}
+	t.mutex.Unlock()
+
+	for _, e := range events {
+		t.handle(ctx, e)
+	}
+}
+
+// open starts a new window for the key, must be called with the lock
+func (t *Throttler) open(key string) {
+	w := &throttled{}
+	w.timer = t.config.Clock.AfterFunc(t.config.Window, func() { t.close(key, w) })
+	t.windows[key] = w
+}
+
+// close delivers the latest event of the window, which opens a new window
+func (t *Throttler) close(key string, w *throttled) {
+	t.mutex.Lock()
+	// the timer of a flushed window
+	if t.windows[key] != w {
+		t.mutex.Unlock()
+		return
+	}
+	delete(t.windows, key)
+
+	if !w.pending {
+		t.mutex.Unlock()
+		return
+	}
+	t.open(key)
+	t.mutex.Unlock()
+
+	t.handle(context.Background(), w.latest)
+}
+
+func (c WindowConfig) normalize(fn func(ctx context.Context, e Event)) (WindowConfig, error) {
+	if fn == nil {
+		return c, fmt.Errorf("bus: window handler func can't be nil")
+	}
+	if c.Key == nil {
+		return c, fmt.Errorf("bus: window key func can't be nil")
+	}
+	if c.Window <= 0 {
+		return c, fmt.Errorf("bus: window(%s) must be positive", c.Window)
+	}
+	if c.Clock == nil {
+		c.Clock = SystemClock
+	}
+	return c, nil
+}
@@ -0,0 +1,138 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package bus_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mustafaturan/bus/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewDebouncer(t *testing.T) {
+	r := &fakeRecorder{}
+
+	t.Run("with nil func", func(t *testing.T) {
+		_, err := bus.NewDebouncer(bus.WindowConfig{Window: time.Second, Key: txIDKey}, nil)
+		assert.EqualError(t, err, "bus: window handler func can't be nil")
+	})
+
+	t.Run("with nil key func", func(t *testing.T) {
+		_, err := bus.NewDebouncer(bus.WindowConfig{Window: time.Second}, r.record)
+		assert.EqualError(t, err, "bus: window key func can't be nil")
+	})
+
+	t.Run("without window", func(t *testing.T) {
+		_, err := bus.NewThrottler(bus.WindowConfig{Key: txIDKey}, r.record)
+		assert.EqualError(t, err, "bus: window(0s) must be positive")
+	})
+}
+
+func TestDebouncer(t *testing.T) {
+	ctx := context.Background()
+	setup := func(t *testing.T) (*bus.Debouncer, *fakeClock, *fakeRecorder) {
+		clock := newFakeClock()
+		r := &fakeRecorder{}
+		d, err := bus.NewDebouncer(bus.WindowConfig{Window: time.Second, Key: txIDKey, Clock: clock}, r.record)
+		require.Nil(t, err)
+		return d, clock, r
+	}
+
+	t.Run("delivers the latest event per key", func(t *testing.T) {
+		d, clock, r := setup(t)
+
+		d.Handle(ctx, bus.Event{TxID: "a", Data: 1})
+		d.Handle(ctx, bus.Event{TxID: "b", Data: 2})
+		clock.Advance(500 * time.Millisecond)
+		d.Handle(ctx, bus.Event{TxID: "a", Data: 3})
+		clock.Advance(500 * time.Millisecond)
+		assert.Equal(t, []interface{}{2}, r.received())
+
+		clock.Advance(500 * time.Millisecond)
+		assert.Equal(t, []interface{}{2, 3}, r.received())
+	})
+
+	t.Run("flushes on demand", func(t *testing.T) {
+		d, clock, r := setup(t)
+
+		d.Handle(ctx, bus.Event{TxID: "b", Data: 1})
+		d.Handle(ctx, bus.Event{TxID: "a", Data: 2})
+		d.Flush(ctx)
+		assert.Equal(t, []interface{}{2, 1}, r.received())
+
+		clock.Advance(time.Second)
+		assert.Equal(t, []interface{}{2, 1}, r.received())
+	})
+}
+
+func TestThrottler(t *testing.T) {
+	ctx := context.Background()
+	setup := func(t *testing.T) (*bus.Throttler, *fakeClock, *fakeRecorder) {
+		clock := newFakeClock()
+		r := &fakeRecorder{}
+		th, err := bus.NewThrottler(bus.WindowConfig{Window: time.Second, Key: txIDKey, Clock: clock}, r.record)
+		require.Nil(t, err)
+		return th, clock, r
+	}
+
+	t.Run("delivers the first and the latest event per window", func(t *testing.T) {
+		th, clock, r := setup(t)
+
+		th.Handle(ctx, bus.Event{TxID: "a", Data: 1})
+		th.Handle(ctx, bus.Event{TxID: "a", Data: 2})
+		th.Handle(ctx, bus.Event{TxID: "a", Data: 3})
+		th.Handle(ctx, bus.Event{TxID: "b", Data: 4})
+		assert.Equal(t, []interface{}{1, 4}, r.received())
+
+		clock.Advance(time.Second)
+		assert.Equal(t, []interface{}{1, 4, 3}, r.received())
+
+		th.Handle(ctx, bus.Event{TxID: "a", Data: 5})
+		clock.Advance(time.Second)
+		assert.Equal(t, []interface{}{1, 4, 3, 5}, r.received())
+
+		clock.Advance(time.Second)
+		th.Handle(ctx, bus.Event{TxID: "a", Data: 6})
+		assert.Equal(t, []interface{}{1, 4, 3, 5, 6}, r.received())
+	})
+
+	t.Run("flushes on demand", func(t *testing.T) {
+		th, clock, r := setup(t)
+
+		th.Handle(ctx, bus.Event{TxID: "a", Data: 1})
+		th.Handle(ctx, bus.Event{TxID: "a", Data: 2})
+		th.Handle(ctx, bus.Event{TxID: "b", Data: 3})
+		th.Flush(ctx)
+		assert.Equal(t, []interface{}{1, 3, 2}, r.received())
+
+		clock.Advance(time.Second)
+		th.Handle(ctx, bus.Event{TxID: "a", Data: 4})
+		assert.Equal(t, []interface{}{1, 3, 2, 4}, r.received())
+	})
+}
+
+func TestDebouncerHandler(t *testing.T) {
+	b := setup(topicCommentCreated)
+
+	r := &fakeRecorder{}
+	d, err := bus.NewDebouncer(bus.WindowConfig{Window: time.Hour, Key: txIDKey}, r.record)
+	require.Nil(t, err)
+	b.RegisterHandler("test.debouncer", d.Handler(".*"))
+
+	ctx := context.Background()
+	require.Nil(t, b.EmitWithOpts(ctx, topicCommentCreated, 1, bus.WithTxID("a")))
+	require.Nil(t, b.EmitWithOpts(ctx, topicCommentCreated, 2, bus.WithTxID("a")))
+	assert.Empty(t, r.received())
+
+	require.Nil(t, b.Close(ctx))
+	assert.Equal(t, []interface{}{2}, r.received())
+}
+
+func txIDKey(e bus.Event) string {
+	return e.TxID
+}
@@ -0,0 +1,224 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package bus
+
+import (
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// EnvelopeVersion is the version of the serialized event envelope format
+//
+// The envelope starts with the version byte followed by tag-length-value
+// encoded fields; decoders skip the unknown tags, so new fields can be added
+// without breaking the older readers.
+const EnvelopeVersion = 1
+
+const (
+	envelopeTagID byte = iota + 1
+	envelopeTagTxID
+	envelopeTagTopic
+	envelopeTagSource
+	envelopeTagOccurredAt
+	envelopeTagCodec
+	envelopeTagData
+	envelopeTagSchemaVersion
+	envelopeTagSeq
+	envelopeTagKey
+	envelopeTagTenant
+)
+
+// MarshalEvent serializes the event into a versioned envelope encoding the
+// payload with the given codec
+func MarshalEvent(c Codec, e Event) ([]byte, error) {
+	occurredAt, err := e.OccurredAt.MarshalBinary()
+	if err != nil {
+		return nil, fmt.Errorf("bus: event(%s) occurredAt encode failed: %w", e.ID, err)
+	}
+
+	buf := []byte{EnvelopeVersion}
+	buf = appendEnvelopeField(buf, envelopeTagID, []byte(e.ID))
+	buf = appendEnvelopeField(buf, envelopeTagTxID, []byte(e.TxID))
+	buf = appendEnvelopeField(buf, envelopeTagTopic, []byte(e.Topic))
+	buf = appendEnvelopeField(buf, envelopeTagSource, []byte(e.Source))
+	buf = appendEnvelopeField(buf, envelopeTagOccurredAt, occurredAt)
+	buf = appendEnvelopeField(buf, envelopeTagCodec, []byte(c.Name()))
+	if e.SchemaVersion != 0 {
+		var v [binary.MaxVarintLen64]byte
+		buf = appendEnvelopeField(buf, envelopeTagSchemaVersion, v[:binary.PutVarint(v[:], int64(e.SchemaVersion))])
+	}
+	if e.Key != empty {
+		buf = appendEnvelopeField(buf, envelopeTagKey, []byte(e.Key))
+	}
+	if e.Tenant != empty {
+		buf = appendEnvelopeField(buf, envelopeTagTenant, []byte(e.Tenant))
+	}
+	if e.Seq != 0 {
+		var v [binary.MaxVarintLen64]byte
+		buf = appendEnvelopeField(buf, envelopeTagSeq, v[:binary.PutUvarint(v[:], e.Seq)])
+	}
+
+	if e.Data != nil {
+		data, err := c.Marshal(e.Data)
+		if err != nil {
+			return nil, fmt.Errorf("bus: event(%s) data encode failed: %w", e.ID, err)
+		}
+		buf = appendEnvelopeField(buf, envelopeTagData, data)
+	}
+	return buf, nil
+}
+
+// UnmarshalEvent deserializes the event from the envelope; the payload is
+// decoded with the codec into the type registered for the event topic
+func UnmarshalEvent(c Codec, r *TypeRegistry, data []byte) (Event, error) {
+	env, err := decodeEnvelope(data)
+	if err != nil {
+		return Event{}, err
+	}
+
+	e := env.event
+	if !env.hasData {
+		return e, nil
+	}
+	if env.codec != c.Name() {
+		return Event{}, fmt.Errorf("bus: envelope codec(%s) does not match codec(%s)", env.codec, c.Name())
+	}
+
+	v, ok := r.New(e.Topic)
+	if !ok {
+		return Event{}, fmt.Errorf("bus: topic(%s) payload type not registered", e.Topic)
+	}
+	if err := c.Unmarshal(env.payload, v); err != nil {
+		return Event{}, fmt.Errorf("bus: event(%s) data decode failed: %w", e.ID, err)
+	}
+	e.Data = reflect.ValueOf(v).Elem().Interface()
+
+	return e, nil
+}
+
+// UnmarshalEventMeta deserializes the event from the envelope without
+// decoding the payload; the returned bool tells whether the event has a
+// payload, i.e. to tell the tombstones apart
+func UnmarshalEventMeta(data []byte) (Event, bool, error) {
+	env, err := decodeEnvelope(data)
+	if err != nil {
+		return Event{}, false, err
+	}
+	return env.event, env.hasData, nil
+}
+
+type envelope struct {
+	event   Event
+	codec   string
+	payload []byte
+	hasData bool
+}
+
+func decodeEnvelope(data []byte) (envelope, error) {
+	var (
+		env      envelope
+		occurred []byte
+	)
+	e := &env.event
+	err := walkEnvelope(data, func(tag byte, val []byte) error {
+		switch tag {
+		case envelopeTagID:
+			e.ID = string(val)
+		case envelopeTagTxID:
+			e.TxID = string(val)
+		case envelopeTagTopic:
+			e.Topic = string(val)
+		case envelopeTagSource:
+			e.Source = string(val)
+		case envelopeTagOccurredAt:
+			occurred = val
+		case envelopeTagCodec:
+			env.codec = string(val)
+		case envelopeTagData:
+			env.payload, env.hasData = val, true
+		case envelopeTagSchemaVersion:
+			v, n := binary.Varint(val)
+			if n <= 0 {
+				return fmt.Errorf("bus: envelope field(%d) is corrupted", tag)
+			}
+			e.SchemaVersion = int(v)
+		case envelopeTagSeq:
+			v, n := binary.Uvarint(val)
+			if n <= 0 {
+				return fmt.Errorf("bus: envelope field(%d) is corrupted", tag)
+			}
+			e.Seq = v
+		case envelopeTagKey:
+			e.Key = string(val)
+		case envelopeTagTenant:
+			e.Tenant = string(val)
+		}
+		return nil
+	})
+	if err != nil {
+		return envelope{}, err
+	}
+
+	if occurred != nil {
+		var occurredAt time.Time
+		if err := occurredAt.UnmarshalBinary(occurred); err != nil {
+			return envelope{}, fmt.Errorf("bus: event(%s) occurredAt decode failed: %w", e.ID, err)
+		}
+		e.OccurredAt = occurredAt
+	}
+	return env, nil
+}
+
+// envelopeSeq returns the seq field of the envelope without decoding the
+// payload
+func envelopeSeq(data []byte) (uint64, error) {
+	var seq uint64
+	err := walkEnvelope(data, func(tag byte, val []byte) error {
+		if tag != envelopeTagSeq {
+			return nil
+		}
+		v, n := binary.Uvarint(val)
+		if n <= 0 {
+			return fmt.Errorf("bus: envelope field(%d) is corrupted", tag)
+		}
+		seq = v
+		return nil
+	})
+	return seq, err
+}
+
+// walkEnvelope calls fn with the tag and the value of each envelope field
+func walkEnvelope(data []byte, fn func(tag byte, val []byte) error) error {
+	if len(data) == 0 {
+		return fmt.Errorf("bus: envelope is empty")
+	}
+	if data[0] != EnvelopeVersion {
+		return fmt.Errorf("bus: envelope version(%d) is not supported", data[0])
+	}
+
+	for rest := data[1:]; len(rest) > 0; {
+		tag := rest[0]
+		l, n := binary.Uvarint(rest[1:])
+		if n <= 0 || uint64(len(rest)-1-n) < l {
+			return fmt.Errorf("bus: envelope field(%d) is corrupted", tag)
+		}
+		val := rest[1+n : 1+n+int(l)]
+		rest = rest[1+n+int(l):]
+
+		if err := fn(tag, val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func appendEnvelopeField(buf []byte, tag byte, val []byte) []byte {
+	var l [binary.MaxVarintLen64]byte
+	buf = append(buf, tag)
+	buf = append(buf, l[:binary.PutUvarint(l[:], uint64(len(val)))]...)
+	return append(buf, val...)
+}
@@ -0,0 +1,113 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package bus_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mustafaturan/bus/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMarshalEvent(t *testing.T) {
+	r := bus.NewTypeRegistry()
+	r.Register(topicCommentCreated, fakeOrder{})
+	r.Register(topicCommentDeleted, "")
+
+	e := bus.Event{
+		ID:         "id",
+		TxID:       "tx",
+		Topic:      topicCommentCreated,
+		Source:     "source",
+		OccurredAt: time.Date(2021, 1, 2, 3, 4, 5, 6, time.FixedZone("PST", -8*3600)),
+		Data:       fakeOrder{ID: "1", Amount: 11.2},
+		Key:        "key",
+		Tenant:     "acme",
+
+		SchemaVersion: 2,
+		Seq:           42,
+	}
+
+	codecs := []bus.Codec{bus.JSONCodec{}, bus.GobCodec{}, bus.BinaryCodec{}}
+	for _, c := range codecs {
+		t.Run(c.Name(), func(t *testing.T) {
+			e := e
+			if c.Name() == "binary" {
+				e.Topic, e.Data = topicCommentDeleted, "a comment"
+			}
+
+			data, err := bus.MarshalEvent(c, e)
+			require.Nil(t, err)
+			assert.EqualValues(t, bus.EnvelopeVersion, data[0])
+
+			got, err := bus.UnmarshalEvent(c, r, data)
+			require.Nil(t, err)
+			assert.True(t, e.OccurredAt.Equal(got.OccurredAt))
+			_, wantOffset := e.OccurredAt.Zone()
+			_, gotOffset := got.OccurredAt.Zone()
+			assert.Equal(t, wantOffset, gotOffset)
+			e.OccurredAt = got.OccurredAt
+			assert.Equal(t, e, got)
+		})
+	}
+
+	t.Run("with nil data", func(t *testing.T) {
+		e := bus.Event{ID: "id", Topic: topicUserCreated}
+		data, err := bus.MarshalEvent(bus.JSONCodec{}, e)
+		require.Nil(t, err)
+
+		got, err := bus.UnmarshalEvent(bus.JSONCodec{}, r, data)
+		require.Nil(t, err)
+		assert.Equal(t, e, got)
+	})
+
+	t.Run("with unregistered topic", func(t *testing.T) {
+		e := bus.Event{ID: "id", Topic: topicUserCreated, Data: "data"}
+		data, err := bus.MarshalEvent(bus.JSONCodec{}, e)
+		require.Nil(t, err)
+
+		_, err = bus.UnmarshalEvent(bus.JSONCodec{}, r, data)
+		if assert.Error(t, err) {
+			assert.Equal(t, "bus: topic(user.created) payload type not registered", err.Error())
+		}
+	})
+
+	t.Run("with codec mismatch", func(t *testing.T) {
+		data, err := bus.MarshalEvent(bus.JSONCodec{}, e)
+		require.Nil(t, err)
+
+		_, err = bus.UnmarshalEvent(bus.GobCodec{}, r, data)
+		if assert.Error(t, err) {
+			assert.Equal(t, "bus: envelope codec(json) does not match codec(gob)", err.Error())
+		}
+	})
+
+	t.Run("with unsupported version", func(t *testing.T) {
+		_, err := bus.UnmarshalEvent(bus.JSONCodec{}, r, []byte{0})
+		if assert.Error(t, err) {
+			assert.Equal(t, "bus: envelope version(0) is not supported", err.Error())
+		}
+	})
+
+	t.Run("with truncated envelope", func(t *testing.T) {
+		data, err := bus.MarshalEvent(bus.JSONCodec{}, e)
+		require.Nil(t, err)
+
+		_, err = bus.UnmarshalEvent(bus.JSONCodec{}, r, data[:len(data)-3])
+		assert.Error(t, err)
+	})
+
+	t.Run("skips unknown fields", func(t *testing.T) {
+		data, err := bus.MarshalEvent(bus.JSONCodec{}, e)
+		require.Nil(t, err)
+
+		data = append(data, 0xFF, 2, 'o', 'k')
+		got, err := bus.UnmarshalEvent(bus.JSONCodec{}, r, data)
+		require.Nil(t, err)
+		assert.Equal(t, e.ID, got.ID)
+	})
+}
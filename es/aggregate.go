@@ -0,0 +1,104 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+/*
+Package es provides the event sourced aggregates on top of the bus
+
+An aggregate embeds the Root and mutates its state only in Apply. The new
+events are raised with Raise, which applies them right away and keeps them as
+the changes of the aggregate until it is saved:
+
+	type Order struct {
+		es.Root
+		Placed bool
+	}
+
+	func (o *Order) Apply(e bus.Event) error {
+		switch e.Topic {
+		case "order.placed":
+			o.Placed = true
+		}
+		return nil
+	}
+
+	func (o *Order) Place() error {
+		if o.Placed {
+			return errors.New("order is already placed")
+		}
+		return es.Raise(o, "order.placed", Placed{ID: o.ID()})
+	}
+
+The stream of an aggregate is the events of the repository topics with the
+aggregate id as the event key. The Repository loads the aggregates by
+replaying their streams from the event store of the bus and saves them by
+emitting the changes through the bus, which appends them to the event store
+and delivers them to the handlers. The versions of the aggregates count the
+events of their streams, so the topics of the repositories must not be
+compacted.
+
+A Projection keeps a read model up to date with the events of a matcher
+pattern, checkpoints the seq of the last applied event as a handler offset
+and rebuilds the read model from the event store on demand.
+*/
+package es
+
+import (
+	"fmt"
+
+	"github.com/mustafaturan/bus/v3"
+)
+
+type (
+	// Aggregate is an event sourced entity rebuilt by applying its events
+	Aggregate interface {
+		// Apply mutates the state of the aggregate by the event, it is called
+		// on load and on raise
+		Apply(e bus.Event) error
+
+		// AggregateRoot returns the embedded root of the aggregate
+		AggregateRoot() *Root
+	}
+
+	// Root tracks the identity, the version and the unsaved changes of an
+	// aggregate; the aggregates embed it
+	Root struct {
+		id      string
+		version int
+		changes []bus.Event
+	}
+)
+
+// Raise applies a new event with the topic and the data to the aggregate and
+// keeps it as a change to save
+func Raise(a Aggregate, topic string, data interface{}) error {
+	r := a.AggregateRoot()
+	e := bus.Event{Topic: topic, Data: data, Key: r.id}
+	if err := a.Apply(e); err != nil {
+		return fmt.Errorf("es: aggregate(%s) topic(%s) apply failed: %w", r.id, topic, err)
+	}
+
+	r.changes = append(r.changes, e)
+	return nil
+}
+
+// AggregateRoot returns the root itself to implement the Aggregate interface
+// for the embedding aggregates
+func (r *Root) AggregateRoot() *Root {
+	return r
+}
+
+// ID returns the id of the aggregate
+func (r *Root) ID() string {
+	return r.id
+}
+
+// Version returns the number of the saved events of the aggregate
+func (r *Root) Version() int {
+	return r.version
+}
+
+// Changes returns the raised events which are not saved yet
+func (r *Root) Changes() []bus.Event {
+	return r.changes
+}
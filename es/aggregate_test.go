@@ -0,0 +1,83 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package es_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/mustafaturan/bus/v3"
+	"github.com/mustafaturan/bus/v3/es"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	topicAccountOpened    = "account.opened"
+	topicAccountDeposited = "account.deposited"
+	topicAccountWithdrawn = "account.withdrawn"
+)
+
+type (
+	fakeAccount struct {
+		es.Root
+		Open    bool
+		Balance int
+	}
+
+	fakeAmount struct{ Amount int }
+)
+
+var errInsufficientFunds = errors.New("insufficient funds")
+
+func TestRaise(t *testing.T) {
+	a := &fakeAccount{}
+	require.Nil(t, a.open())
+	require.Nil(t, a.deposit(10))
+
+	assert.True(t, a.Open)
+	assert.Equal(t, 10, a.Balance)
+	assert.Equal(t, 0, a.Version())
+	assert.Equal(t, []bus.Event{
+		{Topic: topicAccountOpened, Data: fakeAmount{}},
+		{Topic: topicAccountDeposited, Data: fakeAmount{Amount: 10}},
+	}, a.Changes())
+
+	t.Run("with failing apply", func(t *testing.T) {
+		err := a.withdraw(20)
+		assert.EqualError(t, err, "es: aggregate() topic(account.withdrawn) apply failed: insufficient funds")
+		assert.True(t, errors.Is(err, errInsufficientFunds))
+		assert.Len(t, a.Changes(), 2)
+		assert.Equal(t, 10, a.Balance)
+	})
+}
+
+func (a *fakeAccount) Apply(e bus.Event) error {
+	switch e.Topic {
+	case topicAccountOpened:
+		a.Open = true
+	case topicAccountDeposited:
+		a.Balance += e.Data.(fakeAmount).Amount
+	case topicAccountWithdrawn:
+		amount := e.Data.(fakeAmount).Amount
+		if amount > a.Balance {
+			return errInsufficientFunds
+		}
+		a.Balance -= amount
+	}
+	return nil
+}
+
+func (a *fakeAccount) open() error {
+	return es.Raise(a, topicAccountOpened, fakeAmount{})
+}
+
+func (a *fakeAccount) deposit(amount int) error {
+	return es.Raise(a, topicAccountDeposited, fakeAmount{Amount: amount})
+}
+
+func (a *fakeAccount) withdraw(amount int) error {
+	return es.Raise(a, topicAccountWithdrawn, fakeAmount{Amount: amount})
+}
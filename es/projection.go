@@ -0,0 +1,223 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package es
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/mustafaturan/bus/v3"
+)
+
+type (
+	// ReadModel is the state of a projection built by applying the events
+	ReadModel interface {
+		// Apply mutates the read model by the event
+		Apply(e bus.Event) error
+	}
+
+	// ProjectionConfig holds the projection options
+	ProjectionConfig struct {
+		// handler key of the projection, also the key of its checkpoint
+		Name string
+
+		// topics of the projected events as regex pattern
+		Matcher string
+
+		// returns a new read model with its zero state
+		New func() ReadModel
+
+		// loads the persisted read model with the events up to the
+		// checkpoint applied, optional; without it the read model is built
+		// from the start of the event store on start
+		Load func() (ReadModel, error)
+
+		// receives the checkpoint commit failures, optional
+		Warn bus.WarnFunc
+	}
+
+	// Projection keeps a read model up to date with the events of a bus with
+	// an event store and an offset store
+	//
+	// The projection is a durable handler; its checkpoint is the committed
+	// offset of the handler, so on start it catches up from the checkpoint
+	// into the loaded read model, or replays the event store into a new one
+	// when the config has no Load func.
+	Projection struct {
+		bus    *bus.Bus
+		config ProjectionConfig
+
+		mutex sync.RWMutex
+		model ReadModel
+		seq   uint64 // checkpoint, seq of the last applied event
+		err   error  // apply failure halting the projection
+	}
+)
+
+// NewProjection inits a projection with a new read model
+func NewProjection(b *bus.Bus, c ProjectionConfig) (*Projection, error) {
+	if b == nil {
+		return nil, fmt.Errorf("es: bus can't be nil")
+	}
+	if c.Name == "" {
+		return nil, fmt.Errorf("es: projection name can't be empty")
+	}
+	if c.New == nil {
+		return nil, fmt.Errorf("es: projection(%s) new func can't be nil", c.Name)
+	}
+
+	return &Projection{bus: b, config: c, model: c.New()}, nil
+}
+
+// Start loads the read model and its checkpoint and registers the projection
+// handler, which catches up from the checkpoint before the live events
+func (p *Projection) Start() error {
+	seq, err := p.bus.HandlerOffset(p.config.Name)
+	if err != nil {
+		return fmt.Errorf("es: projection(%s) start failed: %w", p.config.Name, err)
+	}
+	if _, err := p.bus.LastSeq(); err != nil {
+		return fmt.Errorf("es: projection(%s) start failed: %w", p.config.Name, err)
+	}
+
+	if p.config.Load == nil {
+		// the checkpoint of a read model which is not persisted is lost
+		// with the read model
+		if err := p.Rebuild(context.Background()); err != nil {
+			return err
+		}
+	} else {
+		m, err := p.config.Load()
+		if err != nil {
+			return fmt.Errorf("es: projection(%s) load failed: %w", p.config.Name, err)
+		}
+
+		p.mutex.Lock()
+		p.model, p.seq, p.err = m, seq, nil
+		p.mutex.Unlock()
+	}
+
+	p.bus.RegisterHandler(p.config.Name, bus.Handler{
+		Handle:  p.handle,
+		Matcher: p.config.Matcher,
+		Commit:  bus.CommitExplicit,
+	})
+	return nil
+}
+
+// Stop deregisters the projection handler
+func (p *Projection) Stop() {
+	p.bus.DeregisterHandler(p.config.Name)
+}
+
+// Read calls fn with the read model; the events are not applied until fn
+// returns, so fn must not emit the projected topics
+func (p *Projection) Read(fn func(m ReadModel)) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	fn(p.model)
+}
+
+// Checkpoint returns the seq of the last applied event
+func (p *Projection) Checkpoint() uint64 {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	return p.seq
+}
+
+// Lag returns the number of the stored events of the projected topics after
+// the checkpoint
+func (p *Projection) Lag() (uint64, error) {
+	last, err := p.bus.LastSeq()
+	if err != nil {
+		return 0, err
+	}
+
+	var lag uint64
+	err = p.bus.Replay(context.Background(), p.Checkpoint()+1, p.config.Matcher, func(_ context.Context, e bus.Event) {
+		if e.Seq <= last {
+			lag++
+		}
+	})
+	return lag, err
+}
+
+// Err returns the apply failure which halted the projection, nil when it is
+// running
+func (p *Projection) Err() error {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	return p.err
+}
+
+// Rebuild builds a new read model from the start of the event store and
+// swaps it in; the current read model keeps serving the reads and the live
+// events until the swap
+//
+// A rebuild also recovers a projection halted by an apply failure.
+func (p *Projection) Rebuild(ctx context.Context) error {
+	m, seq := p.config.New(), uint64(0)
+	if err := p.replay(ctx, m, &seq); err != nil {
+		return err
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	// the events stored since the replay
+	if err := p.replay(ctx, m, &seq); err != nil {
+		return err
+	}
+	if seq > 0 {
+		if err := p.bus.CommitOffset(p.config.Name, seq); err != nil {
+			return err
+		}
+	}
+
+	p.model, p.seq, p.err = m, seq, nil
+	return nil
+}
+
+// replay applies the stored events after the seq to the read model
+func (p *Projection) replay(ctx context.Context, m ReadModel, seq *uint64) error {
+	var err error
+	replayErr := p.bus.Replay(ctx, *seq+1, p.config.Matcher, func(_ context.Context, e bus.Event) {
+		if err != nil {
+			return
+		}
+		if err = m.Apply(e); err != nil {
+			err = fmt.Errorf("es: projection(%s) event(%d) apply failed: %w", p.config.Name, e.Seq, err)
+			return
+		}
+		*seq = e.Seq
+	})
+	if replayErr != nil {
+		return replayErr
+	}
+	return err
+}
+
+func (p *Projection) handle(ctx context.Context, e bus.Event) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	// applied by a rebuild or halted
+	if e.Seq <= p.seq || p.err != nil {
+		return
+	}
+
+	if err := p.model.Apply(e); err != nil {
+		p.err = fmt.Errorf("es: projection(%s) event(%d) apply failed: %w", p.config.Name, e.Seq, err)
+		return
+	}
+	p.seq = e.Seq
+	if err := p.bus.CommitOffset(p.config.Name, e.Seq); err != nil && p.config.Warn != nil {
+		p.config.Warn(ctx, e.Topic, err.Error())
+	}
+}
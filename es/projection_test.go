@@ -0,0 +1,253 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package es_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/mustafaturan/bus/v3"
+	"github.com/mustafaturan/bus/v3/es"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeBalances struct {
+	balances map[string]int
+	fail     bool
+}
+
+var errApply = errors.New("apply failed")
+
+func TestNewProjection(t *testing.T) {
+	b, _ := setupBus(t)
+
+	t.Run("with nil bus", func(t *testing.T) {
+		_, err := es.NewProjection(nil, es.ProjectionConfig{Name: "balances", New: newFakeBalances})
+		assert.EqualError(t, err, "es: bus can't be nil")
+	})
+
+	t.Run("with empty name", func(t *testing.T) {
+		_, err := es.NewProjection(b, es.ProjectionConfig{New: newFakeBalances})
+		assert.EqualError(t, err, "es: projection name can't be empty")
+	})
+
+	t.Run("with nil new func", func(t *testing.T) {
+		_, err := es.NewProjection(b, es.ProjectionConfig{Name: "balances"})
+		assert.EqualError(t, err, "es: projection(balances) new func can't be nil")
+	})
+
+	t.Run("without offset store", func(t *testing.T) {
+		p, err := es.NewProjection(b, es.ProjectionConfig{Name: "balances", New: newFakeBalances})
+		require.Nil(t, err)
+		assert.EqualError(t, p.Start(), "es: projection(balances) start failed: bus: offset store is not configured")
+	})
+}
+
+func TestProjection(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	b, s := setupDurableBus(t, dir)
+	deposit(t, b, "a1", 10)
+
+	p := setupProjection(t, b)
+	require.Nil(t, p.Start())
+
+	t.Run("catches up on start", func(t *testing.T) {
+		assert.Equal(t, map[string]int{"a1": 10}, balances(p))
+		assert.Equal(t, uint64(1), p.Checkpoint())
+	})
+
+	t.Run("applies the live events", func(t *testing.T) {
+		deposit(t, b, "a2", 5)
+		deposit(t, b, "a1", 1)
+		require.Nil(t, b.Emit(ctx, topicAccountOpened, fakeAmount{}))
+
+		assert.Equal(t, map[string]int{"a1": 11, "a2": 5}, balances(p))
+		assert.Equal(t, uint64(3), p.Checkpoint())
+
+		// the events of the other topics are not lagging
+		lag, err := p.Lag()
+		require.Nil(t, err)
+		assert.Equal(t, uint64(0), lag)
+
+		offset, err := b.HandlerOffset("balances")
+		require.Nil(t, err)
+		assert.Equal(t, uint64(3), offset)
+	})
+
+	t.Run("halts on apply failure", func(t *testing.T) {
+		p.Read(func(m es.ReadModel) { m.(*fakeBalances).fail = true })
+		deposit(t, b, "a1", 100)
+		deposit(t, b, "a3", 1)
+
+		assert.True(t, errors.Is(p.Err(), errApply))
+		assert.EqualError(t, p.Err(), "es: projection(balances) event(5) apply failed: apply failed")
+		assert.Equal(t, map[string]int{"a1": 11, "a2": 5}, balances(p))
+
+		lag, err := p.Lag()
+		require.Nil(t, err)
+		assert.Equal(t, uint64(2), lag)
+	})
+
+	t.Run("rebuilds and swaps the read model", func(t *testing.T) {
+		require.Nil(t, p.Rebuild(ctx))
+
+		assert.Nil(t, p.Err())
+		assert.Equal(t, map[string]int{"a1": 111, "a2": 5, "a3": 1}, balances(p))
+		assert.Equal(t, uint64(6), p.Checkpoint())
+
+		deposit(t, b, "a3", 1)
+		assert.Equal(t, map[string]int{"a1": 111, "a2": 5, "a3": 2}, balances(p))
+	})
+
+	t.Run("resumes from the checkpoint of the loaded read model", func(t *testing.T) {
+		p.Stop()
+		deposit(t, b, "a2", 1)
+		require.Nil(t, s.Close())
+
+		b, s = setupDurableBus(t, dir)
+		defer s.Close()
+
+		p, err := es.NewProjection(b, es.ProjectionConfig{
+			Name:    "balances",
+			Matcher: "^account\\.deposited$",
+			New:     newFakeBalances,
+			Load: func() (es.ReadModel, error) {
+				return &fakeBalances{balances: map[string]int{"a1": 111, "a2": 5, "a3": 2}}, nil
+			},
+		})
+		require.Nil(t, err)
+		require.Nil(t, p.Start())
+		assert.Equal(t, uint64(8), p.Checkpoint())
+		assert.Equal(t, map[string]int{"a1": 111, "a2": 6, "a3": 2}, balances(p))
+	})
+
+	t.Run("rebuilds the read model without load on start", func(t *testing.T) {
+		p := setupProjection(t, b)
+		require.Nil(t, p.Start())
+		defer p.Stop()
+
+		assert.Equal(t, uint64(8), p.Checkpoint())
+		assert.Equal(t, map[string]int{"a1": 111, "a2": 6, "a3": 2}, balances(p))
+	})
+
+	t.Run("with load failure", func(t *testing.T) {
+		p, err := es.NewProjection(b, es.ProjectionConfig{
+			Name: "balances",
+			New:  newFakeBalances,
+			Load: func() (es.ReadModel, error) { return nil, errors.New("not found") },
+		})
+		require.Nil(t, err)
+		assert.EqualError(t, p.Start(), "es: projection(balances) load failed: not found")
+	})
+}
+
+func TestProjectionCommitFailure(t *testing.T) {
+	s, err := bus.OpenFileStore(t.TempDir(), bus.JSONCodec{}, bus.NewTypeRegistry())
+	require.Nil(t, err)
+	defer s.Close()
+
+	b, err := bus.NewBus(fakeIDGen(), bus.WithEventStore(s), bus.WithOffsetStore(fakeFailingOffsets{s}))
+	require.Nil(t, err)
+	b.RegisterTopics(topicAccountDeposited)
+
+	var warnings []string
+	p, err := es.NewProjection(b, es.ProjectionConfig{
+		Name:    "balances",
+		Matcher: "^account\\.deposited$",
+		New:     newFakeBalances,
+		Warn:    func(_ context.Context, _, msg string) { warnings = append(warnings, msg) },
+	})
+	require.Nil(t, err)
+	require.Nil(t, p.Start())
+
+	deposit(t, b, "a1", 10)
+	assert.Equal(t, map[string]int{"a1": 10}, balances(p))
+	assert.Equal(t, []string{"bus: handler(balances) offset(1) commit failed: disk full"}, warnings)
+}
+
+func TestProjectionRebuildFailure(t *testing.T) {
+	b, s := setupDurableBus(t, t.TempDir())
+	defer s.Close()
+	deposit(t, b, "a1", 10)
+
+	failing := false
+	p, err := es.NewProjection(b, es.ProjectionConfig{
+		Name:    "balances",
+		Matcher: "^account\\.",
+		New: func() es.ReadModel {
+			return &fakeBalances{balances: make(map[string]int), fail: failing}
+		},
+	})
+	require.Nil(t, err)
+	require.Nil(t, p.Start())
+
+	failing = true
+	err = p.Rebuild(context.Background())
+	assert.EqualError(t, err, "es: projection(balances) event(1) apply failed: apply failed")
+	assert.Equal(t, map[string]int{"a1": 10}, balances(p))
+}
+
+func setupDurableBus(t *testing.T, dir string) (*bus.Bus, *bus.FileStore) {
+	types := bus.NewTypeRegistry()
+	types.Register(topicAccountOpened, fakeAmount{})
+	types.Register(topicAccountDeposited, fakeAmount{})
+
+	s, err := bus.OpenFileStore(dir, bus.JSONCodec{}, types)
+	require.Nil(t, err)
+
+	b, err := bus.NewBus(fakeIDGen(), bus.WithEventStore(s), bus.WithOffsetStore(s))
+	require.Nil(t, err)
+	b.RegisterTopics(topicAccountOpened, topicAccountDeposited)
+	return b, s
+}
+
+func setupProjection(t *testing.T, b *bus.Bus) *es.Projection {
+	p, err := es.NewProjection(b, es.ProjectionConfig{
+		Name:    "balances",
+		Matcher: "^account\\.deposited$",
+		New:     newFakeBalances,
+	})
+	require.Nil(t, err)
+	return p
+}
+
+func deposit(t *testing.T, b *bus.Bus, id string, amount int) {
+	err := b.EmitWithOpts(context.Background(), topicAccountDeposited, fakeAmount{Amount: amount}, bus.WithKey(id))
+	require.Nil(t, err)
+}
+
+func balances(p *es.Projection) map[string]int {
+	got := make(map[string]int)
+	p.Read(func(m es.ReadModel) {
+		for k, v := range m.(*fakeBalances).balances {
+			got[k] = v
+		}
+	})
+	return got
+}
+
+type fakeFailingOffsets struct {
+	bus.OffsetStore
+}
+
+func (fakeFailingOffsets) Commit(string, uint64) error {
+	return errors.New("disk full")
+}
+
+func newFakeBalances() es.ReadModel {
+	return &fakeBalances{balances: make(map[string]int)}
+}
+
+func (m *fakeBalances) Apply(e bus.Event) error {
+	if m.fail {
+		return errApply
+	}
+	m.balances[e.Key] += e.Data.(fakeAmount).Amount
+	return nil
+}
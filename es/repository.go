@@ -0,0 +1,202 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package es
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+
+	"github.com/mustafaturan/bus/v3"
+)
+
+type (
+	// Config holds the repository options
+	Config struct {
+		// topics of the aggregate events as regex pattern
+		Matcher string
+
+		// returns a new aggregate with its zero state
+		New func() Aggregate
+	}
+
+	// Repository loads and saves the aggregates of a kind
+	//
+	// The repository keeps an index of the stream versions read from the
+	// event store. A save checks the expected version as the condition of a
+	// bus batch, so the check is atomic with the append against all emits of
+	// the bus; the buses sharing an event store are not covered.
+	Repository struct {
+		bus     *bus.Bus
+		idgen   bus.Next
+		matcher *regexp.Regexp
+		config  Config
+
+		mutex   sync.Mutex
+		seq     uint64            // last indexed seq
+		streams map[string]stream // indexed streams by aggregate id
+	}
+
+	stream struct {
+		first   uint64 // seq of the first event
+		version int    // number of the events
+	}
+)
+
+// ErrVersionConflict is wrapped by the save errors of the aggregates which
+// are changed by another save since they are loaded
+var ErrVersionConflict = errors.New("es: version conflict")
+
+// NewRepository inits a repository emitting the aggregate events to the bus;
+// the bus must have a batch event store
+//
+// The generator assigns the tx id of the saves without a tx id in the ctx.
+func NewRepository(b *bus.Bus, g bus.IDGenerator, c Config) (*Repository, error) {
+	if b == nil || g == nil {
+		return nil, fmt.Errorf("es: bus and id generator can't be nil")
+	}
+	if c.New == nil {
+		return nil, fmt.Errorf("es: aggregate new func can't be nil")
+	}
+	re, err := regexp.Compile(c.Matcher)
+	if err != nil {
+		return nil, fmt.Errorf("es: matcher(%s) is invalid: %w", c.Matcher, err)
+	}
+
+	return &Repository{
+		bus:     b,
+		idgen:   g.Generate,
+		matcher: re,
+		config:  c,
+		streams: make(map[string]stream),
+	}, nil
+}
+
+// Load rebuilds the aggregate by replaying its stream; an aggregate without
+// any event has the version 0
+func (r *Repository) Load(ctx context.Context, id string) (Aggregate, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err := r.index(ctx); err != nil {
+		return nil, err
+	}
+
+	a := r.config.New()
+	root := a.AggregateRoot()
+	root.id = id
+
+	s, ok := r.streams[id]
+	if !ok {
+		return a, nil
+	}
+
+	var err error
+	replayErr := r.bus.Replay(ctx, s.first, r.config.Matcher, func(_ context.Context, e bus.Event) {
+		if err != nil || e.Key != id || e.Seq > r.seq {
+			return
+		}
+		if err = a.Apply(e); err != nil {
+			err = fmt.Errorf("es: aggregate(%s) event(%d) apply failed: %w", id, e.Seq, err)
+			return
+		}
+		root.version++
+	})
+	if replayErr != nil {
+		return nil, replayErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Save emits the changes of the aggregate in order as a bus batch when its
+// stream is still at the loaded version; the events share the tx id of the
+// ctx or a new one
+//
+// Either all or none of the changes are saved; the changes of a failed save
+// are kept to retry. The handlers of the events may load the aggregates but
+// must not save to the same repository synchronously.
+func (r *Repository) Save(ctx context.Context, a Aggregate) error {
+	root := a.AggregateRoot()
+	if len(root.changes) == 0 {
+		return nil
+	}
+
+	txID, _ := ctx.Value(bus.CtxKeyTxID).(string)
+	if txID == "" {
+		txID = r.idgen()
+	}
+
+	events := make([]bus.Event, len(root.changes))
+	for i, e := range root.changes {
+		events[i] = bus.Event{Topic: e.Topic, Data: e.Data, Key: root.id, TxID: txID}
+	}
+
+	// the events are delivered synchronously, so the index is unlocked
+	// while emitting
+	defer func() {
+		r.mutex.Lock()
+		_ = r.index(ctx)
+		r.mutex.Unlock()
+	}()
+	err := r.bus.EmitBatch(ctx, func() error { return r.check(ctx, root) }, events...)
+	if errors.Is(err, ErrVersionConflict) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("es: aggregate(%s) save failed: %w", root.id, err)
+	}
+
+	root.version += len(root.changes)
+	root.changes = nil
+	return nil
+}
+
+// Version returns the saved version of the aggregate stream
+func (r *Repository) Version(ctx context.Context, id string) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err := r.index(ctx); err != nil {
+		return 0, err
+	}
+	return r.streams[id].version, nil
+}
+
+// check indexes the stream and compares its version with the loaded version
+func (r *Repository) check(ctx context.Context, root *Root) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err := r.index(ctx); err != nil {
+		return err
+	}
+	if v := r.streams[root.id].version; v != root.version {
+		return fmt.Errorf("%w: aggregate(%s) version(%d) does not match the expected version(%d)", ErrVersionConflict, root.id, v, root.version)
+	}
+	return nil
+}
+
+// index reads the stored events after the indexed seq into the stream index;
+// must be called with the lock
+func (r *Repository) index(ctx context.Context) error {
+	return r.bus.Replay(ctx, r.seq+1, ".*", func(_ context.Context, e bus.Event) {
+		r.seq = e.Seq
+		if e.Key == "" || !r.matcher.MatchString(e.Topic) {
+			return
+		}
+
+		s, ok := r.streams[e.Key]
+		if !ok {
+			s.first = e.Seq
+		}
+		s.version++
+		r.streams[e.Key] = s
+	})
+}
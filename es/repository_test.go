@@ -0,0 +1,221 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package es_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/mustafaturan/bus/v3"
+	"github.com/mustafaturan/bus/v3/es"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewRepository(t *testing.T) {
+	b, _ := setupBus(t)
+	g := fakeIDGen()
+
+	t.Run("with nil bus", func(t *testing.T) {
+		_, err := es.NewRepository(nil, g, es.Config{New: newFakeAccount})
+		assert.EqualError(t, err, "es: bus and id generator can't be nil")
+	})
+
+	t.Run("with nil new func", func(t *testing.T) {
+		_, err := es.NewRepository(b, g, es.Config{})
+		assert.EqualError(t, err, "es: aggregate new func can't be nil")
+	})
+
+	t.Run("with invalid matcher", func(t *testing.T) {
+		_, err := es.NewRepository(b, g, es.Config{Matcher: "[", New: newFakeAccount})
+		assert.EqualError(t, err, "es: matcher([) is invalid: error parsing regexp: missing closing ]: `[`")
+	})
+}
+
+func TestRepository(t *testing.T) {
+	b, s := setupBus(t)
+	r := setupRepository(t, b)
+	ctx := context.Background()
+
+	var events []bus.Event
+	b.RegisterHandler("test.handler", bus.Handler{
+		Handle:  func(_ context.Context, e bus.Event) { events = append(events, e) },
+		Matcher: "^account\\.",
+	})
+
+	t.Run("loads a new aggregate", func(t *testing.T) {
+		a := load(t, r, "a1")
+		assert.Equal(t, "a1", a.ID())
+		assert.Equal(t, 0, a.Version())
+		assert.False(t, a.Open)
+	})
+
+	t.Run("saves the changes", func(t *testing.T) {
+		a := load(t, r, "a1")
+		require.Nil(t, a.open())
+		require.Nil(t, a.deposit(10))
+		require.Nil(t, r.Save(context.WithValue(ctx, bus.CtxKeyTxID, "tx1"), a))
+
+		assert.Equal(t, 2, a.Version())
+		assert.Empty(t, a.Changes())
+
+		require.Len(t, events, 2)
+		for i, e := range events {
+			assert.Equal(t, "a1", e.Key)
+			assert.Equal(t, "tx1", e.TxID)
+			assert.Equal(t, uint64(i+1), e.Seq)
+		}
+
+		v, err := r.Version(ctx, "a1")
+		require.Nil(t, err)
+		assert.Equal(t, 2, v)
+	})
+
+	t.Run("assigns a tx id per save", func(t *testing.T) {
+		events = nil
+		a := load(t, r, "a2")
+		require.Nil(t, a.open())
+		require.Nil(t, a.deposit(5))
+		require.Nil(t, r.Save(ctx, a))
+
+		require.Len(t, events, 2)
+		assert.Equal(t, events[0].TxID, events[1].TxID)
+		assert.Equal(t, "tx-1", events[0].TxID)
+	})
+
+	t.Run("loads by replaying the stream", func(t *testing.T) {
+		require.Nil(t, b.Emit(ctx, topicAccountOpened, fakeAmount{}))
+
+		a := load(t, r, "a1")
+		assert.Equal(t, 2, a.Version())
+		assert.True(t, a.Open)
+		assert.Equal(t, 10, a.Balance)
+
+		require.Nil(t, a.withdraw(3))
+		require.Nil(t, r.Save(ctx, a))
+		assert.Equal(t, 7, load(t, r, "a1").Balance)
+	})
+
+	t.Run("rejects the stale saves", func(t *testing.T) {
+		a, b := load(t, r, "a1"), load(t, r, "a1")
+		require.Nil(t, a.deposit(1))
+		require.Nil(t, b.deposit(2))
+
+		require.Nil(t, r.Save(ctx, a))
+		err := r.Save(ctx, b)
+		assert.True(t, errors.Is(err, es.ErrVersionConflict), err)
+		assert.EqualError(t, err, "es: version conflict: aggregate(a1) version(4) does not match the expected version(3)")
+		assert.Len(t, b.Changes(), 1)
+	})
+
+	t.Run("rebuilds the index on a new repository", func(t *testing.T) {
+		r := setupRepository(t, b)
+		a := load(t, r, "a1")
+		assert.Equal(t, 4, a.Version())
+		assert.Equal(t, 8, a.Balance)
+	})
+
+	t.Run("keeps all changes of a failed save", func(t *testing.T) {
+		a := load(t, r, "a2")
+		require.Nil(t, a.deposit(1))
+		require.Nil(t, es.Raise(a, "account.unknown", fakeAmount{}))
+
+		err := r.Save(ctx, a)
+		assert.EqualError(t, err, "es: aggregate(a2) save failed: bus: topic(account.unknown) not found")
+		assert.Equal(t, 2, a.Version())
+		assert.Len(t, a.Changes(), 2)
+
+		v, err := r.Version(ctx, "a2")
+		require.Nil(t, err)
+		assert.Equal(t, 2, v)
+	})
+
+	t.Run("rejects the saves after the emits of the stream", func(t *testing.T) {
+		a := load(t, r, "a1")
+		require.Nil(t, a.deposit(1))
+		require.Nil(t, b.EmitWithOpts(ctx, topicAccountDeposited, fakeAmount{Amount: 1}, bus.WithKey("a1")))
+
+		err := r.Save(ctx, a)
+		assert.True(t, errors.Is(err, es.ErrVersionConflict), err)
+		assert.Len(t, a.Changes(), 1)
+	})
+
+	require.Nil(t, s.Close())
+}
+
+func TestRepositoryLoadOnSave(t *testing.T) {
+	b, s := setupBus(t)
+	r := setupRepository(t, b)
+	ctx := context.Background()
+
+	var versions []int
+	b.RegisterHandler("test.reader", bus.Handler{
+		Handle: func(ctx context.Context, e bus.Event) {
+			a, err := r.Load(ctx, e.Key)
+			require.Nil(t, err)
+			versions = append(versions, a.AggregateRoot().Version())
+		},
+		Matcher: "^account\\.",
+	})
+
+	a := load(t, r, "a1")
+	require.Nil(t, a.open())
+	require.Nil(t, a.deposit(10))
+	require.Nil(t, r.Save(ctx, a))
+	// the batch is stored before its delivery
+	assert.Equal(t, []int{2, 2}, versions)
+
+	require.Nil(t, s.Close())
+}
+
+func TestRepositoryWithoutEventStore(t *testing.T) {
+	b, err := bus.NewBus(fakeIDGen())
+	require.Nil(t, err)
+	r := setupRepository(t, b)
+
+	_, err = r.Load(context.Background(), "a1")
+	assert.EqualError(t, err, "bus: event store is not configured")
+}
+
+func setupBus(t *testing.T) (*bus.Bus, *bus.FileStore) {
+	types := bus.NewTypeRegistry()
+	types.Register(topicAccountOpened, fakeAmount{})
+	types.Register(topicAccountDeposited, fakeAmount{})
+	types.Register(topicAccountWithdrawn, fakeAmount{})
+
+	s, err := bus.OpenFileStore(t.TempDir(), bus.JSONCodec{}, types)
+	require.Nil(t, err)
+
+	b, err := bus.NewBus(fakeIDGen(), bus.WithEventStore(s))
+	require.Nil(t, err)
+	b.RegisterTopics(topicAccountOpened, topicAccountDeposited, topicAccountWithdrawn)
+	return b, s
+}
+
+func setupRepository(t *testing.T, b *bus.Bus) *es.Repository {
+	r, err := es.NewRepository(b, fakeIDGen(), es.Config{Matcher: "^account\\.", New: newFakeAccount})
+	require.Nil(t, err)
+	return r
+}
+
+func load(t *testing.T, r *es.Repository, id string) *fakeAccount {
+	a, err := r.Load(context.Background(), id)
+	require.Nil(t, err)
+	return a.(*fakeAccount)
+}
+
+func newFakeAccount() es.Aggregate {
+	return &fakeAccount{}
+}
+
+func fakeIDGen() bus.Next {
+	var n int
+	return func() string {
+		n++
+		return fmt.Sprintf("tx-%d", n)
+	}
+}
@@ -0,0 +1,365 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package bus
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/mustafaturan/bus/v3/internal/fsutil"
+)
+
+const (
+	fileStoreLog     = "events.log"
+	fileStoreOffsets = "offsets.json"
+
+	// fileStoreFlushInterval is the max delay of the offset commit writes
+	fileStoreFlushInterval = 100 * time.Millisecond
+)
+
+var errTornRecord = errors.New("bus: file store record is torn")
+
+// FileStore is a file based EventStore and OffsetStore keeping the events in
+// an append only log and the offsets in a json file of its directory
+//
+// The log records are length prefixed event envelopes; a torn or corrupted
+// record is truncated on open with the rest of the log. The offset commits
+// are coalesced and written within 100ms, on Flush or on Close, so the
+// events of the commits lost on a crash are delivered again.
+type FileStore struct {
+	dir   string
+	codec Codec
+	types *TypeRegistry
+
+	mutex sync.Mutex
+	log   *os.File
+	size  int64
+	last  uint64
+
+	offsetsMutex sync.Mutex
+	offsets      map[string]uint64
+	dirty        bool  // offsets file is behind the offsets
+	flush        Timer // scheduled offsets write, nil when none
+	flushErr     error // failure of the last scheduled offsets write
+}
+
+// OpenFileStore opens the store in the directory creating it when missing;
+// the payloads are encoded with the codec into the registered types
+func OpenFileStore(dir string, c Codec, r *TypeRegistry) (*FileStore, error) {
+	if c == nil || r == nil {
+		return nil, fmt.Errorf("bus: file store codec and type registry can't be nil")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("bus: file store dir(%s) create failed: %w", dir, err)
+	}
+
+	s := &FileStore{dir: dir, codec: c, types: r, offsets: make(map[string]uint64)}
+	if err := s.openLog(); err != nil {
+		return nil, err
+	}
+	if err := s.loadOffsets(); err != nil {
+		_ = s.log.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Append writes the event to the end of the log with the next seq
+func (s *FileStore) Append(e Event) (Event, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	e.Seq = s.last + 1
+	data, err := MarshalEvent(s.codec, e)
+	if err != nil {
+		return e, err
+	}
+
+	if err := s.write(appendRecord(nil, data)); err != nil {
+		return e, err
+	}
+	s.last = e.Seq
+	return e, nil
+}
+
+// AppendBatch writes the events to the end of the log with the next seqs in
+// a single write
+func (s *FileStore) AppendBatch(events []Event) ([]Event, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	stored := make([]Event, len(events))
+	var records []byte
+	for i, e := range events {
+		e.Seq = s.last + uint64(i) + 1
+		data, err := MarshalEvent(s.codec, e)
+		if err != nil {
+			return events, err
+		}
+		records = appendRecord(records, data)
+		stored[i] = e
+	}
+
+	if err := s.write(records); err != nil {
+		return events, err
+	}
+	s.last += uint64(len(events))
+	return stored, nil
+}
+
+// write appends the records to the log; must be called with the lock
+func (s *FileStore) write(records []byte) error {
+	if _, err := s.log.Write(records); err != nil {
+		// drop the partially written records
+		_ = s.log.Truncate(s.size)
+		return fmt.Errorf("bus: file store append failed: %w", err)
+	}
+	s.size += int64(len(records))
+	return nil
+}
+
+// Read calls fn with the events appended before the call from the seq
+func (s *FileStore) Read(from uint64, fn func(e Event) error) error {
+	s.mutex.Lock()
+	size := s.size
+	s.mutex.Unlock()
+
+	f, err := os.Open(filepath.Join(s.dir, fileStoreLog))
+	if err != nil {
+		return fmt.Errorf("bus: file store read failed: %w", err)
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(io.LimitReader(f, size))
+	for pos := int64(0); ; {
+		data, err := readRecord(r, size-pos)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("bus: file store read failed: %w", err)
+		}
+		pos += int64(uvarintLen(uint64(len(data))) + len(data))
+
+		seq, err := envelopeSeq(data)
+		if err != nil {
+			return err
+		}
+		if seq < from {
+			continue
+		}
+
+		e, err := UnmarshalEvent(s.codec, s.types, data)
+		if err != nil {
+			return err
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+}
+
+// LastSeq returns the seq of the last appended event
+func (s *FileStore) LastSeq() uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.last
+}
+
+// Offset returns the committed seq of the handler
+func (s *FileStore) Offset(handlerKey string) (uint64, error) {
+	s.offsetsMutex.Lock()
+	defer s.offsetsMutex.Unlock()
+
+	return s.offsets[handlerKey], nil
+}
+
+// Commit stores the committed seq of the handler and schedules the offsets
+// file write; returns the failure of the previous scheduled write
+func (s *FileStore) Commit(handlerKey string, seq uint64) error {
+	s.offsetsMutex.Lock()
+	defer s.offsetsMutex.Unlock()
+
+	s.offsets[handlerKey] = seq
+	s.dirty = true
+	if s.flush == nil {
+		s.flush = SystemClock.AfterFunc(fileStoreFlushInterval, func() {
+			s.offsetsMutex.Lock()
+			defer s.offsetsMutex.Unlock()
+
+			if s.flush != nil {
+				s.flush = nil
+				s.flushErr = s.flushOffsets()
+			}
+		})
+	}
+
+	err := s.flushErr
+	s.flushErr = nil
+	return err
+}
+
+// Flush writes the pending offset commits
+func (s *FileStore) Flush() error {
+	s.offsetsMutex.Lock()
+	defer s.offsetsMutex.Unlock()
+
+	if s.flush != nil {
+		s.flush.Stop()
+		s.flush = nil
+	}
+	s.flushErr = nil
+	return s.flushOffsets()
+}
+
+// Close writes the pending offset commits, syncs and closes the log
+func (s *FileStore) Close() error {
+	ferr := s.Flush()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if ferr != nil {
+		_ = s.log.Close()
+		return ferr
+	}
+	if err := s.log.Sync(); err != nil {
+		_ = s.log.Close()
+		return fmt.Errorf("bus: file store sync failed: %w", err)
+	}
+	return s.log.Close()
+}
+
+// openLog opens the log, finds the last seq and truncates a torn or corrupted
+// record with the rest of the log
+func (s *FileStore) openLog() error {
+	path := filepath.Join(s.dir, fileStoreLog)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("bus: file store log(%s) open failed: %w", path, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("bus: file store log(%s) open failed: %w", path, err)
+	}
+
+	r := bufio.NewReader(f)
+	for {
+		data, err := readRecord(r, info.Size()-s.size)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil && !errors.Is(err, errTornRecord) {
+			_ = f.Close()
+			return fmt.Errorf("bus: file store log(%s) read failed: %w", path, err)
+		}
+
+		var seq uint64
+		if err == nil {
+			seq, err = envelopeSeq(data)
+		}
+		if err != nil || seq <= s.last {
+			if err := f.Truncate(s.size); err != nil {
+				_ = f.Close()
+				return fmt.Errorf("bus: file store log(%s) truncate failed: %w", path, err)
+			}
+			break
+		}
+		s.last = seq
+		s.size += int64(uvarintLen(uint64(len(data))) + len(data))
+	}
+
+	s.log = f
+	return nil
+}
+
+func (s *FileStore) loadOffsets() error {
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, fileStoreOffsets))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("bus: file store offsets read failed: %w", err)
+	}
+	if err := json.Unmarshal(data, &s.offsets); err != nil {
+		return fmt.Errorf("bus: file store offsets decode failed: %w", err)
+	}
+	return nil
+}
+
+// flushOffsets writes the offsets when the offsets file is behind; must be
+// called with the offsets lock
+func (s *FileStore) flushOffsets() error {
+	if !s.dirty {
+		return nil
+	}
+	if err := s.saveOffsets(); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// saveOffsets replaces the offsets file; must be called with the offsets lock
+func (s *FileStore) saveOffsets() error {
+	data, err := json.Marshal(s.offsets)
+	if err != nil {
+		return fmt.Errorf("bus: file store offsets encode failed: %w", err)
+	}
+
+	if err := fsutil.WriteFile(filepath.Join(s.dir, fileStoreOffsets), data, 0o644); err != nil {
+		return fmt.Errorf("bus: file store offsets write failed: %w", err)
+	}
+	return nil
+}
+
+// readRecord reads a length prefixed record of at most size bytes; io.EOF is
+// returned only at a record boundary, a record with an invalid length or cut
+// short returns errTornRecord
+func readRecord(r *bufio.Reader, size int64) ([]byte, error) {
+	l, err := binary.ReadUvarint(r)
+	if errors.Is(err, io.EOF) {
+		return nil, io.EOF
+	}
+	if err != nil {
+		// a partial or an overflowing length
+		return nil, errTornRecord
+	}
+	if n := size - int64(uvarintLen(l)); l == 0 || n < 0 || l > uint64(n) {
+		return nil, errTornRecord
+	}
+
+	data := make([]byte, l)
+	if _, err := io.ReadFull(r, data); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, errTornRecord
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+// appendRecord appends the length prefixed record of the data to the buf
+func appendRecord(buf, data []byte) []byte {
+	var l [binary.MaxVarintLen64]byte
+	buf = append(buf, l[:binary.PutUvarint(l[:], uint64(len(data)))]...)
+	return append(buf, data...)
+}
+
+func uvarintLen(v uint64) int {
+	var l [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(l[:], v)
+}
@@ -0,0 +1,198 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package bus_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mustafaturan/bus/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenFileStore(t *testing.T) {
+	t.Run("with nil codec", func(t *testing.T) {
+		_, err := bus.OpenFileStore(t.TempDir(), nil, bus.NewTypeRegistry())
+		assert.EqualError(t, err, "bus: file store codec and type registry can't be nil")
+	})
+
+	t.Run("with corrupted offsets", func(t *testing.T) {
+		dir := t.TempDir()
+		require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "offsets.json"), []byte("{"), 0o644))
+		_, err := bus.OpenFileStore(dir, bus.JSONCodec{}, bus.NewTypeRegistry())
+		assert.Error(t, err)
+	})
+}
+
+func TestFileStore(t *testing.T) {
+	dir := t.TempDir()
+	s := openFileStore(t, dir)
+
+	for i, id := range []string{"1", "2", "3"} {
+		e, err := s.Append(bus.Event{ID: id, Topic: topicCommentCreated, Data: fakeOrder{ID: id}})
+		require.Nil(t, err)
+		assert.Equal(t, uint64(i+1), e.Seq)
+	}
+	assert.Equal(t, uint64(3), s.LastSeq())
+
+	t.Run("reads from the seq", func(t *testing.T) {
+		assert.Equal(t, []interface{}{fakeOrder{ID: "2"}, fakeOrder{ID: "3"}}, readFileStore(t, s, 2))
+	})
+
+	t.Run("commits offsets", func(t *testing.T) {
+		got, err := s.Offset("test.handler")
+		require.Nil(t, err)
+		assert.Equal(t, uint64(0), got)
+
+		require.Nil(t, s.Commit("test.handler", 2))
+		got, err = s.Offset("test.handler")
+		require.Nil(t, err)
+		assert.Equal(t, uint64(2), got)
+	})
+
+	t.Run("reopens", func(t *testing.T) {
+		require.Nil(t, s.Close())
+		s = openFileStore(t, dir)
+
+		assert.Equal(t, uint64(3), s.LastSeq())
+		got, err := s.Offset("test.handler")
+		require.Nil(t, err)
+		assert.Equal(t, uint64(2), got)
+	})
+
+	t.Run("truncates torn record", func(t *testing.T) {
+		require.Nil(t, s.Close())
+
+		f, err := os.OpenFile(filepath.Join(dir, "events.log"), os.O_APPEND|os.O_WRONLY, 0o644)
+		require.Nil(t, err)
+		_, err = f.Write([]byte{100, 1, 2, 3})
+		require.Nil(t, err)
+		require.Nil(t, f.Close())
+
+		s = openFileStore(t, dir)
+		assert.Equal(t, uint64(3), s.LastSeq())
+
+		e, err := s.Append(bus.Event{ID: "4", Topic: topicCommentCreated, Data: fakeOrder{ID: "4"}})
+		require.Nil(t, err)
+		assert.Equal(t, uint64(4), e.Seq)
+		assert.Len(t, readFileStore(t, s, 1), 4)
+	})
+
+	t.Run("truncates zero filled tail", func(t *testing.T) {
+		require.Nil(t, s.Close())
+
+		f, err := os.OpenFile(filepath.Join(dir, "events.log"), os.O_APPEND|os.O_WRONLY, 0o644)
+		require.Nil(t, err)
+		_, err = f.Write(make([]byte, 16))
+		require.Nil(t, err)
+		require.Nil(t, f.Close())
+
+		s = openFileStore(t, dir)
+		assert.Equal(t, uint64(4), s.LastSeq())
+		assert.Len(t, readFileStore(t, s, 1), 4)
+	})
+
+	require.Nil(t, s.Close())
+}
+
+func TestFileStoreAppendBatch(t *testing.T) {
+	s := openFileStore(t, t.TempDir())
+	defer s.Close()
+
+	events, err := s.AppendBatch([]bus.Event{
+		{ID: "1", Topic: topicCommentCreated, Data: fakeOrder{ID: "1"}},
+		{ID: "2", Topic: topicCommentCreated, Data: fakeOrder{ID: "2"}},
+	})
+	require.Nil(t, err)
+	assert.Equal(t, uint64(1), events[0].Seq)
+	assert.Equal(t, uint64(2), events[1].Seq)
+
+	t.Run("with failing event", func(t *testing.T) {
+		_, err := s.AppendBatch([]bus.Event{
+			{ID: "3", Topic: topicCommentCreated, Data: fakeOrder{ID: "3"}},
+			{ID: "4", Topic: topicCommentCreated, Data: make(chan int)},
+		})
+		assert.NotNil(t, err)
+		assert.Equal(t, uint64(2), s.LastSeq())
+		assert.Equal(t, []interface{}{fakeOrder{ID: "1"}, fakeOrder{ID: "2"}}, readFileStore(t, s, 1))
+	})
+}
+
+func TestFileStoreCommit(t *testing.T) {
+	dir := t.TempDir()
+	s := openFileStore(t, dir)
+	defer s.Close()
+	path := filepath.Join(dir, "offsets.json")
+
+	t.Run("coalesces the commits", func(t *testing.T) {
+		require.Nil(t, s.Commit("test.handler", 1))
+		require.Nil(t, s.Commit("test.handler", 2))
+		assert.NoFileExists(t, path)
+
+		require.Nil(t, s.Flush())
+		data, err := ioutil.ReadFile(path)
+		require.Nil(t, err)
+		assert.JSONEq(t, `{"test.handler":2}`, string(data))
+	})
+
+	t.Run("writes the commits after the interval", func(t *testing.T) {
+		require.Nil(t, s.Commit("test.handler", 3))
+		assert.Eventually(t, func() bool {
+			data, _ := ioutil.ReadFile(path)
+			return string(data) == `{"test.handler":3}`
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("with failing write", func(t *testing.T) {
+		require.Nil(t, os.Mkdir(path+".tmp", 0o755))
+		require.Nil(t, s.Commit("test.handler", 4))
+
+		err := s.Flush()
+		assert.Contains(t, err.Error(), "bus: file store offsets write failed: ")
+
+		require.Nil(t, os.Remove(path+".tmp"))
+		require.Nil(t, s.Flush())
+		data, err := ioutil.ReadFile(path)
+		require.Nil(t, err)
+		assert.JSONEq(t, `{"test.handler":4}`, string(data))
+	})
+}
+
+func TestFileStoreCorruptedLog(t *testing.T) {
+	dir := t.TempDir()
+	garbage := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "events.log"), garbage, 0o644))
+
+	s := openFileStore(t, dir)
+	assert.Equal(t, uint64(0), s.LastSeq())
+
+	e, err := s.Append(bus.Event{ID: "1", Topic: topicCommentCreated, Data: fakeOrder{ID: "1"}})
+	require.Nil(t, err)
+	assert.Equal(t, uint64(1), e.Seq)
+	assert.Len(t, readFileStore(t, s, 1), 1)
+	require.Nil(t, s.Close())
+}
+
+func openFileStore(t *testing.T, dir string) *bus.FileStore {
+	r := bus.NewTypeRegistry()
+	r.Register(topicCommentCreated, fakeOrder{})
+
+	s, err := bus.OpenFileStore(dir, bus.JSONCodec{}, r)
+	require.Nil(t, err)
+	return s
+}
+
+func readFileStore(t *testing.T, s bus.EventStore, from uint64) []interface{} {
+	var got []interface{}
+	require.Nil(t, s.Read(from, func(e bus.Event) error {
+		got = append(got, e.Data)
+		return nil
+	}))
+	return got
+}
@@ -0,0 +1,163 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package bus
+
+import (
+	"context"
+	"sort"
+	"sync/atomic"
+)
+
+// GroupStrategy picks the member of a consumer group receiving an event
+type GroupStrategy int32
+
+const (
+	// GroupRoundRobin rotates the events over the members in key order
+	GroupRoundRobin GroupStrategy = iota
+
+	// GroupLeastBusy delivers the events to the member with the least in
+	// flight events, ties are broken in round robin order
+	GroupLeastBusy
+)
+
+type (
+	// group is a consumer group shared by the routes of its members
+	group struct {
+		strategy int32
+		next     uint64
+	}
+
+	// route is a delivery unit of a topic, either a handler or the members
+	// of a consumer group subscribed to the topic
+	route struct {
+		handler Handler
+		group   *group
+		members []Handler
+	}
+)
+
+// SetGroupStrategy sets the strategy of the consumer group, the default is
+// GroupRoundRobin
+func (b *Bus) SetGroupStrategy(name string, s GroupStrategy) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	atomic.StoreInt32(&b.group(name).strategy, int32(s))
+}
+
+// GroupMembers returns the handler keys of the consumer group in key order
+func (b *Bus) GroupMembers(name string) []string {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	keys := make([]string, 0)
+	for key, h := range b.handlers {
+		if h.Group == name {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (r route) deliver(ctx context.Context, e Event) {
+	if r.group == nil {
+		r.handler.deliver(ctx, e)
+		return
+	}
+	if h, ok := r.group.pick(r.members, e); ok {
+		h.deliver(ctx, e)
+	}
+}
+
+// pick returns the member receiving the next event among the members of its
+// tenant, paused members are skipped unless all those members are paused
+func (g *group) pick(members []Handler, e Event) (Handler, bool) {
+	n := 0
+	for _, h := range members {
+		if h.accepts(e) {
+			n++
+		}
+	}
+	if n == 0 {
+		return Handler{}, false
+	}
+	start := int((atomic.AddUint64(&g.next, 1) - 1) % uint64(n))
+	strategy := GroupStrategy(atomic.LoadInt32(&g.strategy))
+
+	// pos is the position of the member in the rotation of the event over
+	// the members of its tenant
+	var (
+		picked, first  Handler
+		best, firstPos = n, n
+		least          int64
+		rank           int
+	)
+	for _, h := range members {
+		if !h.accepts(e) {
+			continue
+		}
+		pos := (rank - start + n) % n
+		rank++
+		if pos < firstPos {
+			first, firstPos = h, pos
+		}
+		if atomic.LoadInt32(&h.state.mode) != handlerRunning {
+			continue
+		}
+
+		var busy int64
+		if strategy == GroupLeastBusy {
+			busy = atomic.LoadInt64(&h.state.inFlight)
+		}
+		if best == n || busy < least || (busy == least && pos < best) {
+			picked, best, least = h, pos, busy
+		}
+	}
+
+	if best == n {
+		return first, true
+	}
+	return picked, true
+}
+
+// group returns the consumer group, must be called with the lock
+func (b *Bus) group(name string) *group {
+	g, ok := b.groups[name]
+	if !ok {
+		g = &group{}
+		b.groups[name] = g
+	}
+	return g
+}
+
+// route rebuilds the delivery routes of the topic, the members of a group
+// are rebalanced over the current subscribers; must be called with the lock
+func (b *Bus) route(topic string) {
+	handlers := b.topics[topic]
+	routes := make([]route, 0, len(handlers))
+	indexes := make(map[string]int)
+
+	for _, h := range handlers {
+		if h.Group == empty {
+			routes = append(routes, route{handler: h})
+			continue
+		}
+
+		i, ok := indexes[h.Group]
+		if !ok {
+			i = len(routes)
+			indexes[h.Group] = i
+			routes = append(routes, route{group: b.group(h.Group)})
+		}
+		routes[i].members = append(routes[i].members, h)
+	}
+
+	for _, r := range routes {
+		members := r.members
+		sort.Slice(members, func(i, j int) bool { return members[i].key < members[j].key })
+	}
+	b.routes[topic] = routes
+}
@@ -0,0 +1,171 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package bus_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mustafaturan/bus/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroupRoundRobin(t *testing.T) {
+	b := setup(topicCommentCreated)
+	defer tearDown(b, topicCommentCreated)
+
+	recorders := make(map[string]*fakeRecorder)
+	register := func(key, group string) {
+		r := &fakeRecorder{}
+		recorders[key] = r
+		b.RegisterHandler(key, bus.Handler{Handle: r.record, Matcher: ".*", Group: group})
+	}
+	register("worker.1", "workers")
+	register("worker.2", "workers")
+	register("worker.3", "workers")
+	register("mailer.1", "mailers")
+	register("audit", "")
+
+	ctx := context.Background()
+	for i := 0; i < 6; i++ {
+		require.Nil(t, b.Emit(ctx, topicCommentCreated, i))
+	}
+
+	t.Run("delivers to one member per group", func(t *testing.T) {
+		assert.Equal(t, []interface{}{0, 3}, recorders["worker.1"].received())
+		assert.Equal(t, []interface{}{1, 4}, recorders["worker.2"].received())
+		assert.Equal(t, []interface{}{2, 5}, recorders["worker.3"].received())
+		assert.Len(t, recorders["mailer.1"].received(), 6)
+		assert.Len(t, recorders["audit"].received(), 6)
+	})
+
+	t.Run("rebalances on deregister", func(t *testing.T) {
+		b.DeregisterHandler("worker.2")
+		assert.Equal(t, []string{"worker.1", "worker.3"}, b.GroupMembers("workers"))
+
+		for i := 6; i < 10; i++ {
+			require.Nil(t, b.Emit(ctx, topicCommentCreated, i))
+		}
+		assert.Equal(t, []interface{}{1, 4}, recorders["worker.2"].received())
+		assert.Len(t, recorders["worker.1"].received(), 4)
+		assert.Len(t, recorders["worker.3"].received(), 4)
+	})
+
+	t.Run("rebalances on register", func(t *testing.T) {
+		register("worker.4", "workers")
+		assert.Equal(t, []string{"worker.1", "worker.3", "worker.4"}, b.GroupMembers("workers"))
+
+		for i := 10; i < 13; i++ {
+			require.Nil(t, b.Emit(ctx, topicCommentCreated, i))
+		}
+		assert.Len(t, recorders["worker.4"].received(), 1)
+	})
+
+	t.Run("skips paused members", func(t *testing.T) {
+		require.Nil(t, b.PauseHandler("worker.1"))
+		defer func() { require.Nil(t, b.ResumeHandler("worker.1")) }()
+
+		before := len(recorders["worker.1"].received())
+		for i := 13; i < 16; i++ {
+			require.Nil(t, b.Emit(ctx, topicCommentCreated, i))
+		}
+		stats, _ := b.HandlerStats("worker.1")
+		assert.Equal(t, 0, stats.Queued)
+		assert.Len(t, recorders["worker.1"].received(), before)
+	})
+
+	t.Run("exports the group", func(t *testing.T) {
+		handlers := b.Topology().Handlers
+		require.Len(t, handlers, 5)
+		assert.Equal(t, bus.HandlerNode{Key: "worker.4", Matcher: ".*", Group: "workers"}, handlers[4])
+	})
+}
+
+func TestGroupLeastBusy(t *testing.T) {
+	b := setup(topicCommentCreated)
+	defer tearDown(b, topicCommentCreated)
+	b.SetGroupStrategy("workers", bus.GroupLeastBusy)
+
+	block := make(chan struct{})
+	slow, fast := &fakeRecorder{}, &fakeRecorder{}
+	b.RegisterHandler("worker.slow", bus.Handler{
+		Handle: func(ctx context.Context, e bus.Event) {
+			<-block
+			slow.record(ctx, e)
+		},
+		Matcher: ".*",
+		Group:   "workers",
+	})
+	b.RegisterHandler("worker.fast", bus.Handler{Handle: fast.record, Matcher: ".*", Group: "workers"})
+
+	ctx := context.Background()
+	// the first event goes to the first member in key order
+	require.Nil(t, b.Emit(ctx, topicCommentCreated, 0))
+	assert.Equal(t, []interface{}{0}, fast.received())
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = b.Emit(ctx, topicCommentCreated, 1)
+	}()
+	require.Eventually(t, func() bool {
+		stats, _ := b.HandlerStats("worker.slow")
+		return stats.InFlight == 1
+	}, time.Second, time.Millisecond)
+
+	for i := 2; i < 5; i++ {
+		require.Nil(t, b.Emit(ctx, topicCommentCreated, i))
+	}
+	assert.Equal(t, []interface{}{0, 2, 3, 4}, fast.received())
+
+	close(block)
+	<-done
+	assert.Equal(t, []interface{}{1}, slow.received())
+}
+
+func TestGroupMembers(t *testing.T) {
+	b := setup()
+	assert.Empty(t, b.GroupMembers("workers"))
+}
+
+func TestGroupDurable(t *testing.T) {
+	s := openFileStore(t, t.TempDir())
+	defer s.Close()
+	b := setupStore(t, s, nil)
+
+	ctx := context.Background()
+	for i := 1; i <= 3; i++ {
+		require.Nil(t, b.Emit(ctx, topicCommentCreated, fakeOrder{ID: fmt.Sprint(i)}))
+	}
+
+	first, second := &fakeRecorder{}, &fakeRecorder{}
+	b.RegisterHandler("worker.1", bus.Handler{Handle: first.record, Matcher: ".*", Group: "workers", Commit: bus.CommitAuto})
+	assert.Len(t, first.received(), 3)
+
+	t.Run("catches up from the group offset", func(t *testing.T) {
+		b.RegisterHandler("worker.2", bus.Handler{Handle: second.record, Matcher: ".*", Group: "workers", Commit: bus.CommitAuto})
+		assert.Empty(t, second.received())
+	})
+
+	t.Run("commits the group offset", func(t *testing.T) {
+		require.Nil(t, b.Emit(ctx, topicCommentCreated, fakeOrder{ID: "4"}))
+		require.Nil(t, b.Emit(ctx, topicCommentCreated, fakeOrder{ID: "5"}))
+		assert.Len(t, first.received(), 4)
+		assert.Len(t, second.received(), 1)
+
+		for _, key := range []string{"worker.1", "worker.2"} {
+			offset, err := b.HandlerOffset(key)
+			require.Nil(t, err)
+			assert.Equal(t, uint64(5), offset)
+		}
+
+		offset, err := s.Offset("worker.1")
+		require.Nil(t, err)
+		assert.Equal(t, uint64(0), offset)
+	})
+}
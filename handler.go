@@ -0,0 +1,418 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package bus
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+type (
+	// HandlerStats is a snapshot of the handler delivery metrics
+	HandlerStats struct {
+		Delivered uint64 `json:"delivered"` // number of handled events
+		Dropped   uint64 `json:"dropped"`   // number of events dropped on overflow
+		Throttled uint64 `json:"throttled"` // number of events over the rate limit
+		InFlight  int64  `json:"inFlight"`  // number of events being handled
+		Queued    int    `json:"queued"`    // number of buffered events
+		Paused    bool   `json:"paused"`    // whether the handler is paused
+	}
+
+	// PauseConfig holds the buffering options of a paused handler
+	PauseConfig struct {
+		BufferSize int            // max number of buffered events
+		Overflow   OverflowPolicy // what to do when the buffer is full
+
+		// receives the overflowing events with the OverflowSpill policy, i.e.
+		// to append them to an event store
+		Spill func(ctx context.Context, e Event)
+	}
+
+	// PauseOption is a function type to mutate pause config fields
+	PauseOption = func(PauseConfig) PauseConfig
+
+	// OverflowPolicy decides which event is given up when the buffer of a
+	// paused handler is full
+	OverflowPolicy int8
+
+	// handlerState is shared by the copies of a registered handler
+	handlerState struct {
+		delivered uint64
+		dropped   uint64
+		inFlight  int64
+		mode      int32 // handlerRunning, handlerPaused or handlerDraining
+
+		mutex   sync.Mutex
+		config  PauseConfig
+		buffer  []pendingEvent
+		queued  map[string]int // number of the buffered events by tenant
+		holding bool           // paused for the catch up of a durable handler
+
+		// the catch up reads the stored events up to covered and re-reads the
+		// events given up on a full buffer when overflowed
+		covered    uint64
+		overflowed bool
+	}
+
+	pendingEvent struct {
+		ctx context.Context
+		e   Event
+	}
+)
+
+const (
+	// OverflowDropOldest drops the oldest buffered event for the new one
+	OverflowDropOldest OverflowPolicy = iota
+
+	// OverflowDropNewest drops the new event
+	OverflowDropNewest
+
+	// OverflowSpill passes the new event to the Spill func
+	OverflowSpill
+)
+
+const (
+	handlerRunning int32 = iota
+	handlerPaused
+	handlerDraining
+
+	// DefaultPauseBufferSize is the default buffer size of paused handlers
+	DefaultPauseBufferSize = 1024
+)
+
+// WithBufferSize returns an option to set the buffer size of a paused handler
+func WithBufferSize(size int) PauseOption {
+	return func(c PauseConfig) PauseConfig {
+		c.BufferSize = size
+		return c
+	}
+}
+
+// WithOverflowPolicy returns an option to set the overflow policy of a paused
+// handler
+func WithOverflowPolicy(p OverflowPolicy) PauseOption {
+	return func(c PauseConfig) PauseConfig {
+		c.Overflow = p
+		return c
+	}
+}
+
+// WithSpill returns an option to spill the overflowing events of a paused
+// handler to the given func
+func WithSpill(fn func(ctx context.Context, e Event)) PauseOption {
+	return func(c PauseConfig) PauseConfig {
+		c.Overflow = OverflowSpill
+		c.Spill = fn
+		return c
+	}
+}
+
+// HandlerStats returns the delivery metrics of the handler
+func (b *Bus) HandlerStats(key string) (HandlerStats, bool) {
+	b.mutex.RLock()
+	h, ok := b.handlers[key]
+	b.mutex.RUnlock()
+
+	if !ok {
+		return HandlerStats{}, false
+	}
+
+	stats := h.state.stats()
+	if h.limiter != nil {
+		stats.Throttled = atomic.LoadUint64(&h.limiter.throttled)
+		stats.Dropped += atomic.LoadUint64(&h.limiter.dropped)
+	}
+	return stats, true
+}
+
+// PauseHandler stops delivering events to the handler; the events are
+// buffered and delivered in order on resume
+func (b *Bus) PauseHandler(key string, opts ...PauseOption) error {
+	c := PauseConfig{BufferSize: DefaultPauseBufferSize}
+	for _, o := range opts {
+		c = o(c)
+	}
+	if c.BufferSize < 1 {
+		return fmt.Errorf("bus: pause buffer size(%d) must be positive", c.BufferSize)
+	}
+	if c.Overflow == OverflowSpill && c.Spill == nil {
+		return fmt.Errorf("bus: pause spill func can't be nil")
+	}
+
+	b.mutex.RLock()
+	h, ok := b.handlers[key]
+	b.mutex.RUnlock()
+
+	if !ok {
+		return fmt.Errorf("bus: handler(%s) not found", key)
+	}
+
+	h.state.pause(c)
+	return nil
+}
+
+// ResumeHandler delivers the buffered events of the paused handler in order
+// on the caller goroutine and then resumes the live delivery
+func (b *Bus) ResumeHandler(key string) error {
+	b.mutex.RLock()
+	h, ok := b.handlers[key]
+	b.mutex.RUnlock()
+
+	if !ok {
+		return fmt.Errorf("bus: handler(%s) not found", key)
+	}
+
+	h.resume()
+	return nil
+}
+
+// deliver handles the event unless it belongs to another tenant, buffering
+// it while the handler is paused
+func (h Handler) deliver(ctx context.Context, e Event) {
+	if !h.accepts(e) {
+		return
+	}
+	if atomic.LoadInt32(&h.state.mode) != handlerRunning && h.state.enqueue(ctx, e, h.tenants.queueSize(e.Tenant)) {
+		return
+	}
+	h.dispatch(ctx, e)
+}
+
+// dispatch handles the event applying the rate limit of the handler
+func (h Handler) dispatch(ctx context.Context, e Event) {
+	if h.limiter == nil {
+		h.handle(ctx, e)
+		return
+	}
+	h.throttle(ctx, e)
+}
+
+func (h Handler) throttle(ctx context.Context, e Event) {
+	_ = h.limiter.throttle(ctx, "handler", h.key, func(bool) { h.handle(ctx, e) })
+}
+
+func (h Handler) handle(ctx context.Context, e Event) {
+	atomic.AddInt64(&h.state.inFlight, 1)
+	defer func() {
+		atomic.AddInt64(&h.state.inFlight, -1)
+		atomic.AddUint64(&h.state.delivered, 1)
+	}()
+
+	if h.Queue != nil {
+		h.Queue(ctx, e, h.commit)
+		return
+	}
+	h.Handle(ctx, e)
+	if h.commit != nil {
+		h.commit(ctx, e)
+	}
+}
+
+func (h Handler) resume() {
+	s := h.state
+
+	s.mutex.Lock()
+	if s.mode != handlerPaused {
+		s.mutex.Unlock()
+		return
+	}
+	atomic.StoreInt32(&s.mode, handlerDraining)
+	s.mutex.Unlock()
+
+	for {
+		s.mutex.Lock()
+		// paused again while draining
+		if s.mode != handlerDraining {
+			s.mutex.Unlock()
+			return
+		}
+		if len(s.buffer) == 0 {
+			s.buffer, s.queued = nil, nil
+			atomic.StoreInt32(&s.mode, handlerRunning)
+			s.mutex.Unlock()
+			return
+		}
+		p := s.remove(0)
+		s.mutex.Unlock()
+
+		h.dispatch(p.ctx, p.e)
+	}
+}
+
+func (s *handlerState) pause(c PauseConfig) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.config = c
+	s.holding = false
+	atomic.StoreInt32(&s.mode, handlerPaused)
+}
+
+// hold pauses the running handler for the catch up of the stored events up
+// to the last seq, returns false when the handler is not running
+func (s *handlerState) hold(last uint64) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.mode != handlerRunning {
+		return false
+	}
+	s.config = PauseConfig{BufferSize: DefaultPauseBufferSize}
+	s.holding = true
+	s.covered, s.overflowed = last, false
+	atomic.StoreInt32(&s.mode, handlerPaused)
+	return true
+}
+
+// nextHeld returns the next buffered event of the held handler; after a
+// buffer overflow, it discards the buffered events up to the last stored seq
+// and returns the seq to re-read up to instead; more is false when the
+// handler is not held anymore or it is running with an empty buffer
+func (s *handlerState) nextHeld(lastSeq func() uint64) (p pendingEvent, reread uint64, more bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.holding || s.mode != handlerPaused {
+		return pendingEvent{}, 0, false
+	}
+
+	if s.overflowed {
+		s.overflowed = false
+		s.covered = lastSeq()
+		for i := 0; i < len(s.buffer); {
+			if seq := s.buffer[i].e.Seq; seq != 0 && seq <= s.covered {
+				s.remove(i)
+				continue
+			}
+			i++
+		}
+		return pendingEvent{}, s.covered, true
+	}
+
+	if len(s.buffer) == 0 {
+		s.buffer, s.queued = nil, nil
+		s.holding = false
+		atomic.StoreInt32(&s.mode, handlerRunning)
+		return pendingEvent{}, 0, false
+	}
+	return s.remove(0), 0, true
+}
+
+// release ends the hold, returns false when the handler was paused or
+// resumed in the meantime
+func (s *handlerState) release() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	held := s.holding && s.mode == handlerPaused
+	s.holding = false
+	return held
+}
+
+// enqueue buffers the event when the handler is not running, returns false
+// when the handler should process the event right away; the limit is the max
+// number of the buffered events of the tenant of the event, zero for no limit
+func (s *handlerState) enqueue(ctx context.Context, e Event, limit int) bool {
+	s.mutex.Lock()
+	if s.mode == handlerRunning {
+		s.mutex.Unlock()
+		return false
+	}
+
+	if s.holding {
+		// the stored events up to covered are read by the catch up and the
+		// ones over the buffer size are re-read from the store
+		if e.Seq == 0 || e.Seq > s.covered {
+			if len(s.buffer) < s.config.BufferSize {
+				s.push(ctx, e)
+			} else {
+				s.overflowed = true
+			}
+		}
+		s.mutex.Unlock()
+		return true
+	}
+
+	overTenant := limit > 0 && s.queued[e.Tenant] >= limit
+	if !overTenant && len(s.buffer) < s.config.BufferSize {
+		s.push(ctx, e)
+		s.mutex.Unlock()
+		return true
+	}
+
+	switch s.config.Overflow {
+	case OverflowDropOldest:
+		i := 0
+		if overTenant {
+			i = s.oldest(e.Tenant)
+		}
+		s.remove(i)
+		s.push(ctx, e)
+		atomic.AddUint64(&s.dropped, 1)
+	case OverflowDropNewest:
+		atomic.AddUint64(&s.dropped, 1)
+	case OverflowSpill:
+		spill := s.config.Spill
+		s.mutex.Unlock()
+		spill(ctx, e)
+		return true
+	}
+	s.mutex.Unlock()
+	return true
+}
+
+// push appends the event to the buffer; must be called with the lock
+func (s *handlerState) push(ctx context.Context, e Event) {
+	s.buffer = append(s.buffer, pendingEvent{ctx: ctx, e: e})
+	if e.Tenant != empty {
+		if s.queued == nil {
+			s.queued = make(map[string]int)
+		}
+		s.queued[e.Tenant]++
+	}
+}
+
+// remove takes the buffered event at the index; must be called with the lock
+func (s *handlerState) remove(i int) pendingEvent {
+	p := s.buffer[i]
+	if i == 0 {
+		s.buffer = s.buffer[1:]
+	} else {
+		s.buffer = append(s.buffer[:i], s.buffer[i+1:]...)
+	}
+	if p.e.Tenant != empty {
+		if s.queued[p.e.Tenant]--; s.queued[p.e.Tenant] == 0 {
+			delete(s.queued, p.e.Tenant)
+		}
+	}
+	return p
+}
+
+// oldest returns the index of the oldest buffered event of the tenant; must
+// be called with the lock
+func (s *handlerState) oldest(tenant string) int {
+	for i, p := range s.buffer {
+		if p.e.Tenant == tenant {
+			return i
+		}
+	}
+	return 0
+}
+
+func (s *handlerState) stats() HandlerStats {
+	s.mutex.Lock()
+	queued, mode := len(s.buffer), s.mode
+	s.mutex.Unlock()
+
+	return HandlerStats{
+		Delivered: atomic.LoadUint64(&s.delivered),
+		Dropped:   atomic.LoadUint64(&s.dropped),
+		InFlight:  atomic.LoadInt64(&s.inFlight),
+		Queued:    queued,
+		Paused:    mode != handlerRunning,
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package bus_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mustafaturan/bus/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandlerStats(t *testing.T) {
+	b := setup(topicCommentCreated, topicCommentDeleted)
+	defer tearDown(b, topicCommentCreated, topicCommentDeleted)
+
+	var inFlight bus.HandlerStats
+	b.RegisterHandler("test.handler", bus.Handler{
+		Handle: func(context.Context, bus.Event) {
+			inFlight, _ = b.HandlerStats("test.handler")
+		},
+		Matcher: "created$",
+	})
+	defer b.DeregisterHandler("test.handler")
+
+	ctx := context.Background()
+	require.Nil(t, b.Emit(ctx, topicCommentCreated, "1"))
+	require.Nil(t, b.EmitWithOpts(ctx, topicCommentCreated, "2"))
+	require.Nil(t, b.Emit(ctx, topicCommentDeleted, "3"))
+
+	stats, ok := b.HandlerStats("test.handler")
+	assert.True(t, ok)
+	assert.Equal(t, bus.HandlerStats{Delivered: 2}, stats)
+	assert.Equal(t, bus.HandlerStats{Delivered: 1, InFlight: 1}, inFlight)
+
+	_, ok = b.HandlerStats("unknown")
+	assert.False(t, ok)
+}
+
+func TestPauseHandler(t *testing.T) {
+	b := setup(topicCommentCreated)
+	defer tearDown(b, topicCommentCreated)
+
+	var received []interface{}
+	b.RegisterHandler("test.handler", bus.Handler{
+		Handle:  func(_ context.Context, e bus.Event) { received = append(received, e.Data) },
+		Matcher: ".*",
+	})
+	defer b.DeregisterHandler("test.handler")
+
+	ctx := context.Background()
+
+	t.Run("buffers and delivers in order on resume", func(t *testing.T) {
+		received = nil
+		require.Nil(t, b.PauseHandler("test.handler"))
+		for i := 0; i < 3; i++ {
+			require.Nil(t, b.Emit(ctx, topicCommentCreated, i))
+		}
+		assert.Empty(t, received)
+
+		stats, _ := b.HandlerStats("test.handler")
+		assert.True(t, stats.Paused)
+		assert.Equal(t, 3, stats.Queued)
+
+		require.Nil(t, b.ResumeHandler("test.handler"))
+		assert.Equal(t, []interface{}{0, 1, 2}, received)
+
+		require.Nil(t, b.Emit(ctx, topicCommentCreated, 3))
+		assert.Equal(t, []interface{}{0, 1, 2, 3}, received)
+
+		stats, _ = b.HandlerStats("test.handler")
+		assert.False(t, stats.Paused)
+		assert.Equal(t, 0, stats.Queued)
+	})
+
+	t.Run("keeps the buffer on re-register", func(t *testing.T) {
+		received = nil
+		require.Nil(t, b.PauseHandler("test.handler"))
+		require.Nil(t, b.Emit(ctx, topicCommentCreated, "a"))
+
+		var reregistered []interface{}
+		b.RegisterHandler("test.handler", bus.Handler{
+			Handle:  func(_ context.Context, e bus.Event) { reregistered = append(reregistered, e.Data) },
+			Matcher: ".*",
+		})
+		require.Nil(t, b.Emit(ctx, topicCommentCreated, "b"))
+
+		require.Nil(t, b.ResumeHandler("test.handler"))
+		assert.Empty(t, received)
+		assert.Equal(t, []interface{}{"a", "b"}, reregistered)
+	})
+
+	t.Run("with unknown handler", func(t *testing.T) {
+		assert.EqualError(t, b.PauseHandler("unknown"), "bus: handler(unknown) not found")
+		assert.EqualError(t, b.ResumeHandler("unknown"), "bus: handler(unknown) not found")
+	})
+
+	t.Run("with invalid options", func(t *testing.T) {
+		err := b.PauseHandler("test.handler", bus.WithBufferSize(0))
+		assert.EqualError(t, err, "bus: pause buffer size(0) must be positive")
+
+		err = b.PauseHandler("test.handler", bus.WithOverflowPolicy(bus.OverflowSpill))
+		assert.EqualError(t, err, "bus: pause spill func can't be nil")
+	})
+
+	t.Run("resumes running handler", func(t *testing.T) {
+		assert.Nil(t, b.ResumeHandler("test.handler"))
+	})
+}
+
+func TestPauseHandlerOverflow(t *testing.T) {
+	b := setup(topicCommentCreated)
+	defer tearDown(b, topicCommentCreated)
+
+	var received []interface{}
+	b.RegisterHandler("test.handler", bus.Handler{
+		Handle:  func(_ context.Context, e bus.Event) { received = append(received, e.Data) },
+		Matcher: ".*",
+	})
+	defer b.DeregisterHandler("test.handler")
+
+	var spilled []interface{}
+	spill := func(_ context.Context, e bus.Event) { spilled = append(spilled, e.Data) }
+
+	tests := []struct {
+		name    string
+		opts    []bus.PauseOption
+		want    []interface{}
+		spilled []interface{}
+		dropped uint64
+	}{
+		{
+			name:    "drop oldest",
+			opts:    []bus.PauseOption{bus.WithBufferSize(2)},
+			want:    []interface{}{2, 3},
+			dropped: 2,
+		},
+		{
+			name:    "drop newest",
+			opts:    []bus.PauseOption{bus.WithBufferSize(2), bus.WithOverflowPolicy(bus.OverflowDropNewest)},
+			want:    []interface{}{0, 1},
+			dropped: 4,
+		},
+		{
+			name:    "spill",
+			opts:    []bus.PauseOption{bus.WithBufferSize(2), bus.WithSpill(spill)},
+			want:    []interface{}{0, 1},
+			spilled: []interface{}{2, 3},
+			dropped: 4,
+		},
+	}
+
+	ctx := context.Background()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			received, spilled = nil, nil
+			require.Nil(t, b.PauseHandler("test.handler", test.opts...))
+			for i := 0; i < 4; i++ {
+				require.Nil(t, b.Emit(ctx, topicCommentCreated, i))
+			}
+			require.Nil(t, b.ResumeHandler("test.handler"))
+
+			assert.Equal(t, test.want, received)
+			assert.Equal(t, test.spilled, spilled)
+
+			stats, _ := b.HandlerStats("test.handler")
+			assert.Equal(t, test.dropped, stats.Dropped)
+		})
+	}
+}
+
+func TestPauseHandlerWhileDraining(t *testing.T) {
+	b := setup(topicCommentCreated)
+	defer tearDown(b, topicCommentCreated)
+
+	var received []interface{}
+	b.RegisterHandler("test.handler", bus.Handler{
+		Handle: func(_ context.Context, e bus.Event) {
+			received = append(received, e.Data)
+			if e.Data == 1 {
+				_ = b.PauseHandler("test.handler")
+			}
+		},
+		Matcher: ".*",
+	})
+	defer b.DeregisterHandler("test.handler")
+
+	ctx := context.Background()
+	require.Nil(t, b.PauseHandler("test.handler"))
+	for i := 0; i < 3; i++ {
+		require.Nil(t, b.Emit(ctx, topicCommentCreated, i))
+	}
+
+	require.Nil(t, b.ResumeHandler("test.handler"))
+	assert.Equal(t, []interface{}{0, 1}, received)
+
+	require.Nil(t, b.ResumeHandler("test.handler"))
+	assert.Equal(t, []interface{}{0, 1, 2}, received)
+}
@@ -0,0 +1,137 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package bus
+
+import "sort"
+
+type (
+	// Change describes a topic or handler registration change with the
+	// resulting subscription diff
+	Change struct {
+		Kind       ChangeKind
+		Topic      string         // set on topic changes
+		HandlerKey string         // set on handler changes
+		Added      []Subscription // subscriptions created by the change
+		Removed    []Subscription // subscriptions deleted by the change
+	}
+
+	// ChangeKind is the type of a registration change
+	ChangeKind int8
+
+	// Subscription is a topic and handler binding
+	Subscription struct {
+		Topic      string `json:"topic"`
+		HandlerKey string `json:"handler"`
+	}
+
+	hook struct {
+		key    string
+		notify func(c Change)
+	}
+)
+
+const (
+	// TopicRegistered is the change kind of a new topic
+	TopicRegistered ChangeKind = iota + 1
+
+	// TopicDeregistered is the change kind of a deleted topic
+	TopicDeregistered
+
+	// HandlerRegistered is the change kind of a new or re-registered handler
+	HandlerRegistered
+
+	// HandlerDeregistered is the change kind of a deleted handler
+	HandlerDeregistered
+)
+
+// String returns the system event name of the change kind
+func (k ChangeKind) String() string {
+	switch k {
+	case TopicRegistered:
+		return "bus.topic.registered"
+	case TopicDeregistered:
+		return "bus.topic.deregistered"
+	case HandlerRegistered:
+		return "bus.handler.registered"
+	case HandlerDeregistered:
+		return "bus.handler.deregistered"
+	}
+	return "bus.unknown"
+}
+
+// RegisterHook re/registers the hook called after each topic and handler
+// registration change; hooks run synchronously on the caller goroutine
+// after the registry lock is released, so they can call the bus
+func (b *Bus) RegisterHook(key string, fn func(c Change)) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	// copy on write, changes are notified to a snapshot of the hooks
+	hooks := make([]hook, 0, len(b.hooks)+1)
+	for _, h := range b.hooks {
+		if h.key != key {
+			hooks = append(hooks, h)
+		}
+	}
+	b.hooks = append(hooks, hook{key: key, notify: fn})
+}
+
+// DeregisterHook deletes the hook
+func (b *Bus) DeregisterHook(key string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	hooks := make([]hook, 0, len(b.hooks))
+	for _, h := range b.hooks {
+		if h.key != key {
+			hooks = append(hooks, h)
+		}
+	}
+	b.hooks = hooks
+}
+
+func notifyHooks(hooks []hook, changes ...Change) {
+	for _, c := range changes {
+		for _, h := range hooks {
+			h.notify(c)
+		}
+	}
+}
+
+func topicSubscriptions(topic string, handlers []Handler) []Subscription {
+	subscriptions := make([]Subscription, len(handlers))
+	for i, h := range handlers {
+		subscriptions[i] = Subscription{Topic: topic, HandlerKey: h.key}
+	}
+	sortSubscriptions(subscriptions)
+	return subscriptions
+}
+
+// handlerSubscriptionDiff returns the handler subscriptions of the topics
+// which are not in the excluded topics
+func handlerSubscriptionDiff(handlerKey string, topics, excluded []string) []Subscription {
+	skip := make(map[string]struct{}, len(excluded))
+	for _, t := range excluded {
+		skip[t] = struct{}{}
+	}
+
+	subscriptions := make([]Subscription, 0, len(topics))
+	for _, t := range topics {
+		if _, ok := skip[t]; !ok {
+			subscriptions = append(subscriptions, Subscription{Topic: t, HandlerKey: handlerKey})
+		}
+	}
+	sortSubscriptions(subscriptions)
+	return subscriptions
+}
+
+func sortSubscriptions(subscriptions []Subscription) {
+	sort.Slice(subscriptions, func(i, j int) bool {
+		if subscriptions[i].Topic != subscriptions[j].Topic {
+			return subscriptions[i].Topic < subscriptions[j].Topic
+		}
+		return subscriptions[i].HandlerKey < subscriptions[j].HandlerKey
+	})
+}
@@ -0,0 +1,129 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package bus_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mustafaturan/bus/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegisterHook(t *testing.T) {
+	b := setup(topicUserCreated)
+	defer tearDown(b, topicUserCreated)
+
+	var changes []bus.Change
+	b.RegisterHook("test.hook", func(c bus.Change) { changes = append(changes, c) })
+	defer b.DeregisterHook("test.hook")
+
+	t.Run("on handler register", func(t *testing.T) {
+		changes = nil
+		b.RegisterHandler("test.handler", fakeHandler(".*created$"))
+
+		want := []bus.Change{{
+			Kind:       bus.HandlerRegistered,
+			HandlerKey: "test.handler",
+			Added:      []bus.Subscription{{Topic: topicUserCreated, HandlerKey: "test.handler"}},
+			Removed:    []bus.Subscription{},
+		}}
+		assert.Equal(t, want, changes)
+	})
+
+	t.Run("on topic register", func(t *testing.T) {
+		changes = nil
+		b.RegisterTopics(topicCommentCreated, topicCommentDeleted, topicUserCreated)
+
+		want := []bus.Change{
+			{
+				Kind:  bus.TopicRegistered,
+				Topic: topicCommentCreated,
+				Added: []bus.Subscription{{Topic: topicCommentCreated, HandlerKey: "test.handler"}},
+			},
+			{
+				Kind:  bus.TopicRegistered,
+				Topic: topicCommentDeleted,
+				Added: []bus.Subscription{},
+			},
+		}
+		assert.Equal(t, want, changes)
+	})
+
+	t.Run("on handler re-register", func(t *testing.T) {
+		changes = nil
+		b.RegisterHandler("test.handler", fakeHandler("^comment"))
+
+		require.Len(t, changes, 1)
+		assert.Equal(t, []bus.Subscription{
+			{Topic: topicCommentDeleted, HandlerKey: "test.handler"},
+		}, changes[0].Added)
+		assert.Equal(t, []bus.Subscription{
+			{Topic: topicUserCreated, HandlerKey: "test.handler"},
+		}, changes[0].Removed)
+	})
+
+	t.Run("on topic deregister", func(t *testing.T) {
+		changes = nil
+		b.DeregisterTopics(topicCommentDeleted, topicUserUpdated)
+
+		want := []bus.Change{{
+			Kind:    bus.TopicDeregistered,
+			Topic:   topicCommentDeleted,
+			Removed: []bus.Subscription{{Topic: topicCommentDeleted, HandlerKey: "test.handler"}},
+		}}
+		assert.Equal(t, want, changes)
+	})
+
+	t.Run("on handler deregister", func(t *testing.T) {
+		changes = nil
+		b.DeregisterHandler("test.handler")
+		b.DeregisterHandler("test.handler")
+
+		want := []bus.Change{{
+			Kind:       bus.HandlerDeregistered,
+			HandlerKey: "test.handler",
+			Removed:    []bus.Subscription{{Topic: topicCommentCreated, HandlerKey: "test.handler"}},
+		}}
+		assert.Equal(t, want, changes)
+	})
+
+	t.Run("after hook deregister", func(t *testing.T) {
+		changes = nil
+		b.DeregisterHook("test.hook")
+		b.RegisterTopics(topicUserDeleted)
+		assert.Empty(t, changes)
+	})
+}
+
+func TestHookCallsBus(t *testing.T) {
+	var fn bus.Next = func() string { return "fakeid" }
+	b, err := bus.NewBus(fn, bus.WithAutoRegister(".*"))
+	require.Nil(t, err)
+
+	var unsubscribed []string
+	b.RegisterHook("test.hook", func(c bus.Change) {
+		if c.Kind == bus.TopicRegistered && len(b.TopicHandlerKeys(c.Topic)) == 0 {
+			unsubscribed = append(unsubscribed, c.Topic)
+		}
+	})
+
+	require.Nil(t, b.Emit(context.Background(), topicUserCreated, "data"))
+	assert.Equal(t, []string{topicUserCreated}, unsubscribed)
+}
+
+func TestChangeKindString(t *testing.T) {
+	tests := map[bus.ChangeKind]string{
+		bus.TopicRegistered:     "bus.topic.registered",
+		bus.TopicDeregistered:   "bus.topic.deregistered",
+		bus.HandlerRegistered:   "bus.handler.registered",
+		bus.HandlerDeregistered: "bus.handler.deregistered",
+		bus.ChangeKind(0):       "bus.unknown",
+	}
+	for kind, want := range tests {
+		assert.Equal(t, want, kind.String())
+	}
+}
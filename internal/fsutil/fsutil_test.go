@@ -0,0 +1,33 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package fsutil_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/mustafaturan/bus/v3/internal/fsutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "offsets.json")
+
+	require.Nil(t, fsutil.WriteFile(path, []byte("1"), 0o644))
+	require.Nil(t, fsutil.WriteFile(path, []byte("2"), 0o644))
+
+	data, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	assert.Equal(t, "2", string(data))
+	assert.NoFileExists(t, path+".tmp")
+
+	t.Run("with missing dir", func(t *testing.T) {
+		err := fsutil.WriteFile(filepath.Join(dir, "missing", "offsets.json"), nil, 0o644)
+		assert.NotNil(t, err)
+	})
+}
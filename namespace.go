@@ -0,0 +1,136 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package bus
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// WithForward returns an option to forward the events of the namespace bus
+// topics matching the allowlist regex pattern to its parent bus; the events
+// of the other topics stay in the namespace bus
+//
+// The option is only valid for the buses created by Namespace.
+func WithForward(allowlist string) Option {
+	return func(b *Bus) error {
+		re, err := regexp.Compile(allowlist)
+		if err != nil {
+			return fmt.Errorf("bus: forward allowlist(%s) is invalid: %w", allowlist, err)
+		}
+		b.forward = re
+		return nil
+	}
+}
+
+// Namespace returns a new child bus with its own topics and handlers sharing
+// the id generator, the clock, the warn func and the authorizer of the bus;
+// the options can't replace the authorizer
+//
+// The events of the child topics allowed by the WithForward option are
+// forwarded to the bus after the child handlers, with the topic names
+// prefixed by `<prefix>.`, so the handlers of the bus can observe them. The
+// forwarded topics are registered on the bus on first use. Closing the bus
+// closes its children.
+func (b *Bus) Namespace(prefix string, opts ...Option) (*Bus, error) {
+	if prefix == empty || strings.HasSuffix(prefix, ".") {
+		return nil, fmt.Errorf("bus: namespace prefix(%s) is invalid", prefix)
+	}
+
+	b.mutex.RLock()
+	opts = append([]Option{withParent(b, prefix), WithClock(b.clock), WithWarnFunc(b.warn)}, opts...)
+	// applied last, so the options can't replace the inherited authorizer
+	if b.auth != nil {
+		opts = append(opts, WithAuthorizer(b.auth))
+	}
+	idgen := b.idgen
+	b.mutex.RUnlock()
+
+	child, err := NewBus(idgen, opts...)
+	if err != nil {
+		return nil, err
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.closed {
+		return nil, ErrClosed
+	}
+	if _, ok := b.children[prefix]; ok {
+		return nil, fmt.Errorf("bus: namespace(%s) already exists", prefix)
+	}
+	b.children[prefix] = child
+	return child, nil
+}
+
+// withParent returns an option to set the parent of a namespace bus
+func withParent(parent *Bus, prefix string) Option {
+	return func(b *Bus) error {
+		b.parent, b.prefix = parent, prefix+"."
+		return nil
+	}
+}
+
+// Namespaces returns the prefixes of the child buses
+func (b *Bus) Namespaces() []string {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	prefixes := make([]string, 0, len(b.children))
+	for p := range b.children {
+		prefixes = append(prefixes, p)
+	}
+	sort.Strings(prefixes)
+	return prefixes
+}
+
+// namespaces returns the child buses in prefix order
+func (b *Bus) namespaces() []*Bus {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	children := make([]*Bus, 0, len(b.children))
+	for _, c := range b.children {
+		children = append(children, c)
+	}
+	sort.Slice(children, func(i, j int) bool { return children[i].prefix < children[j].prefix })
+	return children
+}
+
+// receive publishes an event forwarded by a child bus authorizing it and
+// applying the topic options of the bus like EmitWithOpts
+func (b *Bus) receive(ctx context.Context, e Event) error {
+	b.mutex.RLock()
+	t, ok := b.targetLocked(e.Topic)
+	closed := b.closed
+	b.mutex.RUnlock()
+
+	if closed {
+		return ErrClosed
+	}
+	if b.auth != nil {
+		if err := b.authorizeEmit(ctx, e); err != nil {
+			return err
+		}
+	}
+	if !ok {
+		t = b.registerTarget(e.Topic)
+	}
+
+	e, err := t.upcasters.upcast(e)
+	if err != nil {
+		return err
+	}
+	if err := b.checkPayload(ctx, t.descriptor, e.Topic, e.Data, e.IsTombstone()); err != nil {
+		return err
+	}
+	if e.Key == empty && e.Data != nil && t.descriptor.KeyFunc != nil {
+		e.Key = t.descriptor.KeyFunc(e)
+	}
+	return b.publish(ctx, t, e)
+}
@@ -0,0 +1,175 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package bus_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/mustafaturan/bus/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNamespace(t *testing.T) {
+	b := setup()
+
+	t.Run("with invalid prefix", func(t *testing.T) {
+		_, err := b.Namespace("")
+		assert.EqualError(t, err, "bus: namespace prefix() is invalid")
+
+		_, err = b.Namespace("orders.")
+		assert.EqualError(t, err, "bus: namespace prefix(orders.) is invalid")
+	})
+
+	t.Run("with invalid forward allowlist", func(t *testing.T) {
+		_, err := b.Namespace("orders", bus.WithForward("["))
+		assert.EqualError(t, err, "bus: forward allowlist([) is invalid: error parsing regexp: missing closing ]: `[`")
+	})
+
+	t.Run("with forward on a root bus", func(t *testing.T) {
+		_, err := bus.NewBus(bus.Next(func() string { return "fakeid" }), bus.WithForward(".*"))
+		assert.EqualError(t, err, "bus: forward is only allowed for namespace buses")
+	})
+
+	t.Run("with existing prefix", func(t *testing.T) {
+		_, err := b.Namespace("orders")
+		require.Nil(t, err)
+		_, err = b.Namespace("orders")
+		assert.EqualError(t, err, "bus: namespace(orders) already exists")
+		assert.Equal(t, []string{"orders"}, b.Namespaces())
+	})
+
+	t.Run("with closed bus", func(t *testing.T) {
+		b := setup()
+		require.Nil(t, b.Close(context.Background()))
+		_, err := b.Namespace("orders")
+		assert.Equal(t, bus.ErrClosed, err)
+	})
+}
+
+func TestNamespaceForward(t *testing.T) {
+	var n int
+	b, err := bus.NewBus(bus.Next(func() string {
+		n++
+		return fmt.Sprint(n)
+	}))
+	require.Nil(t, err)
+
+	orders, err := b.Namespace("orders", bus.WithForward(`^(created|payments\.)`))
+	require.Nil(t, err)
+	orders.RegisterTopics("created", "internal")
+
+	payments, err := orders.Namespace("payments", bus.WithForward("^charged$"))
+	require.Nil(t, err)
+	payments.RegisterTopics("charged")
+
+	var parent, child []bus.Event
+	b.RegisterHandler("audit", bus.Handler{
+		Handle:  func(_ context.Context, e bus.Event) { parent = append(parent, e) },
+		Matcher: ".*",
+	})
+	orders.RegisterHandler("audit", bus.Handler{
+		Handle:  func(_ context.Context, e bus.Event) { child = append(child, e) },
+		Matcher: ".*",
+	})
+
+	ctx := context.Background()
+
+	t.Run("keeps the registries apart", func(t *testing.T) {
+		assert.Empty(t, b.Topics())
+		assert.Equal(t, []string{"audit"}, orders.HandlerKeys())
+		assert.ElementsMatch(t, []string{"created", "internal"}, orders.Topics())
+	})
+
+	t.Run("forwards the allowed topics with prefix", func(t *testing.T) {
+		require.Nil(t, orders.EmitWithOpts(ctx, "created", "order", bus.WithTxID("tx")))
+		require.Nil(t, orders.Emit(ctx, "internal", "secret"))
+
+		require.Len(t, child, 2)
+		require.Len(t, parent, 1)
+		assert.Equal(t, "created", child[0].Topic)
+		assert.Equal(t, "orders.created", parent[0].Topic)
+		assert.Equal(t, child[0].ID, parent[0].ID)
+		assert.Equal(t, "tx", parent[0].TxID)
+		assert.Equal(t, "order", parent[0].Data)
+		assert.Equal(t, []string{"orders.created"}, b.Topics())
+	})
+
+	t.Run("shares the id generator", func(t *testing.T) {
+		require.Nil(t, b.EmitWithOpts(ctx, "orders.created", "direct", bus.WithTxID("tx")))
+		require.Nil(t, orders.EmitWithOpts(ctx, "internal", "secret", bus.WithTxID("tx")))
+		assert.Equal(t, "4", parent[len(parent)-1].ID)
+		assert.Equal(t, "5", child[len(child)-1].ID)
+	})
+
+	t.Run("forwards through the nested namespaces", func(t *testing.T) {
+		child, parent = nil, nil
+		require.Nil(t, payments.Emit(ctx, "charged", 10))
+
+		require.Len(t, child, 1)
+		require.Len(t, parent, 1)
+		assert.Equal(t, "payments.charged", child[0].Topic)
+		assert.Equal(t, "orders.payments.charged", parent[0].Topic)
+	})
+
+	t.Run("with failing forward", func(t *testing.T) {
+		b.RegisterTopicWithOpts("orders.created", bus.WithRateLimit(bus.RateLimit{Rate: 0.001, Burst: 1, Policy: bus.ThrottleDrop}))
+		require.Nil(t, orders.Emit(ctx, "created", "first"))
+
+		err := orders.Emit(ctx, "created", "second")
+		assert.EqualError(t, err, "bus: topic(created) forward failed: bus: topic(orders.created) dropped: rate limit exceeded")
+	})
+}
+
+func TestNamespaceForwardTopicOptions(t *testing.T) {
+	b := setup()
+	orders, err := b.Namespace("orders", bus.WithForward(".*"))
+	require.Nil(t, err)
+	orders.RegisterTopics("created")
+
+	b.RegisterTopicWithOpts("orders.created",
+		bus.WithPayloadType(fakeUserV1{}),
+		bus.WithKeyFunc(func(e bus.Event) string { return e.Data.(fakeUserV1).Name }),
+	)
+	var parent []bus.Event
+	b.RegisterHandler("audit", bus.Handler{
+		Handle:  func(_ context.Context, e bus.Event) { parent = append(parent, e) },
+		Matcher: ".*",
+	})
+
+	ctx := context.Background()
+	require.Nil(t, orders.Emit(ctx, "created", fakeUserV1{Name: "a"}))
+	require.Len(t, parent, 1)
+	assert.Equal(t, "a", parent[0].Key)
+
+	err = orders.Emit(ctx, "created", "invalid")
+	assert.EqualError(t, err, "bus: topic(created) forward failed: bus: topic(orders.created) payload type(string) does not match type(bus_test.fakeUserV1)")
+	assert.Len(t, parent, 1)
+}
+
+func TestNamespaceClose(t *testing.T) {
+	b := setup()
+	orders, err := b.Namespace("orders", bus.WithForward(".*"))
+	require.Nil(t, err)
+	orders.RegisterTopics("created")
+
+	var flushed []string
+	b.RegisterHandler("parent", bus.Handler{
+		Handle:  func(context.Context, bus.Event) {},
+		Matcher: ".*",
+		Flush:   func(context.Context) { flushed = append(flushed, "parent") },
+	})
+	orders.RegisterHandler("child", bus.Handler{
+		Handle:  func(context.Context, bus.Event) {},
+		Matcher: ".*",
+		Flush:   func(context.Context) { flushed = append(flushed, "child") },
+	})
+
+	require.Nil(t, b.Close(context.Background()))
+	assert.Equal(t, []string{"child", "parent"}, flushed)
+	assert.Equal(t, bus.ErrClosed, orders.Emit(context.Background(), "created", "late"))
+}
@@ -0,0 +1,272 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package bus
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultPartitionQueueSize is the default queue size of a partition worker
+const DefaultPartitionQueueSize = 128
+
+type (
+	// PartitionConfig holds the partitioning options
+	PartitionConfig struct {
+		Workers   int      // number of partition workers running in parallel
+		Key       KeyFunc  // maps the event to its partition, i.e. an order id
+		QueueSize int      // queue size per worker, defaults to 128
+		Warn      WarnFunc // receives the events dropped on done ctx, optional
+	}
+
+	// Partitioner is a handler adapter processing the events of a key in
+	// order and the events of different keys in parallel
+	//
+	// The keys are hashed to the workers, each worker handles its events one
+	// at a time in arrival order. Handle blocks while the worker queue is full
+	// and drops the event when the emit ctx is done.
+	Partitioner struct {
+		dropped uint64
+
+		config PartitionConfig
+		handle func(ctx context.Context, e Event)
+		queues []chan partitioned
+		wg     sync.WaitGroup
+
+		mutex  sync.RWMutex // guards closed against sends on closed queues
+		closed bool
+
+		acks partitionAcks
+	}
+
+	partitioned struct {
+		ctx     context.Context
+		e       Event
+		ack     *partitionAck
+		barrier chan struct{} // flush marker, closed when the worker reaches it
+	}
+
+	// partitionAcks commits the handled events of a durable handler in their
+	// queue order, so a commit never covers an event still waiting in
+	// another partition
+	partitionAcks struct {
+		mutex   sync.Mutex
+		pending []*partitionAck
+	}
+
+	partitionAck struct {
+		ctx    context.Context
+		e      Event
+		commit func(ctx context.Context, e Event)
+		done   bool
+	}
+)
+
+// NewPartitioner inits a new partitioner and starts its workers
+func NewPartitioner(c PartitionConfig, fn func(ctx context.Context, e Event)) (*Partitioner, error) {
+	if fn == nil {
+		return nil, fmt.Errorf("bus: partition handler func can't be nil")
+	}
+	if c.Key == nil {
+		return nil, fmt.Errorf("bus: partition key func can't be nil")
+	}
+	if c.Workers < 1 {
+		return nil, fmt.Errorf("bus: partition workers(%d) must be positive", c.Workers)
+	}
+	if c.QueueSize < 1 {
+		c.QueueSize = DefaultPartitionQueueSize
+	}
+
+	p := &Partitioner{config: c, handle: fn, queues: make([]chan partitioned, c.Workers)}
+	for i := range p.queues {
+		p.queues[i] = make(chan partitioned, c.QueueSize)
+		p.wg.Add(1)
+		go p.work(p.queues[i])
+	}
+	return p, nil
+}
+
+// Handler returns a bus handler for the matcher delivering the events to the
+// partitioner and closing it on bus close; the offsets of a durable handler
+// are committed after the workers handle the events
+func (p *Partitioner) Handler(matcher string) Handler {
+	return Handler{Handle: p.Handle, Queue: p.queue, Flush: p.Close, Matcher: matcher}
+}
+
+// Handle queues the event to the worker of its partition; the events are
+// handled on the caller goroutine once the partitioner is closed
+func (p *Partitioner) Handle(ctx context.Context, e Event) {
+	p.queue(ctx, e, nil)
+}
+
+// Dropped returns the number of events dropped on done ctx
+func (p *Partitioner) Dropped() uint64 {
+	return atomic.LoadUint64(&p.dropped)
+}
+
+// queue queues the event with the commit func to call after it is handled,
+// commit is nil for the handlers without offsets
+func (p *Partitioner) queue(ctx context.Context, e Event, commit func(ctx context.Context, e Event)) {
+	p.mutex.RLock()
+	if p.closed {
+		p.mutex.RUnlock()
+		p.handle(ctx, e)
+		if commit != nil {
+			commit(ctx, e)
+		}
+		return
+	}
+	defer p.mutex.RUnlock()
+
+	item := partitioned{ctx: ctx, e: e}
+	if commit != nil {
+		item.ack = p.acks.add(ctx, e, commit)
+	}
+
+	select {
+	case p.queues[p.partition(e)] <- item:
+	case <-ctx.Done():
+		atomic.AddUint64(&p.dropped, 1)
+		if item.ack != nil {
+			p.acks.remove(item.ack)
+		}
+		if p.config.Warn != nil {
+			p.config.Warn(ctx, e.Topic, fmt.Sprintf("partitioned event(%s) dropped: %s", e.ID, ctx.Err()))
+		}
+	}
+}
+
+// Pending returns the number of queued events
+func (p *Partitioner) Pending() int {
+	var n int
+	for _, q := range p.queues {
+		n += len(q)
+	}
+	return n
+}
+
+// Flush waits until the events queued before the call are handled or the ctx
+// is done
+func (p *Partitioner) Flush(ctx context.Context) {
+	p.mutex.RLock()
+	if p.closed {
+		p.mutex.RUnlock()
+		return
+	}
+
+	barriers := make([]chan struct{}, 0, len(p.queues))
+	for _, q := range p.queues {
+		barrier := make(chan struct{})
+		select {
+		case q <- partitioned{barrier: barrier}:
+			barriers = append(barriers, barrier)
+		case <-ctx.Done():
+		}
+	}
+	p.mutex.RUnlock()
+
+	for _, barrier := range barriers {
+		select {
+		case <-barrier:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Close stops the workers after the queued events are handled; it waits
+// until the workers stop or the ctx is done
+func (p *Partitioner) Close(ctx context.Context) {
+	p.mutex.Lock()
+	if !p.closed {
+		p.closed = true
+		for _, q := range p.queues {
+			close(q)
+		}
+	}
+	p.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+func (p *Partitioner) partition(e Event) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(p.config.Key(e)))
+	return int(h.Sum32() % uint32(len(p.queues)))
+}
+
+func (p *Partitioner) work(q chan partitioned) {
+	defer p.wg.Done()
+
+	for item := range q {
+		if item.barrier != nil {
+			close(item.barrier)
+			continue
+		}
+		p.handle(item.ctx, item.e)
+		if item.ack != nil {
+			p.acks.done(item.ack)
+		}
+	}
+}
+
+func (a *partitionAcks) add(ctx context.Context, e Event, commit func(ctx context.Context, e Event)) *partitionAck {
+	ack := &partitionAck{ctx: ctx, e: e, commit: commit}
+
+	a.mutex.Lock()
+	a.pending = append(a.pending, ack)
+	a.mutex.Unlock()
+	return ack
+}
+
+// remove forgets the ack of a dropped event
+func (a *partitionAcks) remove(ack *partitionAck) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for i, pending := range a.pending {
+		if pending == ack {
+			a.pending = append(a.pending[:i], a.pending[i+1:]...)
+			break
+		}
+	}
+	a.commitLocked()
+}
+
+// done marks the event handled and commits the handled events at the head of
+// the queue order
+func (a *partitionAcks) done(ack *partitionAck) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	ack.done = true
+	a.commitLocked()
+}
+
+// commitLocked commits the last one of the handled events queued before all
+// pending events; the lock keeps the commits in order
+func (a *partitionAcks) commitLocked() {
+	var last *partitionAck
+	for len(a.pending) > 0 && a.pending[0].done {
+		last = a.pending[0]
+		a.pending[0] = nil
+		a.pending = a.pending[1:]
+	}
+	if last != nil {
+		last.commit(last.ctx, last.e)
+	}
+}
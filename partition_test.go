@@ -0,0 +1,195 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package bus_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mustafaturan/bus/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewPartitioner(t *testing.T) {
+	r := &fakeRecorder{}
+
+	t.Run("with nil func", func(t *testing.T) {
+		_, err := bus.NewPartitioner(bus.PartitionConfig{Workers: 1, Key: txIDKey}, nil)
+		assert.EqualError(t, err, "bus: partition handler func can't be nil")
+	})
+
+	t.Run("with nil key func", func(t *testing.T) {
+		_, err := bus.NewPartitioner(bus.PartitionConfig{Workers: 1}, r.record)
+		assert.EqualError(t, err, "bus: partition key func can't be nil")
+	})
+
+	t.Run("without workers", func(t *testing.T) {
+		_, err := bus.NewPartitioner(bus.PartitionConfig{Key: txIDKey}, r.record)
+		assert.EqualError(t, err, "bus: partition workers(0) must be positive")
+	})
+}
+
+func TestPartitioner(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("keeps the order per key", func(t *testing.T) {
+		var mutex sync.Mutex
+		received := make(map[string][]int)
+		p, err := bus.NewPartitioner(bus.PartitionConfig{Workers: 4, Key: txIDKey, QueueSize: 2},
+			func(_ context.Context, e bus.Event) {
+				mutex.Lock()
+				defer mutex.Unlock()
+				received[e.TxID] = append(received[e.TxID], e.Data.(int))
+			},
+		)
+		require.Nil(t, err)
+		defer p.Close(ctx)
+
+		want := make(map[string][]int)
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("order-%d", i%7)
+			want[key] = append(want[key], i)
+			p.Handle(ctx, bus.Event{TxID: key, Data: i})
+		}
+		p.Flush(ctx)
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		assert.Equal(t, want, received)
+		assert.Equal(t, 0, p.Pending())
+	})
+
+	t.Run("runs the partitions in parallel", func(t *testing.T) {
+		block := make(chan struct{})
+		r := &fakeRecorder{}
+		p, err := bus.NewPartitioner(bus.PartitionConfig{Workers: 2, Key: txIDKey},
+			func(ctx context.Context, e bus.Event) {
+				if e.TxID == "blocked" {
+					<-block
+				}
+				r.record(ctx, e)
+			},
+		)
+		require.Nil(t, err)
+		defer p.Close(ctx)
+
+		p.Handle(ctx, bus.Event{TxID: "blocked", Data: "blocked"})
+		for i := 0; i < 10; i++ {
+			p.Handle(ctx, bus.Event{TxID: fmt.Sprintf("key-%d", i), Data: i})
+		}
+
+		require.Eventually(t, func() bool { return len(r.received()) > 0 }, time.Second, time.Millisecond)
+		assert.NotContains(t, r.received(), "blocked")
+
+		close(block)
+		p.Flush(ctx)
+		assert.Len(t, r.received(), 11)
+	})
+
+	t.Run("drops on done ctx", func(t *testing.T) {
+		block := make(chan struct{})
+		r := &fakeRecorder{}
+		var warnings []string
+		warn := func(_ context.Context, _, msg string) { warnings = append(warnings, msg) }
+		p, err := bus.NewPartitioner(bus.PartitionConfig{Workers: 1, Key: txIDKey, QueueSize: 1, Warn: warn},
+			func(ctx context.Context, e bus.Event) {
+				<-block
+				r.record(ctx, e)
+			},
+		)
+		require.Nil(t, err)
+
+		p.Handle(ctx, bus.Event{Data: 1})
+		require.Eventually(t, func() bool { return p.Pending() == 0 }, time.Second, time.Millisecond)
+		p.Handle(ctx, bus.Event{Data: 2})
+
+		cctx, cancel := context.WithCancel(ctx)
+		cancel()
+		p.Handle(cctx, bus.Event{ID: "3", Data: 3})
+		p.Flush(cctx)
+
+		close(block)
+		p.Close(ctx)
+		assert.Equal(t, []interface{}{1, 2}, r.received())
+		assert.Equal(t, uint64(1), p.Dropped())
+		assert.Equal(t, []string{"partitioned event(3) dropped: context canceled"}, warnings)
+	})
+
+	t.Run("handles on the caller after close", func(t *testing.T) {
+		r := &fakeRecorder{}
+		p, err := bus.NewPartitioner(bus.PartitionConfig{Workers: 1, Key: txIDKey}, r.record)
+		require.Nil(t, err)
+
+		p.Close(ctx)
+		p.Close(ctx)
+		p.Flush(ctx)
+		p.Handle(ctx, bus.Event{Data: 1})
+		assert.Equal(t, []interface{}{1}, r.received())
+	})
+}
+
+func TestPartitionerHandler(t *testing.T) {
+	b := setup(topicCommentCreated)
+
+	r := &fakeRecorder{}
+	p, err := bus.NewPartitioner(bus.PartitionConfig{Workers: 2, Key: txIDKey}, r.record)
+	require.Nil(t, err)
+	b.RegisterHandler("test.partitioner", p.Handler(".*"))
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		require.Nil(t, b.EmitWithOpts(ctx, topicCommentCreated, i, bus.WithTxID("a")))
+	}
+
+	require.Nil(t, b.Close(ctx))
+	assert.Equal(t, []interface{}{0, 1, 2}, r.received())
+}
+
+func TestPartitionerDurableHandler(t *testing.T) {
+	s := openFileStore(t, t.TempDir())
+	defer s.Close()
+	b := setupStore(t, s, nil)
+
+	blocks := map[string]chan struct{}{"a": make(chan struct{}), "b": make(chan struct{})}
+	r := &fakeRecorder{}
+	p, err := bus.NewPartitioner(bus.PartitionConfig{Workers: 2, Key: txIDKey}, func(ctx context.Context, e bus.Event) {
+		<-blocks[e.TxID]
+		r.record(ctx, e)
+	})
+	require.Nil(t, err)
+	defer p.Close(context.Background())
+
+	h := p.Handler(".*")
+	h.Commit = bus.CommitAuto
+	b.RegisterHandler("test.partitioner", h)
+
+	ctx := context.Background()
+	offset := func() uint64 {
+		offset, err := b.HandlerOffset("test.partitioner")
+		require.Nil(t, err)
+		return offset
+	}
+
+	// keys a and b are hashed to different workers
+	require.Nil(t, b.EmitWithOpts(ctx, topicCommentCreated, fakeOrder{ID: "1"}, bus.WithTxID("a")))
+	require.Nil(t, b.EmitWithOpts(ctx, topicCommentCreated, fakeOrder{ID: "2"}, bus.WithTxID("b")))
+	assert.Equal(t, uint64(0), offset())
+
+	t.Run("waits for the events queued before", func(t *testing.T) {
+		close(blocks["b"])
+		require.Eventually(t, func() bool { return len(r.received()) == 1 }, time.Second, time.Millisecond)
+		assert.Equal(t, uint64(0), offset())
+	})
+
+	t.Run("commits after the events are handled", func(t *testing.T) {
+		close(blocks["a"])
+		p.Flush(ctx)
+		assert.Equal(t, uint64(2), offset())
+	})
+}
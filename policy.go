@@ -0,0 +1,126 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package bus
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+)
+
+type (
+	// PolicyRule grants the principals and the sources matching its patterns
+	// the permissions for the topics matching its topic patterns
+	PolicyRule struct {
+		Principal string   // principals as regex pattern, empty for any
+		Source    string   // event sources as regex pattern, empty for any
+		Emit      []string // topics allowed to emit as regex patterns
+		Subscribe []string // topics allowed to subscribe as regex patterns
+	}
+
+	// Policy is an Authorizer granting the permissions by the rules; the
+	// emits and the subscriptions not granted by any rule are denied
+	//
+	// The source patterns only apply to the emits.
+	Policy struct {
+		rules []policyRule
+	}
+
+	policyRule struct {
+		principal *regexp.Regexp
+		source    *regexp.Regexp
+		emit      []*regexp.Regexp
+		subscribe []*regexp.Regexp
+	}
+)
+
+// NewPolicy inits a policy with the rules
+func NewPolicy(rules ...PolicyRule) (*Policy, error) {
+	p := &Policy{rules: make([]policyRule, len(rules))}
+	for i, r := range rules {
+		var err error
+		if p.rules[i].principal, err = compilePolicyPattern(i, "principal", r.Principal); err != nil {
+			return nil, err
+		}
+		if p.rules[i].source, err = compilePolicyPattern(i, "source", r.Source); err != nil {
+			return nil, err
+		}
+		if p.rules[i].emit, err = compilePolicyPatterns(i, "emit", r.Emit); err != nil {
+			return nil, err
+		}
+		if p.rules[i].subscribe, err = compilePolicyPatterns(i, "subscribe", r.Subscribe); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// AuthorizeEmit allows the emit when a rule of the principal and the source
+// grants the topic
+func (p *Policy) AuthorizeEmit(_ context.Context, r EmitRequest) error {
+	for _, rule := range p.rules {
+		if matchPolicy(rule.principal, r.Principal) && matchPolicy(rule.source, r.Source) && matchAnyPolicy(rule.emit, r.Topic) {
+			return nil
+		}
+	}
+	return fmt.Errorf("principal(%s) with source(%s) is not granted", r.Principal, r.Source)
+}
+
+// AuthorizeSubscribe allows the subscriptions when each topic is granted by a
+// rule of the principal
+func (p *Policy) AuthorizeSubscribe(_ context.Context, r SubscribeRequest) error {
+	for _, topic := range r.Topics {
+		if !p.subscribes(r.Principal, topic) {
+			return fmt.Errorf("principal(%s) is not granted topic(%s)", r.Principal, topic)
+		}
+	}
+	return nil
+}
+
+func (p *Policy) subscribes(principal, topic string) bool {
+	for _, rule := range p.rules {
+		if matchPolicy(rule.principal, principal) && matchAnyPolicy(rule.subscribe, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+func compilePolicyPattern(i int, field, pattern string) (*regexp.Regexp, error) {
+	if pattern == empty {
+		return nil, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("bus: policy rule(%d) %s(%s) is invalid: %w", i, field, pattern, err)
+	}
+	return re, nil
+}
+
+func compilePolicyPatterns(i int, field string, patterns []string) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, len(patterns))
+	for j, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("bus: policy rule(%d) %s(%s) is invalid: %w", i, field, pattern, err)
+		}
+		res[j] = re
+	}
+	return res, nil
+}
+
+// matchPolicy matches the value by the optional pattern
+func matchPolicy(re *regexp.Regexp, v string) bool {
+	return re == nil || re.MatchString(v)
+}
+
+func matchAnyPolicy(res []*regexp.Regexp, v string) bool {
+	for _, re := range res {
+		if re.MatchString(v) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,161 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package bus_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/mustafaturan/bus/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewPolicy(t *testing.T) {
+	tests := []struct {
+		rule bus.PolicyRule
+		err  string
+	}{
+		{
+			rule: bus.PolicyRule{Principal: "["},
+			err:  "bus: policy rule(0) principal([) is invalid: error parsing regexp: missing closing ]: `[`",
+		},
+		{
+			rule: bus.PolicyRule{Source: "["},
+			err:  "bus: policy rule(0) source([) is invalid: error parsing regexp: missing closing ]: `[`",
+		},
+		{
+			rule: bus.PolicyRule{Emit: []string{".*", "["}},
+			err:  "bus: policy rule(0) emit([) is invalid: error parsing regexp: missing closing ]: `[`",
+		},
+		{
+			rule: bus.PolicyRule{Subscribe: []string{"["}},
+			err:  "bus: policy rule(0) subscribe([) is invalid: error parsing regexp: missing closing ]: `[`",
+		},
+	}
+
+	for _, tt := range tests {
+		_, err := bus.NewPolicy(tt.rule)
+		assert.EqualError(t, err, tt.err)
+	}
+}
+
+func TestPolicyAuthorizeEmit(t *testing.T) {
+	p := setupPolicy(t)
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		r    bus.EmitRequest
+		err  string
+	}{
+		{
+			name: "granted topic",
+			r:    bus.EmitRequest{Principal: "plugin.comments", Topic: topicCommentCreated},
+		},
+		{
+			name: "granted topic of the source",
+			r:    bus.EmitRequest{Principal: "plugin.users", Source: "/users", Topic: topicUserCreated},
+		},
+		{
+			name: "any principal",
+			r:    bus.EmitRequest{Topic: "audit.logged"},
+		},
+		{
+			name: "not granted topic",
+			r:    bus.EmitRequest{Principal: "plugin.comments", Topic: topicUserCreated},
+			err:  "principal(plugin.comments) with source() is not granted",
+		},
+		{
+			name: "not granted source",
+			r:    bus.EmitRequest{Principal: "plugin.users", Source: "/comments", Topic: topicUserCreated},
+			err:  "principal(plugin.users) with source(/comments) is not granted",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := p.AuthorizeEmit(ctx, tt.r)
+			if tt.err == "" {
+				assert.Nil(t, err)
+				return
+			}
+			assert.EqualError(t, err, tt.err)
+		})
+	}
+}
+
+func TestPolicyAuthorizeSubscribe(t *testing.T) {
+	p := setupPolicy(t)
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		r    bus.SubscribeRequest
+		err  string
+	}{
+		{
+			name: "granted topics",
+			r:    bus.SubscribeRequest{Principal: "plugin.comments", Topics: []string{topicCommentCreated, topicUserCreated}},
+		},
+		{
+			name: "without topics",
+			r:    bus.SubscribeRequest{Principal: "plugin.users", Matcher: ".*"},
+		},
+		{
+			name: "not granted topic",
+			r:    bus.SubscribeRequest{Principal: "plugin.users", Topics: []string{topicUserCreated, topicCommentCreated}},
+			err:  "principal(plugin.users) is not granted topic(comment.created)",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := p.AuthorizeSubscribe(ctx, tt.r)
+			if tt.err == "" {
+				assert.Nil(t, err)
+				return
+			}
+			assert.EqualError(t, err, tt.err)
+		})
+	}
+}
+
+func TestPolicyBus(t *testing.T) {
+	p := setupPolicy(t)
+	b := setupAccess(t, p, topicCommentCreated, topicUserCreated)
+	comments := context.WithValue(context.Background(), bus.CtxKeyPrincipal, "plugin.comments")
+	users := context.WithValue(context.Background(), bus.CtxKeyPrincipal, "plugin.users")
+
+	err := b.RegisterHandlerWithContext(users, "users.handler", fakeHandler(".*"))
+	assert.True(t, errors.Is(err, bus.ErrSubscribeDenied))
+
+	err = b.RegisterHandlerWithContext(users, "users.handler", fakeHandler("^user"))
+	require.Nil(t, err)
+
+	require.Nil(t, b.Emit(comments, topicCommentCreated, 1))
+	err = b.Emit(comments, topicUserCreated, 2)
+	assert.EqualError(t, err, "bus: topic(user.created) emit denied: principal(plugin.comments) with source() is not granted")
+}
+
+func setupPolicy(t *testing.T) *bus.Policy {
+	p, err := bus.NewPolicy(
+		bus.PolicyRule{
+			Principal: `^plugin\.comments$`,
+			Emit:      []string{`^comment\.`},
+			Subscribe: []string{`^comment\.`, `^user\.created$`},
+		},
+		bus.PolicyRule{
+			Principal: `^plugin\.users$`,
+			Source:    `^/users$`,
+			Emit:      []string{`^user\.`},
+			Subscribe: []string{`^user\.`},
+		},
+		bus.PolicyRule{Emit: []string{`^audit\.`}},
+	)
+	require.Nil(t, err)
+	return p
+}
@@ -0,0 +1,235 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package bus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type (
+	// RateLimit configures a token bucket rate limiter
+	RateLimit struct {
+		Rate   float64        `json:"rate"`             // events per second, zero or less disables it
+		Burst  int            `json:"burst,omitempty"`  // bucket size, at least 1
+		Policy ThrottlePolicy `json:"policy,omitempty"` // what to do with the events over the limit
+	}
+
+	// ThrottlePolicy decides what happens to the events over the rate limit
+	ThrottlePolicy int8
+
+	// TopicStats is a snapshot of the topic emit metrics
+	TopicStats struct {
+		Throttled uint64 `json:"throttled"` // emits over the rate limit
+		Dropped   uint64 `json:"dropped"`   // emits rejected by the rate limit
+	}
+
+	// limiter is a token bucket allowing token debt for the reservations
+	limiter struct {
+		throttled uint64
+		dropped   uint64
+
+		mutex  sync.Mutex
+		clock  Clock
+		limit  RateLimit
+		tokens float64
+		last   time.Time
+	}
+)
+
+const (
+	// ThrottleBlock blocks the caller until the event is allowed
+	ThrottleBlock ThrottlePolicy = iota
+
+	// ThrottleDelay schedules the event delivery for when it is allowed and
+	// returns immediately
+	ThrottleDelay
+
+	// ThrottleDrop drops the event
+	ThrottleDrop
+)
+
+// ErrThrottled is wrapped by the errors of the events dropped by rate limits
+var ErrThrottled = errors.New("rate limit exceeded")
+
+var errNilClock = errors.New("bus: clock can't be nil")
+
+// WithRateLimit returns an option to rate limit the emits of the topic
+func WithRateLimit(l RateLimit) TopicOption {
+	return func(d TopicDescriptor) TopicDescriptor {
+		d.RateLimit = &l
+		return d
+	}
+}
+
+// TopicStats returns the emit metrics of the topic
+func (b *Bus) TopicStats(topic string) (TopicStats, bool) {
+	b.mutex.RLock()
+	_, ok := b.topics[topic]
+	l := b.limiters[topic]
+	b.mutex.RUnlock()
+
+	if !ok {
+		return TopicStats{}, false
+	}
+	return l.stats(), true
+}
+
+// publish appends the event applying the emit rate limits of its tenant and
+// its topic
+func (b *Bus) publish(ctx context.Context, t emitTarget, e Event) error {
+	if l := b.tenants.limiter(e.Tenant); l != nil {
+		return b.publishTenant(ctx, l, t, e)
+	}
+	return b.publishTopic(ctx, t, e)
+}
+
+func (b *Bus) publishTenant(ctx context.Context, l *limiter, t emitTarget, e Event) error {
+	var err error
+	terr := l.throttle(ctx, "tenant", e.Tenant, func(delayed bool) {
+		if !delayed {
+			err = b.publishTopic(ctx, t, e)
+			return
+		}
+		b.warnDelayed(ctx, e.Topic, b.publishTopic(ctx, t, e))
+	})
+	if terr != nil {
+		return terr
+	}
+	return err
+}
+
+func (b *Bus) publishTopic(ctx context.Context, t emitTarget, e Event) error {
+	if t.limiter == nil {
+		return b.append(ctx, t, e)
+	}
+
+	var err error
+	terr := t.limiter.throttle(ctx, "topic", e.Topic, func(delayed bool) {
+		if !delayed {
+			err = b.append(ctx, t, e)
+			return
+		}
+		b.warnDelayed(ctx, e.Topic, b.append(ctx, t, e))
+	})
+	if terr != nil {
+		return terr
+	}
+	return err
+}
+
+// warnDelayed passes the failure of a delayed emit to the warn func, since
+// the emit has already returned
+func (b *Bus) warnDelayed(ctx context.Context, topic string, err error) {
+	if err != nil {
+		b.warn(ctx, topic, fmt.Sprintf("delayed emit failed: %s", err))
+	}
+}
+
+func newLimiter(c Clock, l *RateLimit) *limiter {
+	if l == nil || l.Rate <= 0 {
+		return nil
+	}
+
+	limit := *l
+	if limit.Burst < 1 {
+		limit.Burst = 1
+	}
+	return &limiter{clock: c, limit: limit, tokens: float64(limit.Burst), last: c.Now()}
+}
+
+// throttle runs the func when the limiter allows it according to the policy,
+// fn is told whether it runs after the return of throttle; dropped events
+// return an error wrapping ErrThrottled
+func (l *limiter) throttle(ctx context.Context, kind, name string, fn func(delayed bool)) error {
+	if l.limit.Policy == ThrottleDrop {
+		if !l.allow() {
+			atomic.AddUint64(&l.throttled, 1)
+			atomic.AddUint64(&l.dropped, 1)
+			return fmt.Errorf("bus: %s(%s) dropped: %w", kind, name, ErrThrottled)
+		}
+		fn(false)
+		return nil
+	}
+
+	wait := l.reserve()
+	if wait <= 0 {
+		fn(false)
+		return nil
+	}
+	atomic.AddUint64(&l.throttled, 1)
+
+	if l.limit.Policy == ThrottleDelay {
+		l.clock.AfterFunc(wait, func() { fn(true) })
+		return nil
+	}
+
+	if err := sleep(ctx, l.clock, wait); err != nil {
+		l.cancel()
+		atomic.AddUint64(&l.dropped, 1)
+		return fmt.Errorf("bus: %s(%s) dropped: %w: %v", kind, name, ErrThrottled, err)
+	}
+	fn(false)
+	return nil
+}
+
+func (l *limiter) stats() TopicStats {
+	if l == nil {
+		return TopicStats{}
+	}
+	return TopicStats{
+		Throttled: atomic.LoadUint64(&l.throttled),
+		Dropped:   atomic.LoadUint64(&l.dropped),
+	}
+}
+
+// allow takes a token if there is one
+func (l *limiter) allow() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.advance()
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// reserve takes a token and returns the duration to wait for it
+func (l *limiter) reserve() time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.advance()
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.limit.Rate * float64(time.Second))
+}
+
+// cancel gives back a reserved token
+func (l *limiter) cancel() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.tokens++
+}
+
+func (l *limiter) advance() {
+	now := l.clock.Now()
+	if elapsed := now.Sub(l.last); elapsed > 0 {
+		l.tokens += elapsed.Seconds() * l.limit.Rate
+		if burst := float64(l.limit.Burst); l.tokens > burst {
+			l.tokens = burst
+		}
+		l.last = now
+	}
+}
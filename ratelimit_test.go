@@ -0,0 +1,227 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package bus_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mustafaturan/bus/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type (
+	fakeRecorder struct {
+		mutex  sync.Mutex
+		events []interface{}
+	}
+
+	fakeFailingStore struct {
+		bus.EventStore
+	}
+)
+
+func TestTopicRateLimit(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("drop", func(t *testing.T) {
+		b, _, r := setupRateLimit(t, bus.RateLimit{Rate: 1, Burst: 2, Policy: bus.ThrottleDrop}, nil)
+
+		require.Nil(t, b.Emit(ctx, topicCommentCreated, 1))
+		require.Nil(t, b.EmitWithOpts(ctx, topicCommentCreated, 2))
+
+		err := b.Emit(ctx, topicCommentCreated, 3)
+		assert.True(t, errors.Is(err, bus.ErrThrottled))
+		assert.EqualError(t, err, "bus: topic(comment.created) dropped: rate limit exceeded")
+		assert.Equal(t, []interface{}{1, 2}, r.received())
+
+		stats, ok := b.TopicStats(topicCommentCreated)
+		assert.True(t, ok)
+		assert.Equal(t, bus.TopicStats{Throttled: 1, Dropped: 1}, stats)
+	})
+
+	t.Run("refills tokens", func(t *testing.T) {
+		b, clock, r := setupRateLimit(t, bus.RateLimit{Rate: 2, Burst: 1, Policy: bus.ThrottleDrop}, nil)
+
+		require.Nil(t, b.Emit(ctx, topicCommentCreated, 1))
+		assert.Error(t, b.Emit(ctx, topicCommentCreated, 2))
+		clock.Advance(500 * time.Millisecond)
+		require.Nil(t, b.Emit(ctx, topicCommentCreated, 3))
+		assert.Equal(t, []interface{}{1, 3}, r.received())
+	})
+
+	t.Run("delay", func(t *testing.T) {
+		b, clock, r := setupRateLimit(t, bus.RateLimit{Rate: 1, Burst: 1, Policy: bus.ThrottleDelay}, nil)
+
+		require.Nil(t, b.Emit(ctx, topicCommentCreated, 1))
+		require.Nil(t, b.Emit(ctx, topicCommentCreated, 2))
+		require.Nil(t, b.Emit(ctx, topicCommentCreated, 3))
+		assert.Equal(t, []interface{}{1}, r.received())
+
+		clock.Advance(time.Second)
+		assert.Equal(t, []interface{}{1, 2}, r.received())
+		clock.Advance(time.Second)
+		assert.Equal(t, []interface{}{1, 2, 3}, r.received())
+
+		stats, _ := b.TopicStats(topicCommentCreated)
+		assert.Equal(t, bus.TopicStats{Throttled: 2}, stats)
+	})
+
+	t.Run("delay with system clock", func(t *testing.T) {
+		b, err := bus.NewBus(bus.Next(func() string { return "fakeid" }))
+		require.Nil(t, err)
+		b.RegisterTopicWithOpts(topicCommentCreated, bus.WithRateLimit(bus.RateLimit{Rate: 1000, Burst: 1, Policy: bus.ThrottleDelay}))
+
+		r := &fakeRecorder{}
+		b.RegisterHandler("test.handler", bus.Handler{Handle: r.record, Matcher: ".*"})
+		for i := 0; i < 20; i++ {
+			require.Nil(t, b.Emit(ctx, topicCommentCreated, i))
+		}
+		assert.Eventually(t, func() bool { return len(r.received()) == 20 }, time.Second, time.Millisecond)
+	})
+
+	t.Run("delay with failing append", func(t *testing.T) {
+		var (
+			mutex    sync.Mutex
+			warnings []string
+		)
+		clock := newFakeClock()
+		b, err := bus.NewBus(
+			bus.Next(func() string { return "fakeid" }),
+			bus.WithClock(clock),
+			bus.WithEventStore(fakeFailingStore{}),
+			bus.WithWarnFunc(func(_ context.Context, _, msg string) {
+				mutex.Lock()
+				defer mutex.Unlock()
+				warnings = append(warnings, msg)
+			}),
+		)
+		require.Nil(t, err)
+		b.RegisterTopicWithOpts(topicCommentCreated, bus.WithRateLimit(bus.RateLimit{Rate: 1, Burst: 1, Policy: bus.ThrottleDelay}))
+
+		assert.Error(t, b.Emit(ctx, topicCommentCreated, 1))
+		require.Nil(t, b.Emit(ctx, topicCommentCreated, 2))
+
+		clock.Advance(time.Second)
+		mutex.Lock()
+		defer mutex.Unlock()
+		assert.Equal(t, []string{"delayed emit failed: bus: topic(comment.created) event append failed: disk full"}, warnings)
+	})
+
+	t.Run("block", func(t *testing.T) {
+		b, clock, r := setupRateLimit(t, bus.RateLimit{Rate: 1, Burst: 1}, nil)
+
+		require.Nil(t, b.Emit(ctx, topicCommentCreated, 1))
+
+		errs := make(chan error)
+		go func() { errs <- b.Emit(ctx, topicCommentCreated, 2) }()
+
+		clock.WaitTimers(t, 1)
+		assert.Equal(t, []interface{}{1}, r.received())
+		clock.Advance(time.Second)
+		require.Nil(t, <-errs)
+		assert.Equal(t, []interface{}{1, 2}, r.received())
+	})
+
+	t.Run("block with cancelled ctx", func(t *testing.T) {
+		b, clock, r := setupRateLimit(t, bus.RateLimit{Rate: 1, Burst: 1}, nil)
+
+		require.Nil(t, b.Emit(ctx, topicCommentCreated, 1))
+
+		ctx, cancel := context.WithCancel(ctx)
+		errs := make(chan error)
+		go func() { errs <- b.Emit(ctx, topicCommentCreated, 2) }()
+
+		clock.WaitTimers(t, 1)
+		cancel()
+		err := <-errs
+		assert.True(t, errors.Is(err, bus.ErrThrottled))
+		assert.Equal(t, []interface{}{1}, r.received())
+
+		stats, _ := b.TopicStats(topicCommentCreated)
+		assert.Equal(t, bus.TopicStats{Throttled: 1, Dropped: 1}, stats)
+	})
+
+	t.Run("without rate", func(t *testing.T) {
+		b, _, r := setupRateLimit(t, bus.RateLimit{Burst: 1, Policy: bus.ThrottleDrop}, nil)
+
+		for i := 0; i < 3; i++ {
+			require.Nil(t, b.Emit(ctx, topicCommentCreated, i))
+		}
+		assert.Len(t, r.received(), 3)
+	})
+
+	t.Run("with unknown topic", func(t *testing.T) {
+		b, _, _ := setupRateLimit(t, bus.RateLimit{Rate: 1}, nil)
+		_, ok := b.TopicStats(topicUserCreated)
+		assert.False(t, ok)
+	})
+}
+
+func TestHandlerRateLimit(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("drop", func(t *testing.T) {
+		l := bus.RateLimit{Rate: 1, Burst: 1, Policy: bus.ThrottleDrop}
+		b, _, r := setupRateLimit(t, bus.RateLimit{}, &l)
+
+		require.Nil(t, b.Emit(ctx, topicCommentCreated, 1))
+		require.Nil(t, b.Emit(ctx, topicCommentCreated, 2))
+		assert.Equal(t, []interface{}{1}, r.received())
+
+		stats, _ := b.HandlerStats("test.handler")
+		assert.Equal(t, bus.HandlerStats{Delivered: 1, Dropped: 1, Throttled: 1}, stats)
+	})
+
+	t.Run("delay", func(t *testing.T) {
+		l := bus.RateLimit{Rate: 10, Burst: 1, Policy: bus.ThrottleDelay}
+		b, clock, r := setupRateLimit(t, bus.RateLimit{}, &l)
+
+		require.Nil(t, b.Emit(ctx, topicCommentCreated, 1))
+		require.Nil(t, b.Emit(ctx, topicCommentCreated, 2))
+		assert.Equal(t, []interface{}{1}, r.received())
+
+		clock.Advance(100 * time.Millisecond)
+		assert.Equal(t, []interface{}{1, 2}, r.received())
+	})
+}
+
+func setupRateLimit(t *testing.T, topicLimit bus.RateLimit, handlerLimit *bus.RateLimit) (*bus.Bus, *fakeClock, *fakeRecorder) {
+	clock := newFakeClock()
+	b, err := bus.NewBus(bus.Next(func() string { return "fakeid" }), bus.WithClock(clock))
+	require.Nil(t, err)
+
+	b.RegisterTopicWithOpts(topicCommentCreated, bus.WithRateLimit(topicLimit))
+
+	r := &fakeRecorder{}
+	b.RegisterHandler("test.handler", bus.Handler{
+		Handle:    r.record,
+		Matcher:   ".*",
+		RateLimit: handlerLimit,
+	})
+	return b, clock, r
+}
+
+func (r *fakeRecorder) record(_ context.Context, e bus.Event) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.events = append(r.events, e.Data)
+}
+
+func (r *fakeRecorder) received() []interface{} {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return append([]interface{}(nil), r.events...)
+}
+
+func (fakeFailingStore) Append(e bus.Event) (bus.Event, error) {
+	return e, errors.New("disk full")
+}
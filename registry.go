@@ -0,0 +1,254 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package bus
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+type (
+	// RegistrySpec is a declarative description of the topics and handlers
+	// of a bus; it can be exported from a running bus, kept as JSON and
+	// applied to a new one
+	//
+	// The options which are code, like the payload types, validators, key
+	// funcs and handler funcs, are not part of the spec.
+	RegistrySpec struct {
+		Topics   []TopicSpec   `json:"topics"`
+		Handlers []HandlerSpec `json:"handlers"`
+	}
+
+	// TopicSpec is a topic of the registry spec with its options
+	TopicSpec struct {
+		Name        string        `json:"name"`
+		Description string        `json:"description,omitempty"`
+		Owner       string        `json:"owner,omitempty"`
+		Retention   time.Duration `json:"retention,omitempty"`
+		Internal    bool          `json:"internal,omitempty"`
+		Deprecation string        `json:"deprecation,omitempty"`
+		RateLimit   *RateLimit    `json:"rateLimit,omitempty"`
+	}
+
+	// HandlerSpec is a handler of the registry spec with its options
+	HandlerSpec struct {
+		Key       string     `json:"key"`
+		Matcher   string     `json:"matcher"`
+		Group     string     `json:"group,omitempty"`
+		Tenant    string     `json:"tenant,omitempty"`
+		Commit    CommitMode `json:"commit,omitempty"`
+		RateLimit *RateLimit `json:"rateLimit,omitempty"`
+	}
+
+	// SpecReport lists the gaps of a registry spec
+	SpecReport struct {
+		// handler keys of the spec without a bound implementation
+		Unbound []string `json:"unbound"`
+
+		// topics of the spec without any subscribed handler
+		Unsubscribed []string `json:"unsubscribed"`
+
+		// handler keys of the spec denied by the authorizer on apply
+		Denied []string `json:"denied,omitempty"`
+	}
+)
+
+// RegistrySpec exports the topics and handlers of the bus sorted by name, so
+// the specs can be diffed
+func (b *Bus) RegistrySpec() RegistrySpec {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	s := RegistrySpec{
+		Topics:   make([]TopicSpec, 0, len(b.topics)),
+		Handlers: make([]HandlerSpec, 0, len(b.handlers)),
+	}
+
+	for name := range b.topics {
+		d := b.descriptors[name]
+		s.Topics = append(s.Topics, TopicSpec{
+			Name:        name,
+			Description: d.Description,
+			Owner:       d.Owner,
+			Retention:   d.Retention,
+			Internal:    d.Internal,
+			Deprecation: d.Deprecation,
+			RateLimit:   copyRateLimit(d.RateLimit),
+		})
+	}
+
+	for key, h := range b.handlers {
+		s.Handlers = append(s.Handlers, HandlerSpec{
+			Key:       key,
+			Matcher:   h.Matcher,
+			Group:     h.Group,
+			Tenant:    h.Tenant,
+			Commit:    h.Commit,
+			RateLimit: copyRateLimit(h.RateLimit),
+		})
+	}
+
+	sort.Slice(s.Topics, func(i, j int) bool { return s.Topics[i].Name < s.Topics[j].Name })
+	sort.Slice(s.Handlers, func(i, j int) bool { return s.Handlers[i].Key < s.Handlers[j].Key })
+
+	return s
+}
+
+// Validate checks the spec and reports the handlers without an
+// implementation in the bindings and the topics no bound handler matches
+func (s RegistrySpec) Validate(bindings map[string]Handler) (SpecReport, error) {
+	matchers, err := s.compile()
+	if err != nil {
+		return SpecReport{}, err
+	}
+
+	r := SpecReport{Unbound: make([]string, 0), Unsubscribed: make([]string, 0)}
+	for _, h := range s.Handlers {
+		if !bound(bindings, h.Key) {
+			r.Unbound = append(r.Unbound, h.Key)
+		}
+	}
+
+	for _, t := range s.Topics {
+		subscribed := false
+		for _, h := range s.Handlers {
+			if bound(bindings, h.Key) && matchers[h.Key].MatchString(t.Name) {
+				subscribed = true
+				break
+			}
+		}
+		if !subscribed {
+			r.Unsubscribed = append(r.Unsubscribed, t.Name)
+		}
+	}
+
+	sort.Strings(r.Unbound)
+	sort.Strings(r.Unsubscribed)
+	return r, nil
+}
+
+// ApplySpec registers the topics and the bound handlers of the spec; the
+// handler funcs come from the bindings by handler key and the rest of the
+// handler options from the spec
+//
+// The options of the already registered topics which are not part of the
+// spec, like the payload types, are kept. The handlers without a binding are
+// skipped and reported along with the topics without any subscribed handler.
+// See ApplySpecWithContext for the buses with an authorizer.
+func (b *Bus) ApplySpec(s RegistrySpec, bindings map[string]Handler) (SpecReport, error) {
+	return b.ApplySpecWithContext(context.Background(), s, bindings)
+}
+
+// ApplySpecWithContext applies the spec like ApplySpec registering the
+// handlers for the principal of the ctx; the handlers denied by the
+// authorizer are reported and the returned error wraps ErrSubscribeDenied
+func (b *Bus) ApplySpecWithContext(ctx context.Context, s RegistrySpec, bindings map[string]Handler) (SpecReport, error) {
+	r, err := s.Validate(bindings)
+	if err != nil {
+		return r, err
+	}
+
+	descriptors := make([]TopicDescriptor, 0, len(s.Topics))
+	for _, t := range s.Topics {
+		d, _ := b.TopicInfo(t.Name)
+		d.Name = t.Name
+		d.Description = t.Description
+		d.Owner = t.Owner
+		d.Retention = t.Retention
+		d.Internal = t.Internal
+		d.Deprecation = t.Deprecation
+		d.RateLimit = copyRateLimit(t.RateLimit)
+		descriptors = append(descriptors, d)
+	}
+	b.RegisterTopicDescriptors(descriptors...)
+
+	for _, spec := range s.Handlers {
+		h, ok := bindings[spec.Key]
+		if !ok || h.Handle == nil {
+			continue
+		}
+		h.Matcher = spec.Matcher
+		h.Group = spec.Group
+		h.Tenant = spec.Tenant
+		h.Commit = spec.Commit
+		h.RateLimit = copyRateLimit(spec.RateLimit)
+		if err := b.RegisterHandlerWithContext(ctx, spec.Key, h); err != nil {
+			r.Denied = append(r.Denied, spec.Key)
+		}
+	}
+
+	r.Unsubscribed = make([]string, 0)
+	for _, t := range s.Topics {
+		if len(b.TopicHandlerKeys(t.Name)) == 0 {
+			r.Unsubscribed = append(r.Unsubscribed, t.Name)
+		}
+	}
+	sort.Strings(r.Unsubscribed)
+
+	if len(r.Denied) > 0 {
+		sort.Strings(r.Denied)
+		return r, fmt.Errorf("bus: registry spec handlers(%s) %w", strings.Join(r.Denied, ", "), ErrSubscribeDenied)
+	}
+	return r, nil
+}
+
+// compile checks the names and the matchers of the spec, returns the
+// compiled matchers by handler key
+func (s RegistrySpec) compile() (map[string]*regexp.Regexp, error) {
+	var msgs []string
+
+	topics := make(map[string]bool, len(s.Topics))
+	for i, t := range s.Topics {
+		switch {
+		case t.Name == empty:
+			msgs = append(msgs, fmt.Sprintf("topic[%d] name can't be empty", i))
+		case topics[t.Name]:
+			msgs = append(msgs, fmt.Sprintf("topic(%s) is duplicated", t.Name))
+		}
+		topics[t.Name] = true
+	}
+
+	matchers := make(map[string]*regexp.Regexp, len(s.Handlers))
+	for i, h := range s.Handlers {
+		if h.Key == empty {
+			msgs = append(msgs, fmt.Sprintf("handler[%d] key can't be empty", i))
+			continue
+		}
+		if _, ok := matchers[h.Key]; ok {
+			msgs = append(msgs, fmt.Sprintf("handler(%s) is duplicated", h.Key))
+			continue
+		}
+		re, err := regexp.Compile(h.Matcher)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("handler(%s) matcher(%s) is invalid: %s", h.Key, h.Matcher, err))
+			continue
+		}
+		matchers[h.Key] = re
+	}
+
+	if len(msgs) > 0 {
+		return nil, fmt.Errorf("bus: registry spec is invalid: %s", strings.Join(msgs, "; "))
+	}
+	return matchers, nil
+}
+
+// copyRateLimit copies the rate limit, so the spec and the registry don't
+// share it
+func copyRateLimit(l *RateLimit) *RateLimit {
+	if l == nil {
+		return nil
+	}
+	c := *l
+	return &c
+}
+
+func bound(bindings map[string]Handler, key string) bool {
+	h, ok := bindings[key]
+	return ok && h.Handle != nil
+}
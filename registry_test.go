@@ -0,0 +1,177 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package bus_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mustafaturan/bus/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistrySpec(t *testing.T) {
+	b := setupRegistry(t)
+
+	want := bus.RegistrySpec{
+		Topics: []bus.TopicSpec{
+			{Name: topicUserCreated, Owner: "identity", Retention: time.Hour, RateLimit: &bus.RateLimit{Rate: 10, Burst: 5}},
+			{Name: topicUserDeleted, Deprecation: "use user.removed"},
+			{Name: topicUserUpdated},
+		},
+		Handlers: []bus.HandlerSpec{
+			{Key: "audit", Matcher: ".*", Commit: bus.CommitExplicit},
+			{Key: "mailer", Matcher: "created$", Group: "mailers"},
+		},
+	}
+	assert.Equal(t, want, b.RegistrySpec())
+
+	t.Run("round trips as json", func(t *testing.T) {
+		data, err := json.Marshal(b.RegistrySpec())
+		require.Nil(t, err)
+
+		var got bus.RegistrySpec
+		require.Nil(t, json.Unmarshal(data, &got))
+		assert.Equal(t, want, got)
+	})
+}
+
+func TestRegistrySpecValidate(t *testing.T) {
+	s := setupRegistry(t).RegistrySpec()
+
+	t.Run("reports unbound handlers and unsubscribed topics", func(t *testing.T) {
+		r, err := s.Validate(map[string]bus.Handler{"mailer": fakeHandler("")})
+		require.Nil(t, err)
+		assert.Equal(t, bus.SpecReport{
+			Unbound:      []string{"audit"},
+			Unsubscribed: []string{topicUserDeleted, topicUserUpdated},
+		}, r)
+	})
+
+	t.Run("with nil handle", func(t *testing.T) {
+		r, err := s.Validate(map[string]bus.Handler{"audit": {}, "mailer": fakeHandler("")})
+		require.Nil(t, err)
+		assert.Equal(t, []string{"audit"}, r.Unbound)
+	})
+
+	t.Run("with all bound", func(t *testing.T) {
+		r, err := s.Validate(map[string]bus.Handler{"audit": fakeHandler(""), "mailer": fakeHandler("")})
+		require.Nil(t, err)
+		assert.Equal(t, bus.SpecReport{Unbound: []string{}, Unsubscribed: []string{}}, r)
+	})
+
+	t.Run("with invalid spec", func(t *testing.T) {
+		s := bus.RegistrySpec{
+			Topics: []bus.TopicSpec{{Name: "a"}, {}, {Name: "a"}},
+			Handlers: []bus.HandlerSpec{
+				{Key: "h", Matcher: ".*"},
+				{Matcher: ".*"},
+				{Key: "h", Matcher: "a"},
+				{Key: "i", Matcher: "["},
+			},
+		}
+		_, err := s.Validate(nil)
+		assert.EqualError(t, err, "bus: registry spec is invalid: "+
+			"topic[1] name can't be empty; topic(a) is duplicated; "+
+			"handler[1] key can't be empty; handler(h) is duplicated; "+
+			"handler(i) matcher([) is invalid: error parsing regexp: missing closing ]: `[`")
+	})
+}
+
+func TestApplySpec(t *testing.T) {
+	s := setupRegistry(t).RegistrySpec()
+
+	b := setup()
+	b.RegisterTopicWithOpts(topicUserCreated, bus.WithPayloadType(fakeUserV3{}), bus.WithOwner("legacy"))
+
+	var flushed bool
+	r := &fakeRecorder{}
+	report, err := b.ApplySpec(s, map[string]bus.Handler{
+		"mailer": {
+			Handle:  r.record,
+			Matcher: "ignored",
+			Flush:   func(context.Context) { flushed = true },
+		},
+	})
+	require.Nil(t, err)
+	assert.Equal(t, bus.SpecReport{
+		Unbound:      []string{"audit"},
+		Unsubscribed: []string{topicUserDeleted, topicUserUpdated},
+	}, report)
+
+	t.Run("registers the topics keeping the code options", func(t *testing.T) {
+		assert.ElementsMatch(t, []string{topicUserCreated, topicUserDeleted, topicUserUpdated}, b.Topics())
+
+		d, ok := b.TopicInfo(topicUserCreated)
+		require.True(t, ok)
+		assert.Equal(t, "identity", d.Owner)
+		assert.Equal(t, time.Hour, d.Retention)
+		assert.Equal(t, reflect.TypeOf(fakeUserV3{}), d.PayloadType)
+	})
+
+	t.Run("registers the bound handlers with the spec options", func(t *testing.T) {
+		assert.Equal(t, []string{"mailer"}, b.HandlerKeys())
+		assert.Equal(t, []string{"mailer"}, b.GroupMembers("mailers"))
+
+		require.Nil(t, b.Emit(context.Background(), topicUserCreated, fakeUserV3{FirstName: "a"}))
+		assert.Equal(t, []interface{}{fakeUserV3{FirstName: "a"}}, r.received())
+
+		require.Nil(t, b.Close(context.Background()))
+		assert.True(t, flushed)
+	})
+
+	t.Run("copies the rate limits", func(t *testing.T) {
+		s.Topics[0].RateLimit.Rate = 1
+		d, _ := b.TopicInfo(topicUserCreated)
+		assert.Equal(t, float64(10), d.RateLimit.Rate)
+
+		exported := b.RegistrySpec()
+		exported.Topics[0].RateLimit.Rate = 2
+		d, _ = b.TopicInfo(topicUserCreated)
+		assert.Equal(t, float64(10), d.RateLimit.Rate)
+	})
+
+	t.Run("with denied handlers", func(t *testing.T) {
+		b, err := bus.NewBus(bus.Next(func() string { return "fakeid" }), bus.WithAuthorizer(&fakeAuthorizer{err: errors.New("not allowed")}))
+		require.Nil(t, err)
+
+		report, err := b.ApplySpecWithContext(context.Background(), s, map[string]bus.Handler{
+			"audit":  {Handle: noopHandle},
+			"mailer": {Handle: noopHandle},
+		})
+		assert.True(t, errors.Is(err, bus.ErrSubscribeDenied), err)
+		assert.EqualError(t, err, "bus: registry spec handlers(audit, mailer) subscribe denied")
+		assert.Equal(t, []string{"audit", "mailer"}, report.Denied)
+		assert.Empty(t, b.HandlerKeys())
+	})
+
+	t.Run("with invalid spec", func(t *testing.T) {
+		b := setup()
+		_, err := b.ApplySpec(bus.RegistrySpec{Topics: []bus.TopicSpec{{}}}, nil)
+		assert.EqualError(t, err, "bus: registry spec is invalid: topic[0] name can't be empty")
+		assert.Empty(t, b.Topics())
+	})
+}
+
+func setupRegistry(t *testing.T) *bus.Bus {
+	b := setup(topicUserUpdated)
+	b.RegisterTopicWithOpts(topicUserCreated,
+		bus.WithOwner("identity"),
+		bus.WithRetention(time.Hour),
+		bus.WithRateLimit(bus.RateLimit{Rate: 10, Burst: 5}),
+	)
+	b.RegisterTopicWithOpts(topicUserDeleted, bus.WithDeprecation("use user.removed"))
+
+	b.RegisterHandler("audit", bus.Handler{Handle: noopHandle, Matcher: ".*", Commit: bus.CommitExplicit})
+	mailer := fakeHandler("created$")
+	mailer.Group = "mailers"
+	b.RegisterHandler("mailer", mailer)
+	return b
+}
@@ -0,0 +1,519 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+/*
+Package saga coordinates the multi step workflows over the bus events
+
+A saga is a sequence of steps. An instance starts with an event of the start
+topic and runs the steps in order; a step emits its action event and waits
+for its done event to run the next step. The events are correlated to the
+instances by the tx id or by the key of the events, the emitted events carry
+the correlation of their instance:
+
+	s, err := saga.New(b, saga.Definition{
+		Name:  "order.fulfillment",
+		Start: "order.placed",
+		Steps: []saga.Step{
+			{
+				Name:       "reserve",
+				Action:     reserveStock,    // emits stock.reserve
+				Done:       "stock.reserved",
+				Failed:     "stock.unavailable",
+				Compensate: releaseStock,    // emits stock.release
+			},
+			{
+				Name:    "charge",
+				Action:  chargeCard,
+				Done:    "card.charged",
+				Failed:  "card.declined",
+				Timeout: time.Minute,
+			},
+		},
+		TimeoutTopic: "order.fulfillment.timedout",
+	})
+	err = s.Start()
+
+When a step fails by its failed event, by a timeout or by an action emit
+failure, the compensations of the completed steps are emitted in the reverse
+order. The timeouts are scheduled events of the timeout topic, so they show up
+on the bus like any other event. The instances are saved to a Store on each
+change and the running ones are resumed on start.
+*/
+package saga
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mustafaturan/bus/v3"
+)
+
+type (
+	// Definition describes a saga
+	Definition struct {
+		// name of the saga, also the handler key of the saga
+		Name string
+
+		// correlates the events to the instances, by tx id by default
+		Correlation Correlation
+
+		// topic of the events starting a new instance
+		Start string
+
+		// steps of the saga in order
+		Steps []Step
+
+		// topic of the scheduled timeout events with the Timeout data,
+		// required when any step has a timeout; the topic is registered on
+		// start
+		TimeoutTopic string
+
+		// persists the instances, defaults to a new MemoryStore
+		Store Store
+
+		// schedules the timeouts, defaults to bus.SystemClock
+		Clock bus.Clock
+
+		// receives the store and emit failures, optional
+		Warn bus.WarnFunc
+	}
+
+	// Step is a step of a saga
+	Step struct {
+		Name string
+
+		// returns the action event of the step, optional
+		Action Command
+
+		// topic of the event completing the step
+		Done string
+
+		// topic of the event failing the step, optional
+		Failed string
+
+		// returns the event undoing the completed step, optional
+		Compensate Command
+
+		// fails the step when its done event is not received in time,
+		// optional
+		Timeout time.Duration
+	}
+
+	// Command returns the topic and the data of an event to emit for the
+	// instance
+	Command func(i Instance) (topic string, data interface{})
+
+	// Correlation decides how the events are correlated to the instances
+	Correlation int8
+
+	// Status is the state of a saga instance
+	Status int8
+
+	// Instance is a run of a saga
+	Instance struct {
+		ID        string    `json:"id"`     // correlation id
+		Saga      string    `json:"saga"`   // name of the saga
+		Status    Status    `json:"status"` // running, completed or compensated
+		Step      int       `json:"step"`   // index of the current step
+		Start     bus.Event `json:"-"`      // event starting the instance
+		Reason    string    `json:"reason,omitempty"`
+		StartedAt time.Time `json:"startedAt"`
+		UpdatedAt time.Time `json:"updatedAt"`
+		Deadline  time.Time `json:"deadline,omitempty"` // of the current step
+	}
+
+	// Timeout is the data of the timeout events
+	Timeout struct {
+		Saga     string
+		Instance string
+		Step     int
+	}
+
+	// Saga runs the instances of a saga definition on a bus
+	Saga struct {
+		bus *bus.Bus
+		def Definition
+
+		mutex     sync.Mutex
+		instances map[string]*Instance
+		timers    map[string]bus.Timer
+	}
+
+	// command is an event to emit for an instance
+	command struct {
+		instance Instance
+		step     int
+		topic    string
+		data     interface{}
+		action   bool
+	}
+)
+
+const (
+	// CorrelateTxID correlates the events by their tx id
+	CorrelateTxID Correlation = iota
+
+	// CorrelateKey correlates the events by their key
+	CorrelateKey
+)
+
+const (
+	// StatusRunning is the status of the instances waiting for a step
+	StatusRunning Status = iota
+
+	// StatusCompleted is the status of the instances with all steps done
+	StatusCompleted
+
+	// StatusCompensated is the status of the failed instances whose
+	// completed steps are compensated
+	StatusCompensated
+)
+
+// New inits a saga of the definition; the saga receives the events after
+// Start
+func New(b *bus.Bus, d Definition) (*Saga, error) {
+	if b == nil {
+		return nil, fmt.Errorf("saga: bus can't be nil")
+	}
+	if d.Name == "" || d.Start == "" {
+		return nil, fmt.Errorf("saga: name and start topic can't be empty")
+	}
+	if len(d.Steps) == 0 {
+		return nil, fmt.Errorf("saga: definition(%s) must have a step", d.Name)
+	}
+	for i, st := range d.Steps {
+		if st.Done == "" {
+			return nil, fmt.Errorf("saga: definition(%s) step[%d] done topic can't be empty", d.Name, i)
+		}
+		if st.Timeout < 0 {
+			return nil, fmt.Errorf("saga: definition(%s) step[%d] timeout(%s) can't be negative", d.Name, i, st.Timeout)
+		}
+		if st.Timeout > 0 && d.TimeoutTopic == "" {
+			return nil, fmt.Errorf("saga: definition(%s) timeout topic can't be empty with step timeouts", d.Name)
+		}
+	}
+	if d.Store == nil {
+		d.Store = NewMemoryStore()
+	}
+	if d.Clock == nil {
+		d.Clock = bus.SystemClock
+	}
+	if d.Warn == nil {
+		d.Warn = func(context.Context, string, string) {}
+	}
+
+	return &Saga{
+		bus:       b,
+		def:       d,
+		instances: make(map[string]*Instance),
+		timers:    make(map[string]bus.Timer),
+	}, nil
+}
+
+// Start loads the instances from the store, schedules the timeouts of the
+// running ones and registers the saga handler
+func (s *Saga) Start() error {
+	instances, err := s.def.Store.Instances(s.def.Name)
+	if err != nil {
+		return fmt.Errorf("saga: definition(%s) instances load failed: %w", s.def.Name, err)
+	}
+
+	s.mutex.Lock()
+	for _, i := range instances {
+		i := i
+		s.instances[i.ID] = &i
+	}
+	s.mutex.Unlock()
+
+	if s.def.TimeoutTopic != "" {
+		s.bus.RegisterTopics(s.def.TimeoutTopic)
+	}
+	s.bus.RegisterHandler(s.def.Name, bus.Handler{Handle: s.handle, Matcher: s.matcher()})
+
+	// the overdue timeouts are emitted right away, so after the handler
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, i := range s.instances {
+		if i.Status == StatusRunning && !i.Deadline.IsZero() {
+			s.schedule(*i)
+		}
+	}
+	return nil
+}
+
+// Stop deregisters the saga handler and cancels the scheduled timeouts; the
+// instances are resumed on the next start
+func (s *Saga) Stop() {
+	s.bus.DeregisterHandler(s.def.Name)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for id, t := range s.timers {
+		t.Stop()
+		delete(s.timers, id)
+	}
+}
+
+// Prune removes the completed and compensated instances updated before the
+// time from the saga and its store; returns the number of the removed
+// instances
+//
+// The finished instances are kept to ignore the repeated start events of
+// their ids, a start event of a pruned id starts a new instance.
+func (s *Saga) Prune(before time.Time) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var pruned int
+	for id, i := range s.instances {
+		if i.Status == StatusRunning || !i.UpdatedAt.Before(before) {
+			continue
+		}
+		if err := s.def.Store.Delete(s.def.Name, id); err != nil {
+			return pruned, fmt.Errorf("saga: definition(%s) instance(%s) delete failed: %w", s.def.Name, id, err)
+		}
+		delete(s.instances, id)
+		pruned++
+	}
+	return pruned, nil
+}
+
+// Instance returns the instance of the correlation id
+func (s *Saga) Instance(id string) (Instance, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	i, ok := s.instances[id]
+	if !ok {
+		return Instance{}, false
+	}
+	return *i, true
+}
+
+// Instances returns the instances sorted by start time and id
+func (s *Saga) Instances() []Instance {
+	s.mutex.Lock()
+	instances := make([]Instance, 0, len(s.instances))
+	for _, i := range s.instances {
+		instances = append(instances, *i)
+	}
+	s.mutex.Unlock()
+
+	sort.Slice(instances, func(a, b int) bool {
+		if !instances[a].StartedAt.Equal(instances[b].StartedAt) {
+			return instances[a].StartedAt.Before(instances[b].StartedAt)
+		}
+		return instances[a].ID < instances[b].ID
+	})
+	return instances
+}
+
+// String returns the name of the status
+func (st Status) String() string {
+	switch st {
+	case StatusRunning:
+		return "running"
+	case StatusCompleted:
+		return "completed"
+	case StatusCompensated:
+		return "compensated"
+	}
+	return fmt.Sprintf("status(%d)", int8(st))
+}
+
+func (s *Saga) handle(ctx context.Context, e bus.Event) {
+	s.mutex.Lock()
+	cmds := s.react(ctx, e)
+	s.mutex.Unlock()
+
+	s.emit(ctx, cmds)
+}
+
+// react moves the correlated instance by the event, returns the events to
+// emit; must be called with the lock
+func (s *Saga) react(ctx context.Context, e bus.Event) []command {
+	if e.Topic == s.def.TimeoutTopic {
+		t, ok := e.Data.(Timeout)
+		if !ok || t.Saga != s.def.Name {
+			return nil
+		}
+		i, ok := s.instances[t.Instance]
+		if !ok || i.Status != StatusRunning || i.Step != t.Step {
+			return nil
+		}
+		return s.fail(ctx, i, fmt.Sprintf("step(%s) timed out", s.def.Steps[i.Step].Name))
+	}
+
+	id := s.correlate(e)
+	if id == "" {
+		return nil
+	}
+
+	i, ok := s.instances[id]
+	if !ok {
+		if e.Topic != s.def.Start {
+			return nil
+		}
+		now := s.def.Clock.Now()
+		i = &Instance{ID: id, Saga: s.def.Name, Start: e, StartedAt: now}
+		s.instances[id] = i
+		return s.enter(ctx, i, 0)
+	}
+	if i.Status != StatusRunning {
+		return nil
+	}
+
+	st := s.def.Steps[i.Step]
+	switch e.Topic {
+	case st.Done:
+		return s.enter(ctx, i, i.Step+1)
+	case st.Failed:
+		return s.fail(ctx, i, fmt.Sprintf("step(%s) failed: %s", st.Name, e.Topic))
+	}
+	return nil
+}
+
+// enter moves the instance to the step, completes it after the last step
+func (s *Saga) enter(ctx context.Context, i *Instance, step int) []command {
+	s.cancel(i.ID)
+
+	i.Step = step
+	i.UpdatedAt = s.def.Clock.Now()
+	i.Deadline = time.Time{}
+	if step == len(s.def.Steps) {
+		i.Status = StatusCompleted
+		s.save(ctx, i)
+		return nil
+	}
+
+	st := s.def.Steps[step]
+	if st.Timeout > 0 {
+		i.Deadline = i.UpdatedAt.Add(st.Timeout)
+		s.schedule(*i)
+	}
+	s.save(ctx, i)
+
+	if st.Action == nil {
+		return nil
+	}
+	topic, data := st.Action(*i)
+	return []command{{instance: *i, step: step, topic: topic, data: data, action: true}}
+}
+
+// fail compensates the completed steps of the instance in reverse order
+func (s *Saga) fail(ctx context.Context, i *Instance, reason string) []command {
+	s.cancel(i.ID)
+
+	i.Status = StatusCompensated
+	i.Reason = reason
+	i.UpdatedAt = s.def.Clock.Now()
+	i.Deadline = time.Time{}
+	s.save(ctx, i)
+
+	var cmds []command
+	for step := i.Step - 1; step >= 0; step-- {
+		st := s.def.Steps[step]
+		if st.Compensate == nil {
+			continue
+		}
+		topic, data := st.Compensate(*i)
+		cmds = append(cmds, command{instance: *i, step: step, topic: topic, data: data})
+	}
+	return cmds
+}
+
+// emit emits the events of the instances in order; an action emit failure
+// fails its instance
+func (s *Saga) emit(ctx context.Context, cmds []command) {
+	for len(cmds) > 0 {
+		c := cmds[0]
+		cmds = cmds[1:]
+
+		err := s.bus.EmitWithOpts(ctx, c.topic, c.data, s.correlation(c.instance)...)
+		if err == nil {
+			continue
+		}
+		s.def.Warn(ctx, c.topic, fmt.Sprintf("saga(%s) instance(%s) emit failed: %s", s.def.Name, c.instance.ID, err))
+		if !c.action {
+			continue
+		}
+
+		s.mutex.Lock()
+		i, ok := s.instances[c.instance.ID]
+		if ok && i.Status == StatusRunning && i.Step == c.step {
+			cmds = append(s.fail(ctx, i, fmt.Sprintf("step(%s) action failed: %s", s.def.Steps[c.step].Name, err)), cmds...)
+		}
+		s.mutex.Unlock()
+	}
+}
+
+// schedule emits the timeout event of the current step of the instance at
+// its deadline; must be called with the lock
+func (s *Saga) schedule(i Instance) {
+	d := i.Deadline.Sub(s.def.Clock.Now())
+	t := Timeout{Saga: s.def.Name, Instance: i.ID, Step: i.Step}
+	s.timers[i.ID] = s.def.Clock.AfterFunc(d, func() {
+		ctx := context.Background()
+		if err := s.bus.EmitWithOpts(ctx, s.def.TimeoutTopic, t, s.correlation(i)...); err != nil {
+			s.def.Warn(ctx, s.def.TimeoutTopic, fmt.Sprintf("saga(%s) instance(%s) timeout emit failed: %s", s.def.Name, i.ID, err))
+		}
+	})
+}
+
+// cancel stops the scheduled timeout of the instance; must be called with
+// the lock
+func (s *Saga) cancel(id string) {
+	if t, ok := s.timers[id]; ok {
+		t.Stop()
+		delete(s.timers, id)
+	}
+}
+
+func (s *Saga) save(ctx context.Context, i *Instance) {
+	if err := s.def.Store.Save(*i); err != nil {
+		s.def.Warn(ctx, i.Start.Topic, fmt.Sprintf("saga(%s) instance(%s) save failed: %s", s.def.Name, i.ID, err))
+	}
+}
+
+func (s *Saga) correlate(e bus.Event) string {
+	if s.def.Correlation == CorrelateKey {
+		return e.Key
+	}
+	return e.TxID
+}
+
+// correlation returns the event options carrying the correlation of the
+// instance
+func (s *Saga) correlation(i Instance) []bus.EventOption {
+	opts := []bus.EventOption{bus.WithTxID(i.Start.TxID)}
+	if s.def.Correlation == CorrelateKey {
+		opts = append(opts, bus.WithKey(i.ID))
+	}
+	return opts
+}
+
+// matcher returns the pattern of the saga topics
+func (s *Saga) matcher() string {
+	topics := []string{s.def.Start}
+	if s.def.TimeoutTopic != "" {
+		topics = append(topics, s.def.TimeoutTopic)
+	}
+	for _, st := range s.def.Steps {
+		topics = append(topics, st.Done)
+		if st.Failed != "" {
+			topics = append(topics, st.Failed)
+		}
+	}
+
+	for i, t := range topics {
+		topics[i] = regexp.QuoteMeta(t)
+	}
+	return "^(" + strings.Join(topics, "|") + ")$"
+}
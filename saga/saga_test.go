@@ -0,0 +1,426 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package saga_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mustafaturan/bus/v3"
+	"github.com/mustafaturan/bus/v3/saga"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	topicOrderPlaced      = "order.placed"
+	topicStockReserve     = "stock.reserve"
+	topicStockReserved    = "stock.reserved"
+	topicStockUnavailable = "stock.unavailable"
+	topicStockRelease     = "stock.release"
+	topicCardCharge       = "card.charge"
+	topicCardCharged      = "card.charged"
+	topicCardDeclined     = "card.declined"
+	topicTimedOut         = "order.fulfillment.timedout"
+)
+
+type (
+	fakeOrder struct {
+		ID     string
+		Amount int
+	}
+
+	fakeClock struct {
+		mutex  sync.Mutex
+		now    time.Time
+		timers []*fakeTimer
+	}
+
+	fakeTimer struct {
+		clock   *fakeClock
+		at      time.Time
+		f       func()
+		stopped bool
+	}
+
+	fakeServices struct {
+		mutex  sync.Mutex
+		topics []string
+	}
+)
+
+var epoch = time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestNew(t *testing.T) {
+	b := setupBus(t)
+	step := saga.Step{Name: "reserve", Done: topicStockReserved}
+
+	tests := []struct {
+		name string
+		d    saga.Definition
+		err  string
+	}{
+		{"with empty name", saga.Definition{Start: topicOrderPlaced}, "saga: name and start topic can't be empty"},
+		{"without steps", saga.Definition{Name: "s", Start: topicOrderPlaced}, "saga: definition(s) must have a step"},
+		{
+			"with empty done topic",
+			saga.Definition{Name: "s", Start: topicOrderPlaced, Steps: []saga.Step{step, {Name: "charge"}}},
+			"saga: definition(s) step[1] done topic can't be empty",
+		},
+		{
+			"with negative timeout",
+			saga.Definition{Name: "s", Start: topicOrderPlaced, Steps: []saga.Step{{Done: topicStockReserved, Timeout: -1}}},
+			"saga: definition(s) step[0] timeout(-1ns) can't be negative",
+		},
+		{
+			"without timeout topic",
+			saga.Definition{Name: "s", Start: topicOrderPlaced, Steps: []saga.Step{{Done: topicStockReserved, Timeout: time.Second}}},
+			"saga: definition(s) timeout topic can't be empty with step timeouts",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := saga.New(b, test.d)
+			assert.EqualError(t, err, test.err)
+		})
+	}
+
+	t.Run("with nil bus", func(t *testing.T) {
+		_, err := saga.New(nil, saga.Definition{})
+		assert.EqualError(t, err, "saga: bus can't be nil")
+	})
+}
+
+func TestSaga(t *testing.T) {
+	b := setupBus(t)
+	services := setupServices(b)
+	clock := &fakeClock{now: epoch}
+	store := saga.NewMemoryStore()
+	s := setupSaga(t, b, saga.Definition{Clock: clock, Store: store})
+	ctx := context.Background()
+
+	t.Run("completes the steps", func(t *testing.T) {
+		services.reset()
+		require.Nil(t, b.EmitWithOpts(ctx, topicOrderPlaced, fakeOrder{ID: "o1", Amount: 10}, bus.WithTxID("tx1")))
+
+		i, ok := s.Instance("tx1")
+		require.True(t, ok)
+		assert.Equal(t, saga.StatusCompleted, i.Status)
+		assert.Equal(t, 2, i.Step)
+		assert.Equal(t, "order.fulfillment", i.Saga)
+		assert.Equal(t, fakeOrder{ID: "o1", Amount: 10}, i.Start.Data)
+		assert.True(t, i.Deadline.IsZero())
+		assert.Equal(t, []string{topicStockReserve, topicCardCharge}, services.received())
+	})
+
+	t.Run("compensates the completed steps on failure", func(t *testing.T) {
+		services.reset()
+		require.Nil(t, b.EmitWithOpts(ctx, topicOrderPlaced, fakeOrder{ID: "o2", Amount: 1000}, bus.WithTxID("tx2")))
+
+		i, _ := s.Instance("tx2")
+		assert.Equal(t, saga.StatusCompensated, i.Status)
+		assert.Equal(t, "step(charge) failed: card.declined", i.Reason)
+		assert.Equal(t, []string{topicStockReserve, topicCardCharge, topicStockRelease}, services.received())
+	})
+
+	t.Run("fails without compensation on the first step", func(t *testing.T) {
+		services.reset()
+		require.Nil(t, b.EmitWithOpts(ctx, topicOrderPlaced, fakeOrder{ID: "o3", Amount: -1}, bus.WithTxID("tx3")))
+
+		i, _ := s.Instance("tx3")
+		assert.Equal(t, saga.StatusCompensated, i.Status)
+		assert.Equal(t, "step(reserve) failed: stock.unavailable", i.Reason)
+		assert.Equal(t, []string{topicStockReserve}, services.received())
+	})
+
+	t.Run("times out the steps", func(t *testing.T) {
+		services.reset()
+		require.Nil(t, b.EmitWithOpts(ctx, topicOrderPlaced, fakeOrder{ID: "o4"}, bus.WithTxID("tx4")))
+
+		i, _ := s.Instance("tx4")
+		assert.Equal(t, saga.StatusRunning, i.Status)
+		assert.Equal(t, 1, i.Step)
+		assert.Equal(t, epoch.Add(time.Minute), i.Deadline)
+
+		clock.Advance(time.Minute)
+		i, _ = s.Instance("tx4")
+		assert.Equal(t, saga.StatusCompensated, i.Status)
+		assert.Equal(t, "step(charge) timed out", i.Reason)
+		assert.Equal(t, []string{topicStockReserve, topicCardCharge, topicTimedOut, topicStockRelease}, services.received())
+	})
+
+	t.Run("ignores the uncorrelated events", func(t *testing.T) {
+		require.Nil(t, b.EmitWithOpts(ctx, topicCardCharged, fakeOrder{}, bus.WithTxID("tx1")))
+		require.Nil(t, b.EmitWithOpts(ctx, topicCardCharged, fakeOrder{}, bus.WithTxID("unknown")))
+		assert.Len(t, s.Instances(), 4)
+
+		i, _ := s.Instance("tx1")
+		assert.Equal(t, saga.StatusCompleted, i.Status)
+	})
+
+	t.Run("lists the instances", func(t *testing.T) {
+		ids := make([]string, 0)
+		for _, i := range s.Instances() {
+			ids = append(ids, i.ID)
+		}
+		assert.Equal(t, []string{"tx1", "tx2", "tx3", "tx4"}, ids)
+	})
+
+	t.Run("prunes the finished instances", func(t *testing.T) {
+		services.reset()
+		require.Nil(t, b.EmitWithOpts(ctx, topicOrderPlaced, fakeOrder{ID: "o5"}, bus.WithTxID("tx5")))
+
+		pruned, err := s.Prune(epoch.Add(time.Hour))
+		require.Nil(t, err)
+		assert.Equal(t, 4, pruned)
+
+		ids := make([]string, 0)
+		for _, i := range s.Instances() {
+			ids = append(ids, i.ID)
+		}
+		assert.Equal(t, []string{"tx5"}, ids)
+
+		stored, err := store.Instances("order.fulfillment")
+		require.Nil(t, err)
+		require.Len(t, stored, 1)
+		assert.Equal(t, "tx5", stored[0].ID)
+	})
+}
+
+func TestSagaActionFailure(t *testing.T) {
+	b := setupBus(t)
+	services := setupServices(b)
+
+	var warnings []string
+	d := fulfillment(saga.Definition{Warn: func(_ context.Context, _, msg string) { warnings = append(warnings, msg) }})
+	d.Steps[1].Action = func(saga.Instance) (string, interface{}) { return "card.unknown", nil }
+	s, err := saga.New(b, d)
+	require.Nil(t, err)
+	require.Nil(t, s.Start())
+
+	require.Nil(t, b.EmitWithOpts(context.Background(), topicOrderPlaced, fakeOrder{ID: "o1"}, bus.WithTxID("tx1")))
+
+	i, _ := s.Instance("tx1")
+	assert.Equal(t, saga.StatusCompensated, i.Status)
+	assert.Equal(t, "step(charge) action failed: bus: topic(card.unknown) not found", i.Reason)
+	assert.Equal(t, []string{topicStockReserve, topicStockRelease}, services.received())
+	assert.Equal(t, []string{"saga(order.fulfillment) instance(tx1) emit failed: bus: topic(card.unknown) not found"}, warnings)
+}
+
+func TestSagaCorrelateKey(t *testing.T) {
+	b := setupBus(t)
+	var keys []string
+	b.RegisterHandler("keys", bus.Handler{
+		Handle:  func(_ context.Context, e bus.Event) { keys = append(keys, e.Key) },
+		Matcher: "^(stock|card)\\.",
+	})
+	setupServices(b)
+	s := setupSaga(t, b, saga.Definition{Correlation: saga.CorrelateKey})
+
+	require.Nil(t, b.EmitWithOpts(context.Background(), topicOrderPlaced, fakeOrder{ID: "o1"}, bus.WithKey("o1")))
+
+	i, ok := s.Instance("o1")
+	require.True(t, ok)
+	assert.Equal(t, saga.StatusRunning, i.Status)
+	assert.Equal(t, 1, i.Step)
+	assert.Equal(t, []string{"o1", "o1", "o1"}, keys)
+}
+
+func TestSagaResume(t *testing.T) {
+	types := bus.NewTypeRegistry()
+	types.Register(topicOrderPlaced, fakeOrder{})
+	store, err := saga.OpenFileStore(t.TempDir(), bus.JSONCodec{}, types)
+	require.Nil(t, err)
+
+	b := setupBus(t)
+	services := setupServices(b)
+	clock := &fakeClock{now: epoch}
+	s := setupSaga(t, b, saga.Definition{Clock: clock, Store: store})
+
+	ctx := context.Background()
+	require.Nil(t, b.EmitWithOpts(ctx, topicOrderPlaced, fakeOrder{ID: "o1"}, bus.WithTxID("tx1")))
+	require.Nil(t, b.EmitWithOpts(ctx, topicOrderPlaced, fakeOrder{ID: "o2", Amount: 10}, bus.WithTxID("tx2")))
+	s.Stop()
+	services.reset()
+
+	clock.Advance(2 * time.Minute)
+	assert.Empty(t, services.received())
+
+	s = setupSaga(t, b, saga.Definition{Clock: clock, Store: store})
+	i, ok := s.Instance("tx1")
+	require.True(t, ok)
+	assert.Equal(t, saga.StatusRunning, i.Status)
+	assert.Equal(t, fakeOrder{ID: "o1"}, i.Start.Data)
+
+	i, _ = s.Instance("tx2")
+	assert.Equal(t, saga.StatusCompleted, i.Status)
+
+	clock.Advance(0)
+	i, _ = s.Instance("tx1")
+	assert.Equal(t, saga.StatusCompensated, i.Status)
+	assert.Equal(t, []string{topicTimedOut, topicStockRelease}, services.received())
+}
+
+func TestStatusString(t *testing.T) {
+	assert.Equal(t, "running", saga.StatusRunning.String())
+	assert.Equal(t, "completed", saga.StatusCompleted.String())
+	assert.Equal(t, "compensated", saga.StatusCompensated.String())
+	assert.Equal(t, "status(9)", saga.Status(9).String())
+}
+
+func setupBus(t *testing.T) *bus.Bus {
+	var n int
+	var mutex sync.Mutex
+	b, err := bus.NewBus(bus.Next(func() string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		n++
+		return fmt.Sprint(n)
+	}))
+	require.Nil(t, err)
+	b.RegisterTopics(
+		topicOrderPlaced,
+		topicStockReserve, topicStockReserved, topicStockUnavailable, topicStockRelease,
+		topicCardCharge, topicCardCharged, topicCardDeclined,
+	)
+	return b
+}
+
+// setupServices registers the handlers replying to the saga actions: the
+// stock is unavailable for the negative amounts, the card is declined over
+// 100 and the zero amounts get no reply
+func setupServices(b *bus.Bus) *fakeServices {
+	s := &fakeServices{}
+	reply := func(ctx context.Context, e bus.Event, topic string) {
+		_ = b.EmitWithOpts(ctx, topic, e.Data, bus.WithTxID(e.TxID), bus.WithKey(e.Key))
+	}
+
+	b.RegisterHandler("services", bus.Handler{
+		Handle: func(ctx context.Context, e bus.Event) {
+			s.record(e.Topic)
+
+			o, _ := e.Data.(fakeOrder)
+			switch {
+			case e.Topic == topicStockReserve && o.Amount < 0:
+				reply(ctx, e, topicStockUnavailable)
+			case e.Topic == topicStockReserve:
+				reply(ctx, e, topicStockReserved)
+			case e.Topic == topicCardCharge && o.Amount > 100:
+				reply(ctx, e, topicCardDeclined)
+			case e.Topic == topicCardCharge && o.Amount > 0:
+				reply(ctx, e, topicCardCharged)
+			}
+		},
+		Matcher: "^(stock\\.(reserve|release)|card\\.charge|order\\.fulfillment\\.timedout)$",
+	})
+	return s
+}
+
+func setupSaga(t *testing.T, b *bus.Bus, d saga.Definition) *saga.Saga {
+	s, err := saga.New(b, fulfillment(d))
+	require.Nil(t, err)
+	require.Nil(t, s.Start())
+	return s
+}
+
+func fulfillment(d saga.Definition) saga.Definition {
+	order := func(topic string) saga.Command {
+		return func(i saga.Instance) (string, interface{}) { return topic, i.Start.Data }
+	}
+
+	d.Name = "order.fulfillment"
+	d.Start = topicOrderPlaced
+	d.TimeoutTopic = topicTimedOut
+	d.Steps = []saga.Step{
+		{
+			Name:       "reserve",
+			Action:     order(topicStockReserve),
+			Done:       topicStockReserved,
+			Failed:     topicStockUnavailable,
+			Compensate: order(topicStockRelease),
+		},
+		{
+			Name:    "charge",
+			Action:  order(topicCardCharge),
+			Done:    topicCardCharged,
+			Failed:  topicCardDeclined,
+			Timeout: time.Minute,
+		},
+	}
+	return d
+}
+
+func (s *fakeServices) record(topic string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.topics = append(s.topics, topic)
+}
+
+func (s *fakeServices) received() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return append([]string{}, s.topics...)
+}
+
+func (s *fakeServices) reset() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.topics = nil
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) bus.Timer {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	t := &fakeTimer{clock: c, at: c.now.Add(d), f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the clock and calls the due timer funcs on the caller
+// goroutine
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	c.now = c.now.Add(d)
+	var due []func()
+	timers := c.timers[:0]
+	for _, t := range c.timers {
+		switch {
+		case t.stopped:
+		case !t.at.After(c.now):
+			due = append(due, t.f)
+		default:
+			timers = append(timers, t)
+		}
+	}
+	c.timers = timers
+	c.mutex.Unlock()
+
+	for _, f := range due {
+		f()
+	}
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+
+	stopped := t.stopped
+	t.stopped = true
+	return !stopped
+}
@@ -0,0 +1,233 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package saga
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/mustafaturan/bus/v3"
+	"github.com/mustafaturan/bus/v3/internal/fsutil"
+)
+
+type (
+	// Store persists the saga instances
+	//
+	// The implementations must be safe for concurrent use.
+	Store interface {
+		// Save inserts or replaces the instance by its saga and id
+		Save(i Instance) error
+
+		// Instances returns the instances of the saga
+		Instances(saga string) ([]Instance, error)
+
+		// Delete removes the instance of the saga if exists
+		Delete(saga, id string) error
+	}
+
+	// MemoryStore is an in memory Store, i.e. for tests
+	MemoryStore struct {
+		mutex     sync.Mutex
+		instances map[string]map[string]Instance
+	}
+
+	// FileStore is a file based Store keeping the instances of each saga in
+	// a json file of its directory named after the saga; the file is replaced
+	// on each save, so it suits a moderate number of instances kept by
+	// pruning the finished ones
+	FileStore struct {
+		dir   string
+		codec bus.Codec
+		types *bus.TypeRegistry
+
+		mutex sync.Mutex
+		sagas map[string]map[string]record
+	}
+
+	// record is an instance with its start event as an envelope
+	record struct {
+		Instance
+		Start []byte `json:"start"`
+	}
+)
+
+// NewMemoryStore inits an empty memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{instances: make(map[string]map[string]Instance)}
+}
+
+// Save inserts or replaces the instance
+func (s *MemoryStore) Save(i Instance) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.instances[i.Saga] == nil {
+		s.instances[i.Saga] = make(map[string]Instance)
+	}
+	s.instances[i.Saga][i.ID] = i
+	return nil
+}
+
+// Instances returns the instances of the saga
+func (s *MemoryStore) Instances(saga string) ([]Instance, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	instances := make([]Instance, 0, len(s.instances[saga]))
+	for _, i := range s.instances[saga] {
+		instances = append(instances, i)
+	}
+	return instances, nil
+}
+
+// Delete removes the instance
+func (s *MemoryStore) Delete(saga, id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.instances[saga], id)
+	return nil
+}
+
+// OpenFileStore opens the store in the directory creating it when missing;
+// the start events are encoded with the codec into the registered types
+func OpenFileStore(dir string, c bus.Codec, r *bus.TypeRegistry) (*FileStore, error) {
+	if c == nil || r == nil {
+		return nil, fmt.Errorf("saga: file store codec and type registry can't be nil")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("saga: file store dir(%s) create failed: %w", dir, err)
+	}
+
+	return &FileStore{dir: dir, codec: c, types: r, sagas: make(map[string]map[string]record)}, nil
+}
+
+// Save inserts or replaces the instance rewriting the file of its saga
+func (s *FileStore) Save(i Instance) error {
+	start, err := bus.MarshalEvent(s.codec, i.Start)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	records, err := s.load(i.Saga)
+	if err != nil {
+		return err
+	}
+
+	prev, ok := records[i.ID]
+	records[i.ID] = record{Instance: i, Start: start}
+	if err := s.write(i.Saga, records); err != nil {
+		if ok {
+			records[i.ID] = prev
+		} else {
+			delete(records, i.ID)
+		}
+		return err
+	}
+	return nil
+}
+
+// Instances returns the instances of the saga
+func (s *FileStore) Instances(saga string) ([]Instance, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	records, err := s.load(saga)
+	if err != nil {
+		return nil, err
+	}
+
+	instances := make([]Instance, 0, len(records))
+	for _, r := range records {
+		i := r.Instance
+		i.Start, err = bus.UnmarshalEvent(s.codec, s.types, r.Start)
+		if err != nil {
+			return nil, err
+		}
+		instances = append(instances, i)
+	}
+	return instances, nil
+}
+
+// Delete removes the instance rewriting the file of its saga
+func (s *FileStore) Delete(saga, id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	records, err := s.load(saga)
+	if err != nil {
+		return err
+	}
+
+	prev, ok := records[id]
+	if !ok {
+		return nil
+	}
+	delete(records, id)
+	if err := s.write(saga, records); err != nil {
+		records[id] = prev
+		return err
+	}
+	return nil
+}
+
+// load reads the records of the saga once; must be called with the lock
+func (s *FileStore) load(saga string) (map[string]record, error) {
+	if records, ok := s.sagas[saga]; ok {
+		return records, nil
+	}
+	// the saga names the file, so it can't leave the dir
+	if saga == "" || saga == "." || saga == ".." || strings.ContainsAny(saga, `/\`) {
+		return nil, fmt.Errorf("saga: file store saga(%s) name is invalid", saga)
+	}
+
+	records := make(map[string]record)
+	data, err := ioutil.ReadFile(s.path(saga))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("saga: file store saga(%s) read failed: %w", saga, err)
+	}
+	if err == nil {
+		var list []record
+		if err := json.Unmarshal(data, &list); err != nil {
+			return nil, fmt.Errorf("saga: file store saga(%s) decode failed: %w", saga, err)
+		}
+		for _, r := range list {
+			records[r.ID] = r
+		}
+	}
+
+	s.sagas[saga] = records
+	return records, nil
+}
+
+// write replaces the file of the saga with the records
+func (s *FileStore) write(saga string, records map[string]record) error {
+	list := make([]record, 0, len(records))
+	for _, r := range records {
+		list = append(list, r)
+	}
+
+	data, err := json.Marshal(list)
+	if err != nil {
+		return fmt.Errorf("saga: file store saga(%s) encode failed: %w", saga, err)
+	}
+
+	if err := fsutil.WriteFile(s.path(saga), data, 0o644); err != nil {
+		return fmt.Errorf("saga: file store saga(%s) write failed: %w", saga, err)
+	}
+	return nil
+}
+
+func (s *FileStore) path(saga string) string {
+	return filepath.Join(s.dir, saga+".json")
+}
@@ -0,0 +1,117 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package saga_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/mustafaturan/bus/v3"
+	"github.com/mustafaturan/bus/v3/saga"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryStore(t *testing.T) {
+	s := saga.NewMemoryStore()
+	require.Nil(t, s.Save(saga.Instance{ID: "1", Saga: "a"}))
+	require.Nil(t, s.Save(saga.Instance{ID: "1", Saga: "a", Step: 1}))
+	require.Nil(t, s.Save(saga.Instance{ID: "1", Saga: "b"}))
+
+	instances, err := s.Instances("a")
+	require.Nil(t, err)
+	assert.Equal(t, []saga.Instance{{ID: "1", Saga: "a", Step: 1}}, instances)
+
+	instances, err = s.Instances("c")
+	require.Nil(t, err)
+	assert.Empty(t, instances)
+
+	require.Nil(t, s.Delete("a", "1"))
+	require.Nil(t, s.Delete("c", "1"))
+	instances, err = s.Instances("a")
+	require.Nil(t, err)
+	assert.Empty(t, instances)
+}
+
+func TestFileStore(t *testing.T) {
+	dir := t.TempDir()
+	types := bus.NewTypeRegistry()
+	types.Register(topicOrderPlaced, fakeOrder{})
+
+	t.Run("with nil codec", func(t *testing.T) {
+		_, err := saga.OpenFileStore(dir, nil, types)
+		assert.EqualError(t, err, "saga: file store codec and type registry can't be nil")
+	})
+
+	s, err := saga.OpenFileStore(dir, bus.JSONCodec{}, types)
+	require.Nil(t, err)
+
+	start := bus.Event{ID: "e1", TxID: "tx1", Topic: topicOrderPlaced, Data: fakeOrder{ID: "o1", Amount: 3}, OccurredAt: epoch}
+	first := saga.Instance{ID: "tx1", Saga: "a", Start: start, StartedAt: epoch, UpdatedAt: epoch}
+	second := first
+	second.ID, second.Status, second.Reason = "tx2", saga.StatusCompensated, "step(x) timed out"
+
+	require.Nil(t, s.Save(first))
+	require.Nil(t, s.Save(second))
+	first.Step, first.Deadline = 1, epoch.Add(time.Minute)
+	require.Nil(t, s.Save(first))
+
+	t.Run("reopens the instances", func(t *testing.T) {
+		s, err := saga.OpenFileStore(dir, bus.JSONCodec{}, types)
+		require.Nil(t, err)
+
+		instances, err := s.Instances("a")
+		require.Nil(t, err)
+		sort.Slice(instances, func(i, j int) bool { return instances[i].ID < instances[j].ID })
+		require.Len(t, instances, 2)
+		for i, want := range []saga.Instance{first, second} {
+			got := instances[i]
+			assert.True(t, want.Start.OccurredAt.Equal(got.Start.OccurredAt))
+			assert.True(t, want.Deadline.Equal(got.Deadline))
+			got.Start.OccurredAt, got.Deadline = want.Start.OccurredAt, want.Deadline
+			got.StartedAt, got.UpdatedAt = want.StartedAt, want.UpdatedAt
+			assert.Equal(t, want, got)
+		}
+	})
+
+	t.Run("deletes the instances", func(t *testing.T) {
+		require.Nil(t, s.Delete("a", "tx2"))
+		require.Nil(t, s.Delete("a", "unknown"))
+
+		s, err := saga.OpenFileStore(dir, bus.JSONCodec{}, types)
+		require.Nil(t, err)
+		instances, err := s.Instances("a")
+		require.Nil(t, err)
+		require.Len(t, instances, 1)
+		assert.Equal(t, "tx1", instances[0].ID)
+	})
+
+	t.Run("with invalid saga name", func(t *testing.T) {
+		for _, name := range []string{"", "..", "../a", "a/b"} {
+			err := s.Save(saga.Instance{ID: "tx1", Saga: name})
+			assert.EqualError(t, err, "saga: file store saga("+name+") name is invalid")
+		}
+		assert.NoFileExists(t, filepath.Join(filepath.Dir(dir), "a.json"))
+	})
+
+	t.Run("with unregistered start topic", func(t *testing.T) {
+		err := s.Save(saga.Instance{ID: "tx3", Saga: "b", Start: bus.Event{Topic: "unknown", Data: fakeOrder{}}})
+		require.Nil(t, err)
+
+		s, err := saga.OpenFileStore(dir, bus.JSONCodec{}, types)
+		require.Nil(t, err)
+		_, err = s.Instances("b")
+		assert.EqualError(t, err, "bus: topic(unknown) payload type not registered")
+	})
+
+	t.Run("with corrupted file", func(t *testing.T) {
+		require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "c.json"), []byte("{"), 0o644))
+		_, err := s.Instances("c")
+		assert.EqualError(t, err, "saga: file store saga(c) decode failed: unexpected end of JSON input")
+	})
+}
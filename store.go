@@ -0,0 +1,379 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package bus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// CommitMode is the offset commit mode of a durable handler
+type CommitMode int
+
+const (
+	// CommitNone is the default mode of the handlers which are not durable
+	CommitNone CommitMode = iota
+
+	// CommitAuto commits the seq of each event after the handler returns
+	CommitAuto
+
+	// CommitExplicit leaves the commits to the handler via CommitOffset
+	CommitExplicit
+)
+
+// groupOffsetPrefix prefixes the consumer group names in the offset stores
+const groupOffsetPrefix = "group:"
+
+type (
+	// EventStore is an append only log of the emitted events
+	//
+	// The implementations must be safe for concurrent use.
+	EventStore interface {
+		// Append stores the event assigning its next seq
+		Append(e Event) (Event, error)
+
+		// Read calls fn with the stored events from the seq in seq order
+		// until fn returns an error
+		Read(from uint64, fn func(e Event) error) error
+
+		// LastSeq returns the seq of the last stored event, 0 when empty
+		LastSeq() uint64
+	}
+
+	// BatchEventStore is an EventStore which appends a batch of events
+	// atomically, required by EmitBatch
+	BatchEventStore interface {
+		EventStore
+
+		// AppendBatch stores the events in order assigning their next seqs;
+		// either all or none of the events are stored
+		AppendBatch(events []Event) ([]Event, error)
+	}
+
+	// OffsetStore keeps the last committed event seqs of the durable handlers
+	//
+	// The implementations must be safe for concurrent use.
+	OffsetStore interface {
+		// Offset returns the committed seq of the handler, 0 when none
+		Offset(handlerKey string) (uint64, error)
+
+		// Commit stores the seq as the committed seq of the handler
+		Commit(handlerKey string, seq uint64) error
+	}
+)
+
+var (
+	errNilEventStore  = errors.New("bus: event store can't be nil")
+	errNilOffsetStore = errors.New("bus: offset store can't be nil")
+	errNoOffsetStore  = errors.New("bus: offset store is not configured")
+	errNoEventStore   = errors.New("bus: event store is not configured")
+	errNoBatchStore   = errors.New("bus: event store does not support batch appends")
+	errCaughtUp       = errors.New("bus: caught up")
+)
+
+// WithEventStore returns an option to append the emitted events to the store
+// before the delivery
+func WithEventStore(s EventStore) Option {
+	return func(b *Bus) error {
+		if s == nil {
+			return errNilEventStore
+		}
+		b.store = s
+		return nil
+	}
+}
+
+// WithOffsetStore returns an option to keep the committed offsets of the
+// durable handlers in the store
+func WithOffsetStore(s OffsetStore) Option {
+	return func(b *Bus) error {
+		if s == nil {
+			return errNilOffsetStore
+		}
+		b.offsets = s
+		return nil
+	}
+}
+
+// CommitOffset commits the event seq as the offset of the handler, the
+// members of a consumer group commit the offset of their group
+func (b *Bus) CommitOffset(handlerKey string, seq uint64) error {
+	if b.offsets == nil {
+		return errNoOffsetStore
+	}
+	if err := b.offsets.Commit(b.offsetKey(handlerKey), seq); err != nil {
+		return fmt.Errorf("bus: handler(%s) offset(%d) commit failed: %w", handlerKey, seq, err)
+	}
+	return nil
+}
+
+// HandlerOffset returns the committed offset of the handler, the offset of
+// the consumer group for its members
+func (b *Bus) HandlerOffset(handlerKey string) (uint64, error) {
+	if b.offsets == nil {
+		return 0, errNoOffsetStore
+	}
+	return b.offsets.Offset(b.offsetKey(handlerKey))
+}
+
+// offsetKey returns the offset store key of the registered handler
+func (b *Bus) offsetKey(handlerKey string) string {
+	b.mutex.RLock()
+	h, ok := b.handlers[handlerKey]
+	b.mutex.RUnlock()
+
+	if !ok {
+		return handlerKey
+	}
+	return h.offsetKey()
+}
+
+// offsetKey returns the offset store key of the handler; the members of a
+// consumer group share the offset of the group, so a new member catches up
+// from the events the group has not handled yet
+func (h Handler) offsetKey() string {
+	if h.Group != empty {
+		return groupOffsetPrefix + h.Group
+	}
+	return h.key
+}
+
+// LastSeq returns the seq of the last stored event, 0 when empty
+func (b *Bus) LastSeq() (uint64, error) {
+	if b.store == nil {
+		return 0, errNoEventStore
+	}
+	return b.store.LastSeq(), nil
+}
+
+// Replay calls fn with the stored events from the seq whose topics match the
+// matcher, upcasted to the current schema versions; it stops when the ctx is
+// done
+func (b *Bus) Replay(ctx context.Context, from uint64, matcher string, fn func(ctx context.Context, e Event)) error {
+	if b.store == nil {
+		return errNoEventStore
+	}
+	re, err := regexp.Compile(matcher)
+	if err != nil {
+		return fmt.Errorf("bus: matcher(%s) is invalid: %w", matcher, err)
+	}
+
+	return b.store.Read(from, func(e Event) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !re.MatchString(e.Topic) {
+			return nil
+		}
+
+		e, err := b.Upcast(e)
+		if err != nil {
+			return err
+		}
+		fn(ctx, e)
+		return nil
+	})
+}
+
+// append stores the event when the bus has an event store, delivers it and
+// forwards it to the parent of a namespace bus by the forward allowlist
+//
+// The routes are read under the same lock with the append, so a durable
+// handler registering meanwhile receives the event either on catch up or as
+// a live event but not both.
+func (b *Bus) append(ctx context.Context, t emitTarget, e Event) error {
+	if b.store != nil {
+		var err error
+
+		b.appends.RLock()
+		b.mutex.RLock()
+		e, err = b.store.Append(e)
+		t.routes = b.routes[e.Topic]
+		b.mutex.RUnlock()
+		b.appends.RUnlock()
+
+		if err != nil {
+			return fmt.Errorf("bus: topic(%s) event append failed: %w", e.Topic, err)
+		}
+	}
+	return b.deliver(ctx, t, e)
+}
+
+// EmitBatch emits the events in order with a single append to the event
+// store, so either all or none of them are stored; the events are checked
+// like EmitWithOpts before the append and delivered after it
+//
+// The condition, when not nil, is called right before the append while the
+// other emits of the bus wait, so a condition reading the event store is
+// atomic with the append; its error rejects the batch. The condition may
+// replay the store but must not emit. The rate limits and the tenant quotas
+// are not applied to the batches. The event store must be a
+// BatchEventStore.
+func (b *Bus) EmitBatch(ctx context.Context, condition func() error, events ...Event) error {
+	store, ok := b.store.(BatchEventStore)
+	if !ok {
+		return errNoBatchStore
+	}
+
+	tenant, _ := ctx.Value(CtxKeyTenant).(string)
+	ctxs, targets := make([]context.Context, len(events)), make([]emitTarget, len(events))
+	batch := make([]Event, len(events))
+	for i, e := range events {
+		if e.Tenant == empty {
+			e.Tenant = tenant
+		}
+
+		var err error
+		ctxs[i], targets[i], batch[i], err = b.prepare(ctx, e)
+		if err != nil {
+			return err
+		}
+	}
+
+	b.appends.Lock()
+	if condition != nil {
+		if err := condition(); err != nil {
+			b.appends.Unlock()
+			return err
+		}
+	}
+	b.mutex.RLock()
+	batch, err := store.AppendBatch(batch)
+	for i, e := range batch {
+		targets[i].routes = b.routes[e.Topic]
+	}
+	b.mutex.RUnlock()
+	b.appends.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("bus: batch append failed: %w", err)
+	}
+	for i, e := range batch {
+		if err := b.deliver(ctxs[i], targets[i], e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deliver delivers the stored event and forwards it to the parent of a
+// namespace bus by the forward allowlist
+func (b *Bus) deliver(ctx context.Context, t emitTarget, e Event) error {
+	t.deliver(ctx, e)
+
+	if b.forward != nil && b.forward.MatchString(e.Topic) {
+		topic := e.Topic
+		e.Topic, e.Seq = b.prefix+e.Topic, 0
+		if err := b.parent.receive(ctx, e); err != nil {
+			return fmt.Errorf("bus: topic(%s) forward failed: %w", topic, err)
+		}
+	}
+	return nil
+}
+
+// autoCommit returns the commit func of the handler in CommitAuto mode
+func (b *Bus) autoCommit(h Handler) func(ctx context.Context, e Event) {
+	if h.Commit != CommitAuto || b.offsets == nil {
+		return nil
+	}
+
+	key, offsetKey, offsets, warn := h.key, h.offsetKey(), b.offsets, b.warn
+	return func(ctx context.Context, e Event) {
+		if e.Seq == 0 {
+			return
+		}
+		if err := offsets.Commit(offsetKey, e.Seq); err != nil {
+			warn(ctx, e.Topic, fmt.Sprintf("handler(%s) offset(%d) commit failed: %s", key, e.Seq, err))
+		}
+	}
+}
+
+// hold buffers the live events of the durable handler during its catch up,
+// returns the last stored seq to catch up to; must be called with the lock
+func (b *Bus) hold(h Handler) (uint64, bool, error) {
+	if h.Commit == CommitNone {
+		return 0, false, nil
+	}
+	if b.store == nil || b.offsets == nil {
+		return 0, false, fmt.Errorf("handler(%s) catch up skipped: event and offset stores are not configured", h.key)
+	}
+	last := b.store.LastSeq()
+	if !h.state.hold(last) {
+		return 0, false, fmt.Errorf("handler(%s) catch up skipped: handler is paused", h.key)
+	}
+	return last, true, nil
+}
+
+// catchUp delivers the stored events after the committed offset up to the
+// last seq and then the buffered live events to the held handler; the live
+// events over the buffer size are re-read from the store, the events are
+// limited to the granted topics when not nil
+func (b *Bus) catchUp(h Handler, last uint64, granted map[string]struct{}) {
+	ctx := context.Background()
+	defer func() {
+		if h.state.release() {
+			h.resume()
+		}
+	}()
+
+	offset, err := b.offsets.Offset(h.offsetKey())
+	if err != nil {
+		b.warn(ctx, empty, fmt.Sprintf("handler(%s) catch up failed: %s", h.key, err))
+		return
+	}
+
+	matcher, err := regexp.Compile(h.Matcher)
+	if err != nil {
+		b.warn(ctx, empty, fmt.Sprintf("handler(%s) catch up failed: matcher(%s) is invalid: %s", h.key, h.Matcher, err))
+		return
+	}
+
+	// the buffered events delivered before a re-read
+	var delivered map[uint64]struct{}
+	from := offset + 1
+	for {
+		err = b.store.Read(from, func(e Event) error {
+			if e.Seq > last {
+				return errCaughtUp
+			}
+			if _, ok := delivered[e.Seq]; ok {
+				return nil
+			}
+			if !matcher.MatchString(e.Topic) || !h.accepts(e) {
+				return nil
+			}
+			if _, ok := granted[e.Topic]; granted != nil && !ok {
+				return nil
+			}
+
+			e, err := b.Upcast(e)
+			if err != nil {
+				return err
+			}
+			h.dispatch(ctx, e)
+			return nil
+		})
+		if err != nil && !errors.Is(err, errCaughtUp) {
+			b.warn(ctx, empty, fmt.Sprintf("handler(%s) catch up failed: %s", h.key, err))
+			return
+		}
+
+		from, delivered = last+1, make(map[uint64]struct{})
+		for {
+			p, reread, more := h.state.nextHeld(b.store.LastSeq)
+			if !more {
+				return
+			}
+			if reread != 0 {
+				last = reread
+				break
+			}
+			delivered[p.e.Seq] = struct{}{}
+			h.dispatch(p.ctx, p.e)
+		}
+	}
+}
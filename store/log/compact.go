@@ -0,0 +1,190 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package log
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/mustafaturan/bus/v3"
+)
+
+const compactExt = ".compact"
+
+var errNotCompacted = errors.New("log: compacted topics are not configured")
+
+type compactionKey struct {
+	topic string
+	key   string
+}
+
+// Compact rewrites the sealed segments keeping only the latest event of each
+// topic and key of the compacted topics, the tombstones older than the
+// tombstone retention are dropped as well; returns the number of the dropped
+// events
+//
+// The active segment is not compacted but its events count as the latest.
+// The appends and the reads are not blocked while the segments are rewritten.
+func (l *Log) Compact() (int, error) {
+	if l.compacted == nil {
+		return 0, errNotCompacted
+	}
+
+	l.compactMutex.Lock()
+	defer l.compactMutex.Unlock()
+
+	views, err := l.views()
+	if err != nil {
+		return 0, err
+	}
+	defer closeViews(views)
+
+	latest := make(map[compactionKey]uint64)
+	for _, v := range views {
+		err := v.scan(0, func(seq uint64, _ int64, env []byte) error {
+			e, _, err := bus.UnmarshalEventMeta(env)
+			if err != nil {
+				return err
+			}
+			if e.Key != "" && l.compacted.MatchString(e.Topic) {
+				latest[compactionKey{topic: e.Topic, key: e.Key}] = seq
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	expiry := unixNano(l.config.Clock.Now().Add(-l.config.TombstoneRetention))
+	keep := func(seq uint64, occurredAt int64, env []byte) (bool, error) {
+		e, hasData, err := bus.UnmarshalEventMeta(env)
+		if err != nil {
+			return false, err
+		}
+		if e.Key == "" || !l.compacted.MatchString(e.Topic) {
+			return true, nil
+		}
+		if latest[compactionKey{topic: e.Topic, key: e.Key}] != seq {
+			return false, nil
+		}
+		expired := l.config.TombstoneRetention > 0 && occurredAt < expiry
+		return hasData || !expired, nil
+	}
+
+	var (
+		compacted []*segment
+		dropped   int
+	)
+	for _, v := range views[:len(views)-1] {
+		s, n, err := l.compactSegment(v, keep)
+		if err != nil {
+			removeCompacted(compacted)
+			return 0, err
+		}
+		if n > 0 {
+			compacted = append(compacted, s)
+			dropped += n
+		}
+	}
+
+	return dropped, l.swap(compacted)
+}
+
+// compactSegment writes the kept records of the segment to a compact file,
+// returns the compacted segment and the number of the dropped records
+func (l *Log) compactSegment(v view, keep func(seq uint64, occurredAt int64, env []byte) (bool, error)) (*segment, int, error) {
+	s := &segment{
+		base:      v.base,
+		last:      v.base - 1,
+		logPath:   v.path + compactExt,
+		indexPath: v.path + compactExt + indexExt,
+	}
+	f, err := os.Create(s.logPath)
+	if err != nil {
+		return nil, 0, fmt.Errorf("log: segment(%s) create failed: %w", s.logPath, err)
+	}
+
+	var dropped int
+	w := bufio.NewWriter(f)
+	err = v.scan(0, func(seq uint64, occurredAt int64, env []byte) error {
+		ok, err := keep(seq, occurredAt, env)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			dropped++
+			return nil
+		}
+
+		record := encodeRecord(seq, occurredAt, env)
+		if _, err := w.Write(record); err != nil {
+			return fmt.Errorf("log: segment(%s) write failed: %w", s.logPath, err)
+		}
+		s.track(seq, occurredAt, s.size, int64(len(record)), l.config.IndexInterval)
+		return nil
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && dropped > 0 {
+		err = s.writeIndex()
+	}
+
+	if err != nil || dropped == 0 {
+		_ = s.remove()
+		return nil, 0, err
+	}
+	return s, dropped, nil
+}
+
+// swap replaces the sealed segments with their compacted versions; the
+// segments dropped by the retention meanwhile are skipped
+func (l *Log) swap(compacted []*segment) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for i, c := range compacted {
+		var target *segment
+		for _, s := range l.segments[:len(l.segments)-1] {
+			if s.base == c.base {
+				target = s
+				break
+			}
+		}
+		if target == nil {
+			_ = c.remove()
+			continue
+		}
+
+		if err := os.Rename(c.logPath, target.logPath); err != nil {
+			removeCompacted(compacted[i:])
+			return fmt.Errorf("log: segment(%s) replace failed: %w", target.logPath, err)
+		}
+		_ = os.Remove(c.indexPath)
+
+		target.last, target.size, target.lastPos, target.maxTime = c.last, c.size, c.lastPos, c.maxTime
+		target.index = c.index
+		if err := target.writeIndex(); err != nil {
+			removeCompacted(compacted[i+1:])
+			return err
+		}
+	}
+	return nil
+}
+
+func removeCompacted(segments []*segment) {
+	for _, s := range segments {
+		_ = s.remove()
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package log_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mustafaturan/bus/v3"
+	"github.com/mustafaturan/bus/v3/store/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const topicOrderShipped = "order.shipped"
+
+func TestCompact(t *testing.T) {
+	dir := t.TempDir()
+	clock := &fakeClock{now: epoch}
+	c := log.Config{SegmentSize: 300, IndexInterval: 100, Clock: clock, Compacted: "^order\\.", TombstoneRetention: time.Hour}
+	l := openLog(t, dir, c)
+
+	appends := []bus.Event{
+		{ID: "1", Key: "a", Data: fakeOrder{ID: "a1"}},
+		{ID: "2", Key: "b", Data: fakeOrder{ID: "b1"}},
+		{ID: "3", Data: fakeOrder{ID: "unkeyed"}},
+		{ID: "4", Key: "a", Data: fakeOrder{ID: "a2"}},
+		{ID: "5", Key: "c", Data: fakeOrder{ID: "c1"}},
+		{ID: "6", Key: "b"},
+		{ID: "7", Key: "a", Topic: topicOrderShipped, Data: fakeOrder{ID: "shipped"}},
+		{ID: "8", Key: "c", Data: fakeOrder{ID: "c2"}},
+		{ID: "9", Key: "a", Data: fakeOrder{ID: "a3"}},
+	}
+	for _, e := range appends {
+		if e.Topic == "" {
+			e.Topic = topicOrderCreated
+		}
+		e.OccurredAt = epoch
+		_, err := l.Append(e)
+		require.Nil(t, err)
+	}
+	require.Greater(t, l.Segments(), 2)
+
+	t.Run("keeps the latest event per key", func(t *testing.T) {
+		dropped, err := l.Compact()
+		require.Nil(t, err)
+		assert.Equal(t, 4, dropped)
+
+		assert.Equal(t, []string{"3", "6", "7", "8", "9"}, compactedIDs(t, l, 1))
+		assert.Equal(t, []string{"6", "7", "8", "9"}, compactedIDs(t, l, 4))
+		assert.Equal(t, uint64(9), l.LastSeq())
+	})
+
+	t.Run("is idempotent", func(t *testing.T) {
+		dropped, err := l.Compact()
+		require.Nil(t, err)
+		assert.Equal(t, 0, dropped)
+	})
+
+	t.Run("drops expired tombstones", func(t *testing.T) {
+		clock.now = epoch.Add(2 * time.Hour)
+		dropped, err := l.Compact()
+		require.Nil(t, err)
+		assert.Equal(t, 1, dropped)
+		assert.Equal(t, []string{"3", "7", "8", "9"}, compactedIDs(t, l, 1))
+	})
+
+	t.Run("survives reopen", func(t *testing.T) {
+		require.Nil(t, l.Close())
+		l = openLog(t, dir, c)
+		defer l.Close()
+
+		assert.Equal(t, uint64(9), l.LastSeq())
+		assert.Equal(t, []string{"3", "7", "8", "9"}, compactedIDs(t, l, 1))
+
+		_, err := l.Append(bus.Event{ID: "10", Topic: topicOrderCreated, Data: fakeOrder{ID: "10"}})
+		require.Nil(t, err)
+		assert.Equal(t, []string{"3", "7", "8", "9", "10"}, compactedIDs(t, l, 1))
+	})
+}
+
+func TestCompactTopics(t *testing.T) {
+	t.Run("keeps the other topics", func(t *testing.T) {
+		l := openLog(t, t.TempDir(), log.Config{SegmentSize: 100, Compacted: "^order\\.created$"})
+		defer l.Close()
+
+		for i, topic := range []string{topicOrderCreated, topicOrderShipped, topicOrderCreated, topicOrderShipped, topicOrderCreated} {
+			_, err := l.Append(bus.Event{ID: fmt.Sprint(i + 1), Key: "a", Topic: topic, Data: fakeOrder{ID: "a"}})
+			require.Nil(t, err)
+		}
+
+		dropped, err := l.Compact()
+		require.Nil(t, err)
+		assert.Equal(t, 2, dropped)
+		assert.Equal(t, []string{"2", "4", "5"}, compactedIDs(t, l, 1))
+	})
+
+	t.Run("without compacted topics", func(t *testing.T) {
+		l := openLog(t, t.TempDir(), log.Config{})
+		defer l.Close()
+
+		_, err := l.Compact()
+		assert.EqualError(t, err, "log: compacted topics are not configured")
+	})
+
+	t.Run("with invalid compacted topics", func(t *testing.T) {
+		_, err := log.Open(t.TempDir(), log.Config{Codec: bus.JSONCodec{}, Types: bus.NewTypeRegistry(), Compacted: "["})
+		assert.EqualError(t, err, "log: compacted topics([) are invalid: error parsing regexp: missing closing ]: `[`")
+	})
+}
+
+func TestCompactLeftovers(t *testing.T) {
+	dir := t.TempDir()
+	l := openLog(t, dir, log.Config{})
+	appendOrders(t, l, 1, 2)
+	require.Nil(t, l.Close())
+
+	leftover := filepath.Join(dir, "00000000000000000001.log.compact")
+	require.Nil(t, ioutil.WriteFile(leftover, []byte("torn"), 0o644))
+
+	l = openLog(t, dir, log.Config{})
+	defer l.Close()
+	assert.NoFileExists(t, leftover)
+	assert.Equal(t, orderIDs(1, 2), readIDs(t, l, 1))
+}
+
+func TestCompactBootstrap(t *testing.T) {
+	l := openLog(t, t.TempDir(), log.Config{SegmentSize: 200, Compacted: topicOrderCreated})
+	defer l.Close()
+
+	b, err := bus.NewBus(bus.Next(func() string { return "fakeid" }), bus.WithEventStore(l))
+	require.Nil(t, err)
+	b.RegisterTopicWithOpts(topicOrderCreated,
+		bus.WithPayloadType(fakeOrder{}),
+		bus.WithKeyFunc(func(e bus.Event) string { return e.Data.(fakeOrder).ID }),
+	)
+
+	ctx := context.Background()
+	for _, id := range []string{"1", "2", "1", "3", "2", "1"} {
+		require.Nil(t, b.Emit(ctx, topicOrderCreated, fakeOrder{ID: id}))
+	}
+	require.Nil(t, b.EmitWithOpts(ctx, topicOrderCreated, nil, bus.WithKey("3")))
+	require.Nil(t, b.Emit(ctx, topicOrderCreated, fakeOrder{ID: "4"}))
+
+	_, err = l.Compact()
+	require.Nil(t, err)
+
+	state := make(map[string]uint64)
+	require.Nil(t, b.Replay(ctx, 1, topicOrderCreated, func(_ context.Context, e bus.Event) {
+		if e.IsTombstone() {
+			delete(state, e.Key)
+			return
+		}
+		state[e.Key] = e.Seq
+	}))
+	assert.Equal(t, map[string]uint64{"1": 6, "2": 5, "4": 8}, state)
+}
+
+// compactedIDs reads the ids without matching the payloads, the compacted
+// events have tombstones and the payload ids differ
+func compactedIDs(t *testing.T, l *log.Log, from uint64) []string {
+	ids := make([]string, 0)
+	require.Nil(t, l.Read(from, func(e bus.Event) error {
+		ids = append(ids, e.ID)
+		return nil
+	}))
+	return ids
+}
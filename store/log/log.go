@@ -0,0 +1,449 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+/*
+Package log provides a segmented append only log storing the bus events; the
+Log implements bus.EventStore
+
+The events are written as CRC checked records to segment files which are
+rotated by size. Each segment has a sparse index of the record positions by
+sequence number and OccurredAt, so the reads seek close to the first record
+instead of scanning the segment:
+
+	<dir>/00000000000000000001.log   records of the seqs 1..N
+	<dir>/00000000000000000001.idx   sparse index of the segment
+	<dir>/0000000000000000000N+1.log active segment
+
+A record is the little endian payload length and the CRC-32C of the payload
+followed by the payload: the seq, the OccurredAt in unix nanoseconds and the
+event envelope. On open, the records of the active segment are verified and a
+torn or corrupted tail, i.e. from a crash in the middle of a write, is
+truncated. The sealed segments are dropped by the time and size retention.
+
+The sealed segments can be compacted to keep only the latest event of each
+topic and event key, the events without a key are kept as is. The seqs of the
+compacted segments have gaps but stay in order.
+*/
+package log
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mustafaturan/bus/v3"
+)
+
+const (
+	// DefaultSegmentSize is the default size of a segment before rotation
+	DefaultSegmentSize = 64 << 20
+
+	// DefaultIndexInterval is the default number of bytes between the index
+	// entries of a segment
+	DefaultIndexInterval = 4 << 10
+
+	segmentExt = ".log"
+	indexExt   = ".idx"
+)
+
+var (
+	// ErrCorrupted is returned on reading a record failing the CRC check
+	ErrCorrupted = errors.New("log: record is corrupted")
+
+	// ErrClosed is returned on appending to a closed log
+	ErrClosed = errors.New("log: closed")
+)
+
+type (
+	// Config holds the log options
+	Config struct {
+		Codec bus.Codec         // payload codec
+		Types *bus.TypeRegistry // payload types of the topics
+
+		SegmentSize   int64 // rotates the active segment over the size
+		IndexInterval int64 // bytes between the index entries
+
+		Retention     time.Duration // drops the segments older than, optional
+		RetentionSize int64         // drops the oldest segments over, optional
+		Clock         bus.Clock     // retention clock, defaults to bus.SystemClock
+
+		// topics compacted by Compact as regex pattern, optional; the
+		// events of the other topics are kept, so the event sourced streams
+		// of the es package must not match it
+		Compacted string
+
+		// drops the compacted tombstones older than, optional
+		TombstoneRetention time.Duration
+	}
+
+	// Log is a segmented append only event log
+	Log struct {
+		dir    string
+		config Config
+
+		compactMutex sync.Mutex     // runs one compaction at a time
+		compacted    *regexp.Regexp // compacted topics, nil when none
+
+		mutex    sync.RWMutex
+		segments []*segment // in seq order, the last one is active
+		last     uint64
+		closed   bool
+	}
+)
+
+// Open opens the log in the directory creating it when missing and recovers
+// the active segment
+func Open(dir string, c Config) (*Log, error) {
+	if c.Codec == nil || c.Types == nil {
+		return nil, fmt.Errorf("log: codec and type registry can't be nil")
+	}
+	if c.SegmentSize <= 0 {
+		c.SegmentSize = DefaultSegmentSize
+	}
+	if c.IndexInterval <= 0 {
+		c.IndexInterval = DefaultIndexInterval
+	}
+	if c.Clock == nil {
+		c.Clock = bus.SystemClock
+	}
+	var compacted *regexp.Regexp
+	if c.Compacted != "" {
+		re, err := regexp.Compile(c.Compacted)
+		if err != nil {
+			return nil, fmt.Errorf("log: compacted topics(%s) are invalid: %w", c.Compacted, err)
+		}
+		compacted = re
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("log: dir(%s) create failed: %w", dir, err)
+	}
+
+	bases, err := segmentBases(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(bases) == 0 {
+		bases = []uint64{1}
+	}
+
+	l := &Log{dir: dir, config: c, compacted: compacted}
+	for i, base := range bases {
+		s := newSegment(dir, base)
+		if i < len(bases)-1 {
+			err = s.load(c.IndexInterval)
+		} else {
+			err = s.recover(c.IndexInterval)
+		}
+		if err != nil {
+			l.closeSegments()
+			return nil, err
+		}
+		l.segments = append(l.segments, s)
+	}
+	l.last = l.active().last
+
+	if err := l.retain(); err != nil {
+		l.closeSegments()
+		return nil, err
+	}
+	return l, nil
+}
+
+// Append writes the event to the active segment with the next seq, rotating
+// the segment when it is full
+func (l *Log) Append(e bus.Event) (bus.Event, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.closed {
+		return e, ErrClosed
+	}
+
+	if s := l.active(); s.size >= l.config.SegmentSize && !s.empty() {
+		if err := l.roll(); err != nil {
+			return e, err
+		}
+	}
+
+	e.Seq = l.last + 1
+	env, err := bus.MarshalEvent(l.config.Codec, e)
+	if err != nil {
+		return e, err
+	}
+	if err := l.active().append(e.Seq, unixNano(e.OccurredAt), env, l.config.IndexInterval); err != nil {
+		return e, err
+	}
+
+	l.last = e.Seq
+	return e, nil
+}
+
+// AppendBatch writes the events to the active segment with the next seqs in a
+// single write, rotating the segment before the batch when it is full
+func (l *Log) AppendBatch(events []bus.Event) ([]bus.Event, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.closed {
+		return events, ErrClosed
+	}
+
+	if s := l.active(); s.size >= l.config.SegmentSize && !s.empty() {
+		if err := l.roll(); err != nil {
+			return events, err
+		}
+	}
+
+	stored := make([]bus.Event, len(events))
+	records := make([]batchRecord, len(events))
+	for i, e := range events {
+		e.Seq = l.last + uint64(i) + 1
+		env, err := bus.MarshalEvent(l.config.Codec, e)
+		if err != nil {
+			return events, err
+		}
+		occurredAt := unixNano(e.OccurredAt)
+		records[i] = batchRecord{seq: e.Seq, occurredAt: occurredAt, data: encodeRecord(e.Seq, occurredAt, env)}
+		stored[i] = e
+	}
+	if err := l.active().appendBatch(records, l.config.IndexInterval); err != nil {
+		return events, err
+	}
+
+	l.last += uint64(len(events))
+	return stored, nil
+}
+
+// Read calls fn with the events from the seq in seq order until fn returns an
+// error; the events dropped by the retention are skipped
+func (l *Log) Read(from uint64, fn func(e bus.Event) error) error {
+	return l.read(
+		func(v view) (int64, bool) { return v.seekSeq(from) },
+		func(seq uint64, _ int64) bool { return seq >= from },
+		fn,
+	)
+}
+
+// ReadSince calls fn with the events occurred at or after the time in seq
+// order until fn returns an error
+func (l *Log) ReadSince(t time.Time, fn func(e bus.Event) error) error {
+	since := unixNano(t)
+	return l.read(
+		func(v view) (int64, bool) { return v.seekTime(since) },
+		func(_ uint64, occurredAt int64) bool { return occurredAt >= since },
+		fn,
+	)
+}
+
+// FirstSeq returns the seq of the first retained event
+func (l *Log) FirstSeq() uint64 {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	return l.segments[0].base
+}
+
+// LastSeq returns the seq of the last appended event, 0 when empty
+func (l *Log) LastSeq() uint64 {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	return l.last
+}
+
+// Segments returns the number of the segments
+func (l *Log) Segments() int {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	return len(l.segments)
+}
+
+// Retain drops the sealed segments out of the retention; it also runs on
+// open and on each rotation
+func (l *Log) Retain() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.retain()
+}
+
+// Sync flushes the active segment to the disk
+func (l *Log) Sync() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.closed {
+		return ErrClosed
+	}
+	return l.active().sync()
+}
+
+// Close syncs and closes the active segment
+func (l *Log) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+
+	err := l.active().sync()
+	if cerr := l.active().close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (l *Log) active() *segment {
+	return l.segments[len(l.segments)-1]
+}
+
+// roll seals the active segment and starts a new one
+func (l *Log) roll() error {
+	if err := l.active().seal(); err != nil {
+		return err
+	}
+
+	s := newSegment(l.dir, l.last+1)
+	if err := s.recover(l.config.IndexInterval); err != nil {
+		return err
+	}
+	l.segments = append(l.segments, s)
+
+	return l.retain()
+}
+
+// retain drops the oldest sealed segments while they are older than the
+// retention or the total size is over the retention size
+func (l *Log) retain() error {
+	var total int64
+	for _, s := range l.segments {
+		total += s.size
+	}
+	expiry := unixNano(l.config.Clock.Now().Add(-l.config.Retention))
+
+	for len(l.segments) > 1 {
+		s := l.segments[0]
+		expired := l.config.Retention > 0 && s.maxTime < expiry
+		oversized := l.config.RetentionSize > 0 && total > l.config.RetentionSize
+		if !expired && !oversized {
+			return nil
+		}
+
+		if err := s.remove(); err != nil {
+			return err
+		}
+		total -= s.size
+		l.segments = l.segments[1:]
+	}
+	return nil
+}
+
+// read scans the segments from the seek position calling fn with the kept
+// events
+func (l *Log) read(seek func(v view) (int64, bool), keep func(seq uint64, occurredAt int64) bool, fn func(e bus.Event) error) error {
+	views, err := l.views()
+	if err != nil {
+		return err
+	}
+	defer closeViews(views)
+
+	for _, v := range views {
+		pos, ok := seek(v)
+		if !ok {
+			continue
+		}
+
+		err := v.scan(pos, func(seq uint64, occurredAt int64, env []byte) error {
+			if !keep(seq, occurredAt) {
+				return nil
+			}
+			e, err := bus.UnmarshalEvent(l.config.Codec, l.config.Types, env)
+			if err != nil {
+				return err
+			}
+			return fn(e)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// views opens the segments for a read
+func (l *Log) views() ([]view, error) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	views := make([]view, 0, len(l.segments))
+	for _, s := range l.segments {
+		v, err := s.view()
+		if err != nil {
+			closeViews(views)
+			return nil, err
+		}
+		views = append(views, v)
+	}
+	return views, nil
+}
+
+func closeViews(views []view) {
+	for _, v := range views {
+		_ = v.file.Close()
+	}
+}
+
+func (l *Log) closeSegments() {
+	for _, s := range l.segments {
+		_ = s.close()
+	}
+}
+
+// segmentBases returns the base seqs of the segment files in the directory
+func segmentBases(dir string) ([]uint64, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("log: dir(%s) read failed: %w", dir, err)
+	}
+
+	var bases []uint64
+	for _, f := range files {
+		name := f.Name()
+		// left over from a crashed compaction
+		if strings.Contains(name, compactExt) {
+			if err := os.Remove(filepath.Join(dir, name)); err != nil {
+				return nil, fmt.Errorf("log: file(%s) remove failed: %w", name, err)
+			}
+			continue
+		}
+		if f.IsDir() || filepath.Ext(name) != segmentExt {
+			continue
+		}
+		base, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		bases = append(bases, base)
+	}
+	sort.Slice(bases, func(i, j int) bool { return bases[i] < bases[j] })
+	return bases, nil
+}
+
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
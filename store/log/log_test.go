@@ -0,0 +1,350 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package log_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mustafaturan/bus/v3"
+	"github.com/mustafaturan/bus/v3/store/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const topicOrderCreated = "order.created"
+
+type (
+	fakeOrder struct{ ID string }
+
+	fakeClock struct{ now time.Time }
+)
+
+var epoch = time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestOpen(t *testing.T) {
+	t.Run("with nil codec", func(t *testing.T) {
+		_, err := log.Open(t.TempDir(), log.Config{Types: bus.NewTypeRegistry()})
+		assert.EqualError(t, err, "log: codec and type registry can't be nil")
+	})
+
+	t.Run("with empty dir", func(t *testing.T) {
+		l := openLog(t, t.TempDir(), log.Config{})
+		defer l.Close()
+
+		assert.Equal(t, uint64(0), l.LastSeq())
+		assert.Equal(t, uint64(1), l.FirstSeq())
+		assert.Empty(t, readIDs(t, l, 1))
+	})
+}
+
+func TestAppendRead(t *testing.T) {
+	l := openLog(t, t.TempDir(), log.Config{SegmentSize: 400, IndexInterval: 100})
+	defer l.Close()
+	appendOrders(t, l, 1, 20)
+
+	assert.Equal(t, uint64(20), l.LastSeq())
+	assert.Greater(t, l.Segments(), 2)
+
+	t.Run("reads from the start", func(t *testing.T) {
+		assert.Equal(t, orderIDs(1, 20), readIDs(t, l, 1))
+	})
+
+	t.Run("reads from the seq", func(t *testing.T) {
+		for from := 1; from <= 21; from++ {
+			assert.Equal(t, orderIDs(from, 20), readIDs(t, l, uint64(from)))
+		}
+	})
+
+	t.Run("stops on fn error", func(t *testing.T) {
+		stop := errors.New("stop")
+		var n int
+		err := l.Read(1, func(bus.Event) error {
+			n++
+			if n == 3 {
+				return stop
+			}
+			return nil
+		})
+		assert.Equal(t, stop, err)
+		assert.Equal(t, 3, n)
+	})
+
+	t.Run("rejects appends after close", func(t *testing.T) {
+		require.Nil(t, l.Close())
+		_, err := l.Append(bus.Event{Topic: topicOrderCreated})
+		assert.Equal(t, log.ErrClosed, err)
+		assert.Len(t, readIDs(t, l, 1), 20)
+	})
+}
+
+func TestAppendBatch(t *testing.T) {
+	l := openLog(t, t.TempDir(), log.Config{SegmentSize: 400, IndexInterval: 100})
+	defer l.Close()
+	appendOrders(t, l, 1, 5)
+
+	events, err := l.AppendBatch([]bus.Event{
+		{ID: "6", Topic: topicOrderCreated, OccurredAt: epoch, Data: fakeOrder{ID: "6"}},
+		{ID: "7", Topic: topicOrderCreated, OccurredAt: epoch, Data: fakeOrder{ID: "7"}},
+	})
+	require.Nil(t, err)
+	assert.Equal(t, uint64(6), events[0].Seq)
+	assert.Equal(t, uint64(7), events[1].Seq)
+	appendOrders(t, l, 8, 20)
+
+	assert.Equal(t, orderIDs(1, 20), readIDs(t, l, 1))
+	assert.Equal(t, orderIDs(7, 20), readIDs(t, l, 7))
+
+	t.Run("with failing event", func(t *testing.T) {
+		_, err := l.AppendBatch([]bus.Event{
+			{ID: "21", Topic: topicOrderCreated, Data: fakeOrder{ID: "21"}},
+			{ID: "22", Topic: topicOrderCreated, Data: make(chan int)},
+		})
+		assert.NotNil(t, err)
+		assert.Equal(t, uint64(20), l.LastSeq())
+		assert.Equal(t, orderIDs(1, 20), readIDs(t, l, 1))
+	})
+}
+
+func TestReadSince(t *testing.T) {
+	l := openLog(t, t.TempDir(), log.Config{SegmentSize: 400, IndexInterval: 100})
+	defer l.Close()
+
+	for i := 1; i <= 20; i++ {
+		occurredAt := epoch.Add(time.Duration(i) * time.Minute)
+		// a late event out of the time order
+		if i == 15 {
+			occurredAt = epoch
+		}
+		_, err := l.Append(bus.Event{ID: fmt.Sprint(i), Topic: topicOrderCreated, OccurredAt: occurredAt, Data: fakeOrder{}})
+		require.Nil(t, err)
+	}
+
+	var got []string
+	require.Nil(t, l.ReadSince(epoch.Add(10*time.Minute), func(e bus.Event) error {
+		got = append(got, e.ID)
+		return nil
+	}))
+	assert.Equal(t, []string{"10", "11", "12", "13", "14", "16", "17", "18", "19", "20"}, got)
+}
+
+func TestReopen(t *testing.T) {
+	dir := t.TempDir()
+	c := log.Config{SegmentSize: 400, IndexInterval: 100}
+
+	l := openLog(t, dir, c)
+	appendOrders(t, l, 1, 10)
+	require.Nil(t, l.Close())
+
+	t.Run("continues the seqs", func(t *testing.T) {
+		l = openLog(t, dir, c)
+		assert.Equal(t, uint64(10), l.LastSeq())
+		appendOrders(t, l, 11, 15)
+		require.Nil(t, l.Close())
+	})
+
+	t.Run("rebuilds missing and corrupted indexes", func(t *testing.T) {
+		indexes, err := filepath.Glob(filepath.Join(dir, "*.idx"))
+		require.Nil(t, err)
+		require.Greater(t, len(indexes), 2)
+		require.Nil(t, os.Remove(indexes[0]))
+		require.Nil(t, ioutil.WriteFile(indexes[1], []byte{1, 2, 3}, 0o644))
+
+		l = openLog(t, dir, c)
+		defer l.Close()
+		assert.Equal(t, uint64(15), l.LastSeq())
+		assert.Equal(t, orderIDs(1, 15), readIDs(t, l, 1))
+		assert.Equal(t, orderIDs(7, 15), readIDs(t, l, 7))
+	})
+}
+
+func TestRetention(t *testing.T) {
+	t.Run("by size", func(t *testing.T) {
+		l := openLog(t, t.TempDir(), log.Config{SegmentSize: 400, RetentionSize: 1000})
+		defer l.Close()
+		appendOrders(t, l, 1, 30)
+
+		first := l.FirstSeq()
+		assert.Greater(t, first, uint64(1))
+		assert.Equal(t, orderIDs(int(first), 30), readIDs(t, l, 1))
+	})
+
+	t.Run("by time", func(t *testing.T) {
+		clock := &fakeClock{now: epoch}
+		l := openLog(t, t.TempDir(), log.Config{SegmentSize: 400, Retention: time.Hour, Clock: clock})
+		defer l.Close()
+		appendOrders(t, l, 1, 20)
+		segments := l.Segments()
+
+		clock.now = epoch.Add(2 * time.Hour)
+		require.Nil(t, l.Retain())
+		assert.Equal(t, 1, l.Segments())
+		assert.Less(t, 1, segments)
+		assert.Equal(t, uint64(20), l.LastSeq())
+
+		appendOrders(t, l, 21, 21)
+		assert.Equal(t, orderIDs(int(l.FirstSeq()), 21), readIDs(t, l, 1))
+	})
+}
+
+func TestTornWrite(t *testing.T) {
+	dir := t.TempDir()
+	l := openLog(t, dir, log.Config{})
+	appendOrders(t, l, 1, 2)
+	require.Nil(t, l.Close())
+	intact := segmentFile(t, dir, 0)
+
+	l = openLog(t, dir, log.Config{})
+	appendOrders(t, l, 3, 3)
+	require.Nil(t, l.Close())
+	full := segmentFile(t, dir, 0)
+
+	// crash at each byte of the last record write
+	for cut := len(intact) + 1; cut < len(full); cut++ {
+		crashed := copyDir(t, dir)
+		writeSegmentFile(t, crashed, 0, full[:cut])
+
+		l := openLog(t, crashed, log.Config{})
+		require.Equal(t, uint64(2), l.LastSeq(), "cut at %d", cut)
+		appendOrders(t, l, 3, 3)
+		require.Equal(t, orderIDs(1, 3), readIDs(t, l, 1), "cut at %d", cut)
+		require.Nil(t, l.Close())
+	}
+}
+
+func TestCorruption(t *testing.T) {
+	t.Run("truncates the corrupted tail of the active segment", func(t *testing.T) {
+		dir := t.TempDir()
+		l := openLog(t, dir, log.Config{})
+		appendOrders(t, l, 1, 3)
+		require.Nil(t, l.Close())
+
+		data := segmentFile(t, dir, 0)
+		data[len(data)-2] ^= 0xff
+		writeSegmentFile(t, dir, 0, data)
+
+		l = openLog(t, dir, log.Config{})
+		defer l.Close()
+		assert.Equal(t, uint64(2), l.LastSeq())
+		assert.Equal(t, orderIDs(1, 2), readIDs(t, l, 1))
+	})
+
+	t.Run("fails the reads of a corrupted sealed segment", func(t *testing.T) {
+		dir := t.TempDir()
+		l := openLog(t, dir, log.Config{SegmentSize: 400})
+		appendOrders(t, l, 1, 20)
+		require.Nil(t, l.Close())
+
+		data := segmentFile(t, dir, 0)
+		data[len(data)/2] ^= 0xff
+		writeSegmentFile(t, dir, 0, data)
+
+		l = openLog(t, dir, log.Config{SegmentSize: 400})
+		defer l.Close()
+		assert.Equal(t, uint64(20), l.LastSeq())
+
+		err := l.Read(1, func(bus.Event) error { return nil })
+		assert.True(t, errors.Is(err, log.ErrCorrupted), err)
+	})
+}
+
+func TestEventStore(t *testing.T) {
+	l := openLog(t, t.TempDir(), log.Config{})
+	defer l.Close()
+
+	b, err := bus.NewBus(bus.Next(func() string { return "fakeid" }), bus.WithEventStore(l))
+	require.Nil(t, err)
+	b.RegisterTopics(topicOrderCreated)
+
+	ctx := context.Background()
+	require.Nil(t, b.EmitWithOpts(ctx, topicOrderCreated, fakeOrder{ID: "1"}, bus.WithID("1")))
+	require.Nil(t, b.EmitWithOpts(ctx, topicOrderCreated, fakeOrder{ID: "2"}, bus.WithID("2")))
+	assert.Equal(t, []string{"1", "2"}, readIDs(t, l, 1))
+}
+
+func openLog(t *testing.T, dir string, c log.Config) *log.Log {
+	types := bus.NewTypeRegistry()
+	types.Register(topicOrderCreated, fakeOrder{})
+	types.Register(topicOrderShipped, fakeOrder{})
+	c.Codec, c.Types = bus.JSONCodec{}, types
+
+	l, err := log.Open(dir, c)
+	require.Nil(t, err)
+	return l
+}
+
+func appendOrders(t *testing.T, l *log.Log, from, to int) {
+	for i := from; i <= to; i++ {
+		e, err := l.Append(bus.Event{
+			ID:         fmt.Sprint(i),
+			Topic:      topicOrderCreated,
+			OccurredAt: epoch,
+			Data:       fakeOrder{ID: fmt.Sprint(i)},
+		})
+		require.Nil(t, err)
+		require.Equal(t, uint64(i), e.Seq)
+	}
+}
+
+func readIDs(t *testing.T, l *log.Log, from uint64) []string {
+	ids := make([]string, 0)
+	require.Nil(t, l.Read(from, func(e bus.Event) error {
+		require.Equal(t, e.ID, e.Data.(fakeOrder).ID)
+		ids = append(ids, e.ID)
+		return nil
+	}))
+	return ids
+}
+
+func orderIDs(from, to int) []string {
+	ids := make([]string, 0)
+	for i := from; i <= to; i++ {
+		ids = append(ids, fmt.Sprint(i))
+	}
+	return ids
+}
+
+func segmentPath(t *testing.T, dir string, i int) string {
+	segments, err := filepath.Glob(filepath.Join(dir, "*.log"))
+	require.Nil(t, err)
+	require.Greater(t, len(segments), i)
+	return segments[i]
+}
+
+func segmentFile(t *testing.T, dir string, i int) []byte {
+	data, err := ioutil.ReadFile(segmentPath(t, dir, i))
+	require.Nil(t, err)
+	return data
+}
+
+func writeSegmentFile(t *testing.T, dir string, i int, data []byte) {
+	require.Nil(t, ioutil.WriteFile(segmentPath(t, dir, i), data, 0o644))
+}
+
+func copyDir(t *testing.T, dir string) string {
+	dst := t.TempDir()
+	files, err := ioutil.ReadDir(dir)
+	require.Nil(t, err)
+	for _, f := range files {
+		data, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		require.Nil(t, err)
+		require.Nil(t, ioutil.WriteFile(filepath.Join(dst, f.Name()), data, 0o644))
+	}
+	return dst
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) bus.Timer {
+	return time.AfterFunc(d, f)
+}
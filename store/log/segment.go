@@ -0,0 +1,463 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package log
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	recordHeaderSize = 8  // payload length and crc
+	recordMetaSize   = 16 // seq and occurredAt of the payload
+	indexEntrySize   = 24 // seq, occurredAt watermark and position
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+type (
+	// segment is a log file with its sparse index; only the active segment
+	// keeps its files open
+	segment struct {
+		base    uint64 // seq of the first record
+		last    uint64 // seq of the last record, base-1 when empty
+		size    int64
+		lastPos int64 // position of the last record
+		maxTime int64 // max occurredAt of the records
+
+		index      []indexEntry
+		indexDirty bool // index file is behind the index
+
+		logPath   string
+		indexPath string
+		log       *os.File
+		idx       *os.File
+	}
+
+	// indexEntry points to a record; the time is the max occurredAt of the
+	// records up to and including the record, so the entries are sorted by
+	// both seq and time
+	indexEntry struct {
+		seq  uint64
+		time int64
+		pos  int64
+	}
+
+	// batchRecord is an encoded record of a batch append
+	batchRecord struct {
+		seq        uint64
+		occurredAt int64
+		data       []byte
+	}
+
+	// view is a point in time snapshot of a segment for the reads
+	view struct {
+		file    *os.File
+		path    string
+		base    uint64
+		last    uint64
+		size    int64
+		maxTime int64
+		index   []indexEntry
+	}
+)
+
+func newSegment(dir string, base uint64) *segment {
+	name := fmt.Sprintf("%020d", base)
+	return &segment{
+		base:      base,
+		last:      base - 1,
+		logPath:   filepath.Join(dir, name+segmentExt),
+		indexPath: filepath.Join(dir, name+indexExt),
+	}
+}
+
+func (s *segment) empty() bool {
+	return s.last < s.base
+}
+
+// load loads a sealed segment from its index; the segment is scanned when the
+// index is missing or does not point to the last record
+func (s *segment) load(interval int64) error {
+	f, err := os.Open(s.logPath)
+	if err != nil {
+		return fmt.Errorf("log: segment(%s) open failed: %w", s.logPath, err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("log: segment(%s) stat failed: %w", s.logPath, err)
+	}
+
+	entries, err := readIndex(s.indexPath)
+	if err == nil && indexed(f, info.Size(), entries) {
+		s.index, s.size = entries, info.Size()
+		if n := len(entries); n > 0 {
+			s.last, s.lastPos, s.maxTime = entries[n-1].seq, entries[n-1].pos, entries[n-1].time
+		}
+		return nil
+	}
+
+	if _, err := s.scan(f, info.Size(), interval); err != nil {
+		return err
+	}
+	// keep the corrupted records to fail the reads instead of skipping them
+	s.size = info.Size()
+	return s.writeIndex()
+}
+
+// recover opens the active segment for appends truncating the records after
+// the first torn or corrupted record
+func (s *segment) recover(interval int64) error {
+	f, err := os.OpenFile(s.logPath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("log: segment(%s) open failed: %w", s.logPath, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("log: segment(%s) stat failed: %w", s.logPath, err)
+	}
+
+	valid, err := s.scan(f, info.Size(), interval)
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	if valid < info.Size() {
+		if err := f.Truncate(valid); err != nil {
+			_ = f.Close()
+			return fmt.Errorf("log: segment(%s) truncate failed: %w", s.logPath, err)
+		}
+	}
+	s.log = f
+
+	if err := s.writeIndex(); err != nil {
+		_ = s.close()
+		return err
+	}
+	idx, err := os.OpenFile(s.indexPath, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		_ = s.close()
+		return fmt.Errorf("log: index(%s) open failed: %w", s.indexPath, err)
+	}
+	s.idx = idx
+	return nil
+}
+
+// scan rebuilds the segment state from the records, returns the size of the
+// valid records
+func (s *segment) scan(r io.Reader, size, interval int64) (int64, error) {
+	s.last, s.size, s.lastPos, s.maxTime, s.index = s.base-1, 0, 0, 0, nil
+
+	br := bufio.NewReader(r)
+	for {
+		seq, occurredAt, _, n, err := readRecord(br, size-s.size)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, ErrCorrupted) {
+			return s.size, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("log: segment(%s) read failed: %w", s.logPath, err)
+		}
+		// the seqs increase with gaps after the compaction
+		if seq <= s.last {
+			return s.size, nil
+		}
+
+		pos := s.size
+		s.track(seq, occurredAt, pos, n, interval)
+	}
+}
+
+// append writes the record to the end of the active segment
+func (s *segment) append(seq uint64, occurredAt int64, env []byte, interval int64) error {
+	record := encodeRecord(seq, occurredAt, env)
+	if _, err := s.log.Write(record); err != nil {
+		// drop the partially written record
+		_ = s.log.Truncate(s.size)
+		return fmt.Errorf("log: segment(%s) append failed: %w", s.logPath, err)
+	}
+
+	s.track(seq, occurredAt, s.size, int64(len(record)), interval)
+	return nil
+}
+
+// appendBatch writes the records to the end of the active segment in a single
+// write
+func (s *segment) appendBatch(records []batchRecord, interval int64) error {
+	var buf []byte
+	for _, r := range records {
+		buf = append(buf, r.data...)
+	}
+	if _, err := s.log.Write(buf); err != nil {
+		// drop the partially written records
+		_ = s.log.Truncate(s.size)
+		return fmt.Errorf("log: segment(%s) append failed: %w", s.logPath, err)
+	}
+
+	for _, r := range records {
+		s.track(r.seq, r.occurredAt, s.size, int64(len(r.data)), interval)
+	}
+	return nil
+}
+
+// track updates the segment state with the record at the position
+func (s *segment) track(seq uint64, occurredAt, pos, n, interval int64) {
+	s.last, s.lastPos, s.size = seq, pos, pos+n
+	if occurredAt > s.maxTime {
+		s.maxTime = occurredAt
+	}
+
+	if len(s.index) == 0 || pos-s.index[len(s.index)-1].pos >= interval {
+		s.addIndex(indexEntry{seq: seq, time: s.maxTime, pos: pos})
+	}
+}
+
+// addIndex appends the entry to the index and to the open index file; a
+// failed write is retried by rewriting the index file on seal
+func (s *segment) addIndex(entry indexEntry) {
+	s.index = append(s.index, entry)
+	if s.idx == nil || s.indexDirty {
+		return
+	}
+
+	var buf [indexEntrySize]byte
+	putIndexEntry(buf[:], entry)
+	if _, err := s.idx.Write(buf[:]); err != nil {
+		s.indexDirty = true
+	}
+}
+
+// seal indexes the last record, so the segment loads from its index, and
+// closes the files
+func (s *segment) seal() error {
+	if n := len(s.index); !s.empty() && (n == 0 || s.index[n-1].seq != s.last) {
+		s.addIndex(indexEntry{seq: s.last, time: s.maxTime, pos: s.lastPos})
+	}
+	if s.indexDirty {
+		if err := s.writeIndex(); err != nil {
+			return err
+		}
+		s.indexDirty = false
+	}
+
+	if err := s.sync(); err != nil {
+		return err
+	}
+	return s.close()
+}
+
+func (s *segment) sync() error {
+	if err := s.log.Sync(); err != nil {
+		return fmt.Errorf("log: segment(%s) sync failed: %w", s.logPath, err)
+	}
+	if err := s.idx.Sync(); err != nil {
+		return fmt.Errorf("log: index(%s) sync failed: %w", s.indexPath, err)
+	}
+	return nil
+}
+
+func (s *segment) close() error {
+	var err error
+	if s.log != nil {
+		err = s.log.Close()
+		s.log = nil
+	}
+	if s.idx != nil {
+		if cerr := s.idx.Close(); err == nil {
+			err = cerr
+		}
+		s.idx = nil
+	}
+	return err
+}
+
+func (s *segment) remove() error {
+	_ = s.close()
+	if err := os.Remove(s.logPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("log: segment(%s) remove failed: %w", s.logPath, err)
+	}
+	if err := os.Remove(s.indexPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("log: index(%s) remove failed: %w", s.indexPath, err)
+	}
+	return nil
+}
+
+// writeIndex replaces the index file with the index
+func (s *segment) writeIndex() error {
+	buf := make([]byte, len(s.index)*indexEntrySize)
+	for i, entry := range s.index {
+		putIndexEntry(buf[i*indexEntrySize:], entry)
+	}
+	if err := ioutil.WriteFile(s.indexPath, buf, 0o644); err != nil {
+		return fmt.Errorf("log: index(%s) write failed: %w", s.indexPath, err)
+	}
+	return nil
+}
+
+// view opens the segment file for a read; the reads are not affected by the
+// later retention or compaction of the segment
+func (s *segment) view() (view, error) {
+	f, err := os.Open(s.logPath)
+	if err != nil {
+		return view{}, fmt.Errorf("log: segment(%s) open failed: %w", s.logPath, err)
+	}
+
+	n := len(s.index)
+	return view{
+		file:    f,
+		path:    s.logPath,
+		base:    s.base,
+		last:    s.last,
+		size:    s.size,
+		maxTime: s.maxTime,
+		index:   s.index[:n:n],
+	}, nil
+}
+
+// seekSeq returns the position of the last indexed record at or before the
+// seq
+func (v view) seekSeq(seq uint64) (int64, bool) {
+	if v.last < v.base || v.last < seq {
+		return 0, false
+	}
+
+	i := sort.Search(len(v.index), func(i int) bool { return v.index[i].seq > seq }) - 1
+	if i < 0 {
+		return 0, true
+	}
+	return v.index[i].pos, true
+}
+
+// seekTime returns the position of the last indexed record before which all
+// the records occurred before the time
+func (v view) seekTime(t int64) (int64, bool) {
+	if v.last < v.base || v.maxTime < t {
+		return 0, false
+	}
+
+	i := sort.Search(len(v.index), func(i int) bool { return v.index[i].time >= t }) - 1
+	if i < 0 {
+		return 0, true
+	}
+	return v.index[i].pos, true
+}
+
+// scan calls fn with the records from the position up to the view size
+func (v view) scan(pos int64, fn func(seq uint64, occurredAt int64, env []byte) error) error {
+	r := bufio.NewReader(io.NewSectionReader(v.file, pos, v.size-pos))
+	for pos < v.size {
+		seq, occurredAt, env, n, err := readRecord(r, v.size-pos)
+		if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, ErrCorrupted) {
+			return fmt.Errorf("log: segment(%s) position(%d): %w", v.path, pos, ErrCorrupted)
+		}
+		if err != nil {
+			return fmt.Errorf("log: segment(%s) read failed: %w", v.path, err)
+		}
+		if err := fn(seq, occurredAt, env); err != nil {
+			return err
+		}
+		pos += n
+	}
+	return nil
+}
+
+// indexed tells whether the last index entry points to the last record of the
+// segment file
+func indexed(f *os.File, size int64, entries []indexEntry) bool {
+	if len(entries) == 0 {
+		return size == 0
+	}
+
+	tail := entries[len(entries)-1]
+	if tail.pos < 0 || tail.pos >= size {
+		return false
+	}
+	r := bufio.NewReader(io.NewSectionReader(f, tail.pos, size-tail.pos))
+	seq, _, _, n, err := readRecord(r, size-tail.pos)
+	return err == nil && seq == tail.seq && tail.pos+n == size
+}
+
+func encodeRecord(seq uint64, occurredAt int64, env []byte) []byte {
+	record := make([]byte, recordHeaderSize+recordMetaSize+len(env))
+	payload := record[recordHeaderSize:]
+	binary.LittleEndian.PutUint64(payload[0:8], seq)
+	binary.LittleEndian.PutUint64(payload[8:16], uint64(occurredAt))
+	copy(payload[recordMetaSize:], env)
+	binary.LittleEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(record[4:8], crc32.Checksum(payload, crcTable))
+	return record
+}
+
+// readRecord reads a record of at most size bytes; io.EOF is returned only at
+// a record boundary
+func readRecord(r *bufio.Reader, size int64) (uint64, int64, []byte, int64, error) {
+	var header [recordHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if errors.Is(err, io.EOF) {
+			return 0, 0, nil, 0, io.EOF
+		}
+		return 0, 0, nil, 0, err
+	}
+
+	l := int64(binary.LittleEndian.Uint32(header[0:4]))
+	if l < recordMetaSize {
+		return 0, 0, nil, 0, ErrCorrupted
+	}
+	if l > size-recordHeaderSize {
+		return 0, 0, nil, 0, io.ErrUnexpectedEOF
+	}
+
+	payload := make([]byte, l)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if errors.Is(err, io.EOF) {
+			return 0, 0, nil, 0, io.ErrUnexpectedEOF
+		}
+		return 0, 0, nil, 0, err
+	}
+	if crc32.Checksum(payload, crcTable) != binary.LittleEndian.Uint32(header[4:8]) {
+		return 0, 0, nil, 0, ErrCorrupted
+	}
+
+	seq := binary.LittleEndian.Uint64(payload[0:8])
+	occurredAt := int64(binary.LittleEndian.Uint64(payload[8:16]))
+	return seq, occurredAt, payload[recordMetaSize:], recordHeaderSize + l, nil
+}
+
+func readIndex(path string) ([]indexEntry, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data)%indexEntrySize != 0 {
+		return nil, fmt.Errorf("log: index(%s) is corrupted", path)
+	}
+
+	entries := make([]indexEntry, len(data)/indexEntrySize)
+	for i := range entries {
+		b := data[i*indexEntrySize:]
+		entries[i] = indexEntry{
+			seq:  binary.LittleEndian.Uint64(b[0:8]),
+			time: int64(binary.LittleEndian.Uint64(b[8:16])),
+			pos:  int64(binary.LittleEndian.Uint64(b[16:24])),
+		}
+	}
+	return entries, nil
+}
+
+func putIndexEntry(b []byte, entry indexEntry) {
+	binary.LittleEndian.PutUint64(b[0:8], entry.seq)
+	binary.LittleEndian.PutUint64(b[8:16], uint64(entry.time))
+	binary.LittleEndian.PutUint64(b[16:24], uint64(entry.pos))
+}
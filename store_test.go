@@ -0,0 +1,339 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package bus_test
+
+import (
+	"context"
+	"fmt"
+	"errors"
+	"testing"
+
+	"github.com/mustafaturan/bus/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithEventStore(t *testing.T) {
+	var fn bus.Next = func() string { return "fakeid" }
+
+	t.Run("with nil event store", func(t *testing.T) {
+		_, err := bus.NewBus(fn, bus.WithEventStore(nil))
+		assert.EqualError(t, err, "bus: event store can't be nil")
+	})
+
+	t.Run("with nil offset store", func(t *testing.T) {
+		_, err := bus.NewBus(fn, bus.WithOffsetStore(nil))
+		assert.EqualError(t, err, "bus: offset store can't be nil")
+	})
+
+	t.Run("without offset store", func(t *testing.T) {
+		b := setup()
+		assert.EqualError(t, b.CommitOffset("test.handler", 1), "bus: offset store is not configured")
+		_, err := b.HandlerOffset("test.handler")
+		assert.EqualError(t, err, "bus: offset store is not configured")
+	})
+}
+
+func TestEmitEventStore(t *testing.T) {
+	s := openFileStore(t, t.TempDir())
+	defer s.Close()
+	b := setupStore(t, s, nil)
+
+	r := &fakeRecorder{}
+	var seqs []uint64
+	b.RegisterHandler("test.handler", bus.Handler{
+		Handle: func(ctx context.Context, e bus.Event) {
+			seqs = append(seqs, e.Seq)
+			r.record(ctx, e)
+		},
+		Matcher: ".*",
+	})
+
+	ctx := context.Background()
+	require.Nil(t, b.Emit(ctx, topicCommentCreated, fakeOrder{ID: "1"}))
+	require.Nil(t, b.EmitWithOpts(ctx, topicCommentCreated, fakeOrder{ID: "2"}))
+
+	assert.Equal(t, []uint64{1, 2}, seqs)
+	assert.Equal(t, r.received(), readFileStore(t, s, 1))
+
+	t.Run("with failing append", func(t *testing.T) {
+		err := b.Emit(ctx, topicCommentCreated, make(chan int))
+		assert.Contains(t, err.Error(), "bus: topic(comment.created) event append failed: ")
+		assert.Len(t, r.received(), 2)
+	})
+}
+
+func TestEmitBatch(t *testing.T) {
+	s := openFileStore(t, t.TempDir())
+	defer s.Close()
+	b := setupStore(t, s, nil)
+
+	var seqs []uint64
+	b.RegisterHandler("test.handler", bus.Handler{
+		Handle:  func(_ context.Context, e bus.Event) { seqs = append(seqs, e.Seq) },
+		Matcher: ".*",
+	})
+	ctx := context.Background()
+
+	t.Run("appends and delivers the events", func(t *testing.T) {
+		var last uint64
+		err := b.EmitBatch(ctx, func() error {
+			last = s.LastSeq()
+			return nil
+		}, bus.Event{Topic: topicCommentCreated, Data: fakeOrder{ID: "1"}}, bus.Event{Topic: topicCommentCreated, Data: fakeOrder{ID: "2"}})
+		require.Nil(t, err)
+
+		assert.Equal(t, uint64(0), last)
+		assert.Equal(t, []uint64{1, 2}, seqs)
+		assert.Equal(t, []interface{}{fakeOrder{ID: "1"}, fakeOrder{ID: "2"}}, readFileStore(t, s, 1))
+	})
+
+	t.Run("with failing condition", func(t *testing.T) {
+		err := b.EmitBatch(ctx, func() error { return errors.New("conflict") }, bus.Event{Topic: topicCommentCreated, Data: fakeOrder{ID: "3"}})
+		assert.EqualError(t, err, "conflict")
+		assert.Equal(t, uint64(2), s.LastSeq())
+	})
+
+	t.Run("with invalid event", func(t *testing.T) {
+		err := b.EmitBatch(ctx, nil, bus.Event{Topic: topicCommentCreated, Data: fakeOrder{ID: "3"}}, bus.Event{Topic: "unknown"})
+		assert.EqualError(t, err, "bus: topic(unknown) not found")
+		assert.Equal(t, uint64(2), s.LastSeq())
+	})
+
+	t.Run("with failing append", func(t *testing.T) {
+		err := b.EmitBatch(ctx, nil, bus.Event{Topic: topicCommentCreated, Data: fakeOrder{ID: "3"}}, bus.Event{Topic: topicCommentCreated, Data: make(chan int)})
+		assert.Contains(t, err.Error(), "bus: batch append failed: ")
+		assert.Equal(t, uint64(2), s.LastSeq())
+		assert.Equal(t, []uint64{1, 2}, seqs)
+	})
+
+	t.Run("without batch event store", func(t *testing.T) {
+		err := setup(topicCommentCreated).EmitBatch(ctx, nil, bus.Event{Topic: topicCommentCreated})
+		assert.EqualError(t, err, "bus: event store does not support batch appends")
+	})
+}
+
+func TestDurableHandler(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	s := openFileStore(t, dir)
+	b := setupStore(t, s, nil)
+	for i := 1; i <= 3; i++ {
+		require.Nil(t, b.Emit(ctx, topicCommentCreated, fakeOrder{ID: string(rune('0' + i))}))
+	}
+
+	auto := &fakeRecorder{}
+	t.Run("catches up from the start", func(t *testing.T) {
+		b.RegisterHandler("test.auto", bus.Handler{Handle: auto.record, Matcher: ".*", Commit: bus.CommitAuto})
+		assert.Len(t, auto.received(), 3)
+
+		offset, err := b.HandlerOffset("test.auto")
+		require.Nil(t, err)
+		assert.Equal(t, uint64(3), offset)
+	})
+
+	explicit := &fakeRecorder{}
+	t.Run("commits explicitly", func(t *testing.T) {
+		b.RegisterHandler("test.explicit", bus.Handler{Handle: explicit.record, Matcher: ".*", Commit: bus.CommitExplicit})
+		assert.Len(t, explicit.received(), 3)
+
+		offset, err := b.HandlerOffset("test.explicit")
+		require.Nil(t, err)
+		assert.Equal(t, uint64(0), offset)
+		require.Nil(t, b.CommitOffset("test.explicit", 2))
+	})
+
+	t.Run("receives live events", func(t *testing.T) {
+		require.Nil(t, b.Emit(ctx, topicCommentCreated, fakeOrder{ID: "4"}))
+		assert.Len(t, auto.received(), 4)
+		assert.Len(t, explicit.received(), 4)
+	})
+
+	t.Run("resumes after restart", func(t *testing.T) {
+		require.Nil(t, s.Close())
+		s = openFileStore(t, dir)
+		b = setupStore(t, s, nil)
+
+		auto, explicit = &fakeRecorder{}, &fakeRecorder{}
+		b.RegisterHandler("test.auto", bus.Handler{Handle: auto.record, Matcher: ".*", Commit: bus.CommitAuto})
+		b.RegisterHandler("test.explicit", bus.Handler{Handle: explicit.record, Matcher: ".*", Commit: bus.CommitExplicit})
+
+		assert.Empty(t, auto.received())
+		assert.Equal(t, []interface{}{fakeOrder{ID: "3"}, fakeOrder{ID: "4"}}, explicit.received())
+	})
+
+	require.Nil(t, s.Close())
+}
+
+func TestDurableHandlerEmitsOnCatchUp(t *testing.T) {
+	s := openFileStore(t, t.TempDir())
+	defer s.Close()
+	b := setupStore(t, s, nil)
+
+	ctx := context.Background()
+	require.Nil(t, b.Emit(ctx, topicCommentCreated, fakeOrder{ID: "1"}))
+	require.Nil(t, b.Emit(ctx, topicCommentCreated, fakeOrder{ID: "2"}))
+
+	r := &fakeRecorder{}
+	b.RegisterHandler("test.handler", bus.Handler{
+		Handle: func(ctx context.Context, e bus.Event) {
+			r.record(ctx, e)
+			if e.Seq == 1 {
+				require.Nil(t, b.Emit(ctx, topicCommentCreated, fakeOrder{ID: "3"}))
+			}
+		},
+		Matcher: ".*",
+		Commit:  bus.CommitAuto,
+	})
+
+	want := []interface{}{fakeOrder{ID: "1"}, fakeOrder{ID: "2"}, fakeOrder{ID: "3"}}
+	assert.Equal(t, want, r.received())
+
+	stats, _ := b.HandlerStats("test.handler")
+	assert.False(t, stats.Paused)
+}
+
+func TestDurableHandlerCatchUpOverflow(t *testing.T) {
+	s := openFileStore(t, t.TempDir())
+	defer s.Close()
+	b := setupStore(t, s, nil)
+
+	ctx := context.Background()
+	require.Nil(t, b.Emit(ctx, topicCommentCreated, fakeOrder{ID: "0"}))
+
+	live := bus.DefaultPauseBufferSize + 10
+	var seqs []uint64
+	b.RegisterHandler("test.handler", bus.Handler{
+		Handle: func(ctx context.Context, e bus.Event) {
+			seqs = append(seqs, e.Seq)
+			if e.Seq == 1 {
+				for i := 1; i <= live; i++ {
+					require.Nil(t, b.Emit(ctx, topicCommentCreated, fakeOrder{ID: fmt.Sprint(i)}))
+				}
+			}
+		},
+		Matcher: ".*",
+		Commit:  bus.CommitAuto,
+	})
+
+	require.Len(t, seqs, live+1)
+	for i, seq := range seqs {
+		assert.Equal(t, uint64(i+1), seq)
+	}
+
+	stats, _ := b.HandlerStats("test.handler")
+	assert.False(t, stats.Paused)
+	assert.Equal(t, 0, stats.Queued)
+	assert.Equal(t, uint64(0), stats.Dropped)
+}
+
+func TestDurableHandlerWarnings(t *testing.T) {
+	var warnings []string
+	warn := func(_ context.Context, _, msg string) { warnings = append(warnings, msg) }
+
+	t.Run("without stores", func(t *testing.T) {
+		warnings = nil
+		b, err := bus.NewBus(bus.Next(func() string { return "fakeid" }), bus.WithWarnFunc(warn))
+		require.Nil(t, err)
+
+		b.RegisterHandler("test.handler", bus.Handler{Handle: noopHandle, Matcher: ".*", Commit: bus.CommitAuto})
+		assert.Equal(t, []string{"handler(test.handler) catch up skipped: event and offset stores are not configured"}, warnings)
+	})
+
+	t.Run("with paused handler", func(t *testing.T) {
+		warnings = nil
+		s := openFileStore(t, t.TempDir())
+		defer s.Close()
+		b := setupStore(t, s, warn)
+
+		b.RegisterHandler("test.handler", bus.Handler{Handle: noopHandle, Matcher: ".*", Commit: bus.CommitAuto})
+		require.Nil(t, b.PauseHandler("test.handler"))
+		b.RegisterHandler("test.handler", bus.Handler{Handle: noopHandle, Matcher: ".*", Commit: bus.CommitAuto})
+		assert.Equal(t, []string{"handler(test.handler) catch up skipped: handler is paused"}, warnings)
+	})
+
+	t.Run("with invalid matcher", func(t *testing.T) {
+		warnings = nil
+		s := openFileStore(t, t.TempDir())
+		defer s.Close()
+		b := setupStore(t, s, warn)
+
+		b.RegisterHandler("test.handler", bus.Handler{Handle: noopHandle, Matcher: "[", Commit: bus.CommitAuto})
+		assert.Equal(t, []string{"handler(test.handler) catch up failed: matcher([) is invalid: error parsing regexp: missing closing ]: `[`"}, warnings)
+	})
+}
+
+func TestReplay(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("without event store", func(t *testing.T) {
+		b := setup()
+		err := b.Replay(ctx, 1, ".*", func(context.Context, bus.Event) {})
+		assert.EqualError(t, err, "bus: event store is not configured")
+	})
+
+	s := openFileStore(t, t.TempDir())
+	defer s.Close()
+	b := setupStore(t, s, nil)
+	b.RegisterTopics(topicCommentDeleted)
+
+	require.Nil(t, b.Emit(ctx, topicCommentCreated, fakeOrder{ID: "1"}))
+	require.Nil(t, b.EmitWithOpts(ctx, topicCommentDeleted, nil, bus.WithKey("1")))
+	require.Nil(t, b.Emit(ctx, topicCommentCreated, fakeOrder{ID: "2"}))
+
+	t.Run("returns the last seq", func(t *testing.T) {
+		seq, err := b.LastSeq()
+		require.Nil(t, err)
+		assert.Equal(t, uint64(3), seq)
+
+		_, err = setup().LastSeq()
+		assert.EqualError(t, err, "bus: event store is not configured")
+	})
+
+	t.Run("calls fn with the matching events", func(t *testing.T) {
+		var seqs []uint64
+		require.Nil(t, b.Replay(ctx, 1, topicCommentCreated, func(_ context.Context, e bus.Event) {
+			seqs = append(seqs, e.Seq)
+		}))
+		assert.Equal(t, []uint64{1, 3}, seqs)
+
+		var keys []string
+		require.Nil(t, b.Replay(ctx, 2, ".*", func(_ context.Context, e bus.Event) {
+			keys = append(keys, e.Key)
+		}))
+		assert.Equal(t, []string{"1", ""}, keys)
+	})
+
+	t.Run("with invalid matcher", func(t *testing.T) {
+		err := b.Replay(ctx, 1, "[", func(context.Context, bus.Event) {})
+		assert.EqualError(t, err, "bus: matcher([) is invalid: error parsing regexp: missing closing ]: `[`")
+	})
+
+	t.Run("with done ctx", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(ctx)
+		var n int
+		err := b.Replay(ctx, 1, ".*", func(context.Context, bus.Event) {
+			n++
+			cancel()
+		})
+		assert.Equal(t, context.Canceled, err)
+		assert.Equal(t, 1, n)
+	})
+}
+
+func setupStore(t *testing.T, s *bus.FileStore, warn bus.WarnFunc) *bus.Bus {
+	opts := []bus.Option{bus.WithEventStore(s), bus.WithOffsetStore(s)}
+	if warn != nil {
+		opts = append(opts, bus.WithWarnFunc(warn))
+	}
+
+	b, err := bus.NewBus(bus.Next(func() string { return "fakeid" }), opts...)
+	require.Nil(t, err)
+	b.RegisterTopics(topicCommentCreated)
+	return b
+}
+
+func noopHandle(context.Context, bus.Event) {}
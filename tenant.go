@@ -0,0 +1,114 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package bus
+
+import (
+	"fmt"
+	"sync"
+)
+
+type (
+	// TenantQuota limits the usage of a tenant
+	TenantQuota struct {
+		// emit rate limit of the tenant over all topics, optional
+		RateLimit *RateLimit
+
+		// max number of the events of the tenant buffered by each paused
+		// handler, zero for no limit; the overflow policy of the pause
+		// applies to the events of the tenant
+		QueueSize int
+	}
+
+	// tenantQuotas holds the quotas of the tenants by name
+	tenantQuotas struct {
+		mutex  sync.RWMutex
+		quotas map[string]tenantQuota
+	}
+
+	tenantQuota struct {
+		quota   TenantQuota
+		limiter *limiter
+	}
+)
+
+// SetTenantQuota sets the quota of the tenant replacing the current one; a
+// zero quota removes it
+func (b *Bus) SetTenantQuota(tenant string, q TenantQuota) error {
+	if tenant == empty {
+		return fmt.Errorf("bus: tenant can't be empty")
+	}
+	if q.QueueSize < 0 {
+		return fmt.Errorf("bus: tenant(%s) queue size(%d) can't be negative", tenant, q.QueueSize)
+	}
+
+	b.mutex.RLock()
+	clock := b.clock
+	b.mutex.RUnlock()
+
+	b.tenants.set(tenant, tenantQuota{quota: q, limiter: newLimiter(clock, q.RateLimit)})
+	return nil
+}
+
+// TenantQuota returns the quota of the tenant
+func (b *Bus) TenantQuota(tenant string) (TenantQuota, bool) {
+	q, ok := b.tenants.get(tenant)
+	return q.quota, ok
+}
+
+// TenantStats returns the emit metrics of the tenant rate limit
+func (b *Bus) TenantStats(tenant string) (TopicStats, bool) {
+	q, ok := b.tenants.get(tenant)
+	if !ok {
+		return TopicStats{}, false
+	}
+	return q.limiter.stats(), true
+}
+
+// accepts tells whether the event is visible to the handler
+func (h Handler) accepts(e Event) bool {
+	return h.Tenant == empty || h.Tenant == e.Tenant
+}
+
+func newTenantQuotas() *tenantQuotas {
+	return &tenantQuotas{quotas: make(map[string]tenantQuota)}
+}
+
+func (t *tenantQuotas) set(tenant string, q tenantQuota) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if q.quota.RateLimit == nil && q.quota.QueueSize == 0 {
+		delete(t.quotas, tenant)
+		return
+	}
+	t.quotas[tenant] = q
+}
+
+func (t *tenantQuotas) get(tenant string) (tenantQuota, bool) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	q, ok := t.quotas[tenant]
+	return q, ok
+}
+
+// limiter returns the emit rate limiter of the tenant, nil for no limit
+func (t *tenantQuotas) limiter(tenant string) *limiter {
+	if tenant == empty {
+		return nil
+	}
+	q, _ := t.get(tenant)
+	return q.limiter
+}
+
+// queueSize returns the max number of the buffered events of the tenant, zero
+// for no limit
+func (t *tenantQuotas) queueSize(tenant string) int {
+	if t == nil || tenant == empty {
+		return 0
+	}
+	q, _ := t.get(tenant)
+	return q.quota.QueueSize
+}
@@ -0,0 +1,286 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package bus_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mustafaturan/bus/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmitTenant(t *testing.T) {
+	b := setup(topicCommentCreated, topicUserCreated)
+
+	var received []bus.Event
+	b.RegisterHandler("test.handler", bus.Handler{
+		Handle: func(ctx context.Context, e bus.Event) {
+			received = append(received, e)
+			if e.Topic == topicCommentCreated {
+				require.Nil(t, b.EmitWithOpts(ctx, topicUserCreated, e.Data))
+			}
+		},
+		Matcher: ".*",
+	})
+
+	t.Run("with ctx tenant", func(t *testing.T) {
+		received = nil
+		ctx := context.WithValue(context.Background(), bus.CtxKeyTenant, "acme")
+		require.Nil(t, b.Emit(ctx, topicCommentCreated, "1"))
+
+		require.Len(t, received, 2)
+		assert.Equal(t, "acme", received[0].Tenant)
+		assert.Equal(t, "acme", received[1].Tenant)
+	})
+
+	t.Run("with tenant option", func(t *testing.T) {
+		received = nil
+		require.Nil(t, b.EmitWithOpts(context.Background(), topicCommentCreated, "2", bus.WithTenant("globex")))
+
+		require.Len(t, received, 2)
+		assert.Equal(t, "globex", received[0].Tenant)
+		assert.Equal(t, "globex", received[1].Tenant)
+	})
+
+	t.Run("with tenant option of the ctx tenant", func(t *testing.T) {
+		received = nil
+		ctx := context.WithValue(context.Background(), bus.CtxKeyTenant, "acme")
+		require.Nil(t, b.EmitWithOpts(ctx, topicCommentCreated, "2", bus.WithTenant("acme")))
+
+		require.Len(t, received, 2)
+		assert.Equal(t, "acme", received[0].Tenant)
+	})
+
+	t.Run("with tenant option not matching the ctx tenant", func(t *testing.T) {
+		received = nil
+		ctx := context.WithValue(context.Background(), bus.CtxKeyTenant, "acme")
+		err := b.EmitWithOpts(ctx, topicCommentCreated, "2", bus.WithTenant("globex"))
+
+		assert.EqualError(t, err, "bus: topic(comment.created) tenant(globex) does not match the ctx tenant(acme)")
+		assert.Empty(t, received)
+
+		err = b.EmitWithOpts(ctx, topicCommentCreated, "2", bus.WithTenant(""))
+		assert.EqualError(t, err, "bus: topic(comment.created) tenant() does not match the ctx tenant(acme)")
+	})
+
+	t.Run("without tenant", func(t *testing.T) {
+		received = nil
+		require.Nil(t, b.Emit(context.Background(), topicCommentCreated, "3"))
+
+		require.Len(t, received, 2)
+		assert.Empty(t, received[0].Tenant)
+		assert.Empty(t, received[1].Tenant)
+	})
+}
+
+func TestTenantHandler(t *testing.T) {
+	b := setup(topicCommentCreated)
+	ctx := context.Background()
+
+	acme, globex, all := &fakeRecorder{}, &fakeRecorder{}, &fakeRecorder{}
+	b.RegisterHandler("test.acme", bus.Handler{Handle: acme.record, Matcher: ".*", Tenant: "acme"})
+	b.RegisterHandler("test.globex", bus.Handler{Handle: globex.record, Matcher: ".*", Tenant: "globex"})
+	b.RegisterHandler("test.all", bus.Handler{Handle: all.record, Matcher: ".*"})
+
+	require.Nil(t, b.EmitWithOpts(ctx, topicCommentCreated, 1, bus.WithTenant("acme")))
+	require.Nil(t, b.EmitWithOpts(ctx, topicCommentCreated, 2, bus.WithTenant("globex")))
+	require.Nil(t, b.EmitWithOpts(ctx, topicCommentCreated, 3))
+
+	assert.Equal(t, []interface{}{1}, acme.received())
+	assert.Equal(t, []interface{}{2}, globex.received())
+	assert.Equal(t, []interface{}{1, 2, 3}, all.received())
+
+	t.Run("while paused", func(t *testing.T) {
+		require.Nil(t, b.PauseHandler("test.acme"))
+		require.Nil(t, b.EmitWithOpts(ctx, topicCommentCreated, 4, bus.WithTenant("globex")))
+		require.Nil(t, b.EmitWithOpts(ctx, topicCommentCreated, 5, bus.WithTenant("acme")))
+
+		stats, _ := b.HandlerStats("test.acme")
+		assert.Equal(t, 1, stats.Queued)
+
+		require.Nil(t, b.ResumeHandler("test.acme"))
+		assert.Equal(t, []interface{}{1, 5}, acme.received())
+	})
+
+	t.Run("in topology", func(t *testing.T) {
+		nodes := b.Topology().Handlers
+		require.Len(t, nodes, 3)
+		assert.Equal(t, "acme", nodes[0].Tenant)
+		assert.Empty(t, nodes[1].Tenant)
+		assert.Equal(t, "globex", nodes[2].Tenant)
+	})
+}
+
+func TestTenantGroup(t *testing.T) {
+	b := setup(topicCommentCreated)
+	ctx := context.Background()
+
+	acme1, acme2, globex := &fakeRecorder{}, &fakeRecorder{}, &fakeRecorder{}
+	b.RegisterHandler("test.acme1", bus.Handler{Handle: acme1.record, Matcher: ".*", Group: "workers", Tenant: "acme"})
+	b.RegisterHandler("test.acme2", bus.Handler{Handle: acme2.record, Matcher: ".*", Group: "workers", Tenant: "acme"})
+	b.RegisterHandler("test.globex", bus.Handler{Handle: globex.record, Matcher: ".*", Group: "workers", Tenant: "globex"})
+
+	for i := 1; i <= 4; i++ {
+		require.Nil(t, b.EmitWithOpts(ctx, topicCommentCreated, i, bus.WithTenant("acme")))
+	}
+	require.Nil(t, b.EmitWithOpts(ctx, topicCommentCreated, 5, bus.WithTenant("globex")))
+
+	assert.Len(t, acme1.received(), 2)
+	assert.Len(t, acme2.received(), 2)
+	assert.Equal(t, []interface{}{5}, globex.received())
+
+	t.Run("without a member of the tenant", func(t *testing.T) {
+		require.Nil(t, b.EmitWithOpts(ctx, topicCommentCreated, 6, bus.WithTenant("initech")))
+		assert.Len(t, acme1.received(), 2)
+		assert.Len(t, acme2.received(), 2)
+		assert.Len(t, globex.received(), 1)
+	})
+
+	t.Run("with paused members of the tenant", func(t *testing.T) {
+		require.Nil(t, b.PauseHandler("test.acme1"))
+		require.Nil(t, b.PauseHandler("test.acme2"))
+		require.Nil(t, b.EmitWithOpts(ctx, topicCommentCreated, 7, bus.WithTenant("acme")))
+
+		stats1, _ := b.HandlerStats("test.acme1")
+		stats2, _ := b.HandlerStats("test.acme2")
+		assert.Equal(t, 1, stats1.Queued+stats2.Queued)
+		assert.Len(t, globex.received(), 1)
+	})
+}
+
+func TestTenantDurableHandler(t *testing.T) {
+	ctx := context.Background()
+	s := openFileStore(t, t.TempDir())
+	b := setupStore(t, s, nil)
+
+	require.Nil(t, b.EmitWithOpts(ctx, topicCommentCreated, fakeOrder{ID: "1"}, bus.WithTenant("acme")))
+	require.Nil(t, b.EmitWithOpts(ctx, topicCommentCreated, fakeOrder{ID: "2"}, bus.WithTenant("globex")))
+
+	r := &fakeRecorder{}
+	b.RegisterHandler("test.acme", bus.Handler{Handle: r.record, Matcher: ".*", Commit: bus.CommitAuto, Tenant: "acme"})
+	assert.Equal(t, []interface{}{fakeOrder{ID: "1"}}, r.received())
+
+	require.Nil(t, s.Close())
+}
+
+func TestSetTenantQuota(t *testing.T) {
+	b := setup()
+
+	t.Run("with empty tenant", func(t *testing.T) {
+		err := b.SetTenantQuota("", bus.TenantQuota{QueueSize: 1})
+		assert.EqualError(t, err, "bus: tenant can't be empty")
+	})
+
+	t.Run("with negative queue size", func(t *testing.T) {
+		err := b.SetTenantQuota("acme", bus.TenantQuota{QueueSize: -1})
+		assert.EqualError(t, err, "bus: tenant(acme) queue size(-1) can't be negative")
+	})
+
+	t.Run("sets and removes", func(t *testing.T) {
+		q := bus.TenantQuota{RateLimit: &bus.RateLimit{Rate: 1}, QueueSize: 2}
+		require.Nil(t, b.SetTenantQuota("acme", q))
+
+		got, ok := b.TenantQuota("acme")
+		assert.True(t, ok)
+		assert.Equal(t, q, got)
+
+		require.Nil(t, b.SetTenantQuota("acme", bus.TenantQuota{}))
+		_, ok = b.TenantQuota("acme")
+		assert.False(t, ok)
+	})
+}
+
+func TestTenantRateLimit(t *testing.T) {
+	clock := newFakeClock()
+	b, err := bus.NewBus(bus.Next(func() string { return "fakeid" }), bus.WithClock(clock))
+	require.Nil(t, err)
+	b.RegisterTopics(topicCommentCreated, topicUserCreated)
+
+	r := &fakeRecorder{}
+	b.RegisterHandler("test.handler", bus.Handler{Handle: r.record, Matcher: ".*"})
+	require.Nil(t, b.SetTenantQuota("acme", bus.TenantQuota{
+		RateLimit: &bus.RateLimit{Rate: 10, Burst: 1, Policy: bus.ThrottleDrop},
+	}))
+
+	acme := context.WithValue(context.Background(), bus.CtxKeyTenant, "acme")
+	require.Nil(t, b.Emit(acme, topicCommentCreated, 1))
+
+	err = b.Emit(acme, topicUserCreated, 2)
+	assert.True(t, errors.Is(err, bus.ErrThrottled))
+	assert.EqualError(t, err, "bus: tenant(acme) dropped: rate limit exceeded")
+
+	require.Nil(t, b.EmitWithOpts(context.Background(), topicUserCreated, 3, bus.WithTenant("globex")))
+	require.Nil(t, b.Emit(context.Background(), topicUserCreated, 4))
+
+	clock.Advance(100 * time.Millisecond)
+	require.Nil(t, b.Emit(acme, topicUserCreated, 5))
+
+	assert.Equal(t, []interface{}{1, 3, 4, 5}, r.received())
+
+	stats, ok := b.TenantStats("acme")
+	assert.True(t, ok)
+	assert.Equal(t, bus.TopicStats{Throttled: 1, Dropped: 1}, stats)
+
+	_, ok = b.TenantStats("globex")
+	assert.False(t, ok)
+}
+
+func TestTenantQueueSize(t *testing.T) {
+	ctx := context.Background()
+
+	var spilled []interface{}
+	tests := []struct {
+		name     string
+		opts     []bus.PauseOption
+		received []interface{}
+		spilled  []interface{}
+	}{
+		{
+			name:     "drops the oldest of the tenant",
+			opts:     []bus.PauseOption{bus.WithOverflowPolicy(bus.OverflowDropOldest)},
+			received: []interface{}{2, 3, 4, 5},
+		},
+		{
+			name:     "drops the newest",
+			opts:     []bus.PauseOption{bus.WithOverflowPolicy(bus.OverflowDropNewest)},
+			received: []interface{}{1, 2, 3, 4},
+		},
+		{
+			name:     "spills",
+			opts:     []bus.PauseOption{bus.WithSpill(func(_ context.Context, e bus.Event) { spilled = append(spilled, e.Data) })},
+			received: []interface{}{1, 2, 3, 4},
+			spilled:  []interface{}{5},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spilled = nil
+			b := setup(topicCommentCreated)
+			require.Nil(t, b.SetTenantQuota("acme", bus.TenantQuota{QueueSize: 2}))
+
+			r := &fakeRecorder{}
+			b.RegisterHandler("test.handler", bus.Handler{Handle: r.record, Matcher: ".*"})
+			require.Nil(t, b.PauseHandler("test.handler", tt.opts...))
+
+			require.Nil(t, b.EmitWithOpts(ctx, topicCommentCreated, 1, bus.WithTenant("acme")))
+			require.Nil(t, b.EmitWithOpts(ctx, topicCommentCreated, 2, bus.WithTenant("globex")))
+			require.Nil(t, b.EmitWithOpts(ctx, topicCommentCreated, 3, bus.WithTenant("globex")))
+			require.Nil(t, b.EmitWithOpts(ctx, topicCommentCreated, 4, bus.WithTenant("acme")))
+			require.Nil(t, b.EmitWithOpts(ctx, topicCommentCreated, 5, bus.WithTenant("acme")))
+
+			stats, _ := b.HandlerStats("test.handler")
+			assert.Equal(t, 4, stats.Queued)
+
+			require.Nil(t, b.ResumeHandler("test.handler"))
+			assert.Equal(t, tt.received, r.received())
+			assert.Equal(t, tt.spilled, spilled)
+		})
+	}
+}
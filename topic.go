@@ -0,0 +1,199 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package bus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+type (
+	// TopicDescriptor holds the metadata and the options of a topic
+	TopicDescriptor struct {
+		Name        string        // topic name
+		Description string        // human readable description
+		Owner       string        // owner team or package of the topic
+		Retention   time.Duration // how long the events should be kept
+		Internal    bool          // whether the topic is internal to the owner
+		Deprecation string        // deprecation notice, warned on emit
+
+		// payload type, emits with a different type are rejected
+		PayloadType reflect.Type
+
+		// payload validator, runs on emit before any handler
+		Validator Validator
+
+		// emit rate limit of the topic
+		RateLimit *RateLimit
+
+		// extracts the key of the emitted events, i.e. for the compaction
+		KeyFunc KeyFunc
+	}
+
+	// TopicOption is a function type to mutate topic descriptor fields
+	TopicOption = func(TopicDescriptor) TopicDescriptor
+)
+
+// WithDescription returns an option to set topic's description field
+func WithDescription(description string) TopicOption {
+	return func(d TopicDescriptor) TopicDescriptor {
+		d.Description = description
+		return d
+	}
+}
+
+// WithOwner returns an option to set topic's owner field
+func WithOwner(owner string) TopicOption {
+	return func(d TopicDescriptor) TopicDescriptor {
+		d.Owner = owner
+		return d
+	}
+}
+
+// WithRetention returns an option to set topic's retention field
+func WithRetention(retention time.Duration) TopicOption {
+	return func(d TopicDescriptor) TopicDescriptor {
+		d.Retention = retention
+		return d
+	}
+}
+
+// WithInternal returns an option to mark the topic as internal
+func WithInternal() TopicOption {
+	return func(d TopicDescriptor) TopicDescriptor {
+		d.Internal = true
+		return d
+	}
+}
+
+// WithDeprecation returns an option to mark the topic as deprecated with the
+// given notice
+func WithDeprecation(notice string) TopicOption {
+	return func(d TopicDescriptor) TopicDescriptor {
+		d.Deprecation = notice
+		return d
+	}
+}
+
+// WithPayloadType returns an option to set topic's payload type from the
+// given sample payload
+func WithPayloadType(sample interface{}) TopicOption {
+	return func(d TopicDescriptor) TopicDescriptor {
+		d.PayloadType = reflect.TypeOf(sample)
+		return d
+	}
+}
+
+// WithValidator returns an option to set topic's payload validator
+func WithValidator(v Validator) TopicOption {
+	return func(d TopicDescriptor) TopicDescriptor {
+		d.Validator = v
+		return d
+	}
+}
+
+// WithKeyFunc returns an option to set topic's event key extractor; the key
+// is set on emit unless the event already has one
+func WithKeyFunc(fn KeyFunc) TopicOption {
+	return func(d TopicDescriptor) TopicDescriptor {
+		d.KeyFunc = fn
+		return d
+	}
+}
+
+// RegisterTopicWithOpts registers the topic with options; options of an
+// already registered topic are replaced
+func (b *Bus) RegisterTopicWithOpts(topic string, opts ...TopicOption) {
+	d := TopicDescriptor{Name: topic}
+	for _, o := range opts {
+		d = o(d)
+	}
+
+	b.RegisterTopicDescriptors(d)
+}
+
+// RegisterTopicDescriptors registers the topics with their descriptors;
+// descriptors of already registered topics are replaced
+func (b *Bus) RegisterTopicDescriptors(descriptors ...TopicDescriptor) {
+	b.mutex.Lock()
+	changes := make([]Change, 0, len(descriptors))
+	for _, d := range descriptors {
+		if c, ok := b.registerTopic(d.Name); ok {
+			changes = append(changes, c)
+		}
+		b.descriptors[d.Name] = d
+		if l := newLimiter(b.clock, d.RateLimit); l != nil {
+			b.limiters[d.Name] = l
+		} else {
+			delete(b.limiters, d.Name)
+		}
+	}
+	hooks := b.hooks
+	b.mutex.Unlock()
+
+	notifyHooks(hooks, changes...)
+}
+
+// TopicInfo returns the descriptor of the registered topic
+func (b *Bus) TopicInfo(topic string) (TopicDescriptor, bool) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	if _, ok := b.topics[topic]; !ok {
+		return TopicDescriptor{}, false
+	}
+
+	d, ok := b.descriptors[topic]
+	if !ok {
+		d = TopicDescriptor{Name: topic}
+	}
+	return d, true
+}
+
+// TopicValidator returns the payload validator of the topic
+func (b *Bus) TopicValidator(topic string) (Validator, bool) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	d := b.descriptors[topic]
+	return d.Validator, d.Validator != nil
+}
+
+// checkPayload enforces the topic descriptor options on the payload; the
+// tombstones have no payload to check
+func (b *Bus) checkPayload(ctx context.Context, d TopicDescriptor, topic string, data interface{}, tombstone bool) error {
+	if d.Deprecation != empty {
+		b.warn(ctx, topic, fmt.Sprintf("topic(%s) is deprecated: %s", topic, d.Deprecation))
+	}
+	if tombstone {
+		return nil
+	}
+
+	if d.PayloadType != nil && reflect.TypeOf(data) != d.PayloadType {
+		return fmt.Errorf("bus: topic(%s) payload type(%T) does not match type(%s)", topic, data, d.PayloadType)
+	}
+
+	return d.validate(topic, data)
+}
+
+func (d TopicDescriptor) validate(topic string, data interface{}) error {
+	if d.Validator == nil {
+		return nil
+	}
+
+	err := d.Validator.Validate(data)
+	if err == nil {
+		return nil
+	}
+
+	var verr *ValidationError
+	if !errors.As(err, &verr) {
+		return &ValidationError{Topic: topic, Errors: []FieldError{{Message: err.Error()}}}
+	}
+	return &ValidationError{Topic: topic, Errors: verr.Errors}
+}
@@ -0,0 +1,229 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package bus_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mustafaturan/bus/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegisterTopicWithOpts(t *testing.T) {
+	b := setup()
+	defer tearDown(b, topicCommentCreated)
+
+	v := bus.ValidatorFunc(func(data interface{}) error {
+		if _, ok := data.(string); !ok {
+			return errors.New("comment must be a string")
+		}
+		return nil
+	})
+	b.RegisterTopicWithOpts(topicCommentCreated, bus.WithValidator(v))
+
+	t.Run("registers topic", func(t *testing.T) {
+		assert.ElementsMatch(t, []string{topicCommentCreated}, b.Topics())
+	})
+
+	t.Run("keeps handlers on re-register", func(t *testing.T) {
+		b.RegisterHandler("test.handler", fakeHandler(".*"))
+		defer b.DeregisterHandler("test.handler")
+
+		b.RegisterTopicWithOpts(topicCommentCreated, bus.WithValidator(v))
+		assert.True(t, isTopicHandler(b, topicCommentCreated, "test.handler"))
+	})
+
+	t.Run("introspects validator", func(t *testing.T) {
+		got, ok := b.TopicValidator(topicCommentCreated)
+		assert.True(t, ok)
+		assert.NotNil(t, got)
+
+		_, ok = b.TopicValidator(topicCommentDeleted)
+		assert.False(t, ok)
+	})
+}
+
+func TestEmitValidation(t *testing.T) {
+	b := setup()
+	defer tearDown(b, topicCommentCreated)
+
+	s, err := bus.ParseSchema([]byte(`{"type":"string","minLength":3}`))
+	require.Nil(t, err)
+	b.RegisterTopicWithOpts(topicCommentCreated, bus.WithValidator(s))
+
+	var calls int
+	b.RegisterHandler("test.handler", bus.Handler{
+		Handle:  func(context.Context, bus.Event) { calls++ },
+		Matcher: ".*",
+	})
+	defer b.DeregisterHandler("test.handler")
+
+	ctx := context.Background()
+	emits := map[string]func(data interface{}) error{
+		"Emit": func(data interface{}) error {
+			return b.Emit(ctx, topicCommentCreated, data)
+		},
+		"EmitWithOpts": func(data interface{}) error {
+			return b.EmitWithOpts(ctx, topicCommentCreated, data)
+		},
+	}
+
+	for name, emit := range emits {
+		t.Run(name, func(t *testing.T) {
+			calls = 0
+
+			err := emit(1)
+			var verr *bus.ValidationError
+			require.True(t, errors.As(err, &verr))
+			assert.Equal(t, topicCommentCreated, verr.Topic)
+			assert.Equal(t, "bus: topic(comment.created) payload is invalid: $: expected string, got number", err.Error())
+			assert.Equal(t, 0, calls)
+
+			assert.Nil(t, emit("a comment"))
+			assert.Equal(t, 1, calls)
+		})
+	}
+
+	t.Run("wraps plain errors", func(t *testing.T) {
+		fail := bus.ValidatorFunc(func(interface{}) error { return errors.New("nope") })
+		b.RegisterTopicWithOpts(topicCommentCreated, bus.WithValidator(fail))
+
+		err := b.Emit(ctx, topicCommentCreated, "a comment")
+		assert.EqualError(t, err, "bus: topic(comment.created) payload is invalid: nope")
+	})
+}
+
+func TestTopicInfo(t *testing.T) {
+	b := setup(topicUserDeleted)
+	defer tearDown(b, topicUserCreated, topicUserDeleted)
+
+	b.RegisterTopicWithOpts(topicUserCreated,
+		bus.WithDescription("a user signed up"),
+		bus.WithOwner("identity"),
+		bus.WithRetention(24*time.Hour),
+		bus.WithInternal(),
+		bus.WithPayloadType(fakeUserV3{}),
+	)
+
+	t.Run("with descriptor", func(t *testing.T) {
+		got, ok := b.TopicInfo(topicUserCreated)
+		require.True(t, ok)
+
+		assert := assert.New(t)
+		assert.Equal(topicUserCreated, got.Name)
+		assert.Equal("a user signed up", got.Description)
+		assert.Equal("identity", got.Owner)
+		assert.Equal(24*time.Hour, got.Retention)
+		assert.True(got.Internal)
+		assert.Equal(reflect.TypeOf(fakeUserV3{}), got.PayloadType)
+	})
+
+	t.Run("without descriptor", func(t *testing.T) {
+		got, ok := b.TopicInfo(topicUserDeleted)
+		require.True(t, ok)
+		assert.Equal(t, bus.TopicDescriptor{Name: topicUserDeleted}, got)
+	})
+
+	t.Run("with unknown topic", func(t *testing.T) {
+		_, ok := b.TopicInfo(topicUserUpdated)
+		assert.False(t, ok)
+	})
+
+	t.Run("after deregister", func(t *testing.T) {
+		b.DeregisterTopics(topicUserCreated)
+		_, ok := b.TopicInfo(topicUserCreated)
+		assert.False(t, ok)
+	})
+}
+
+func TestRegisterTopicDescriptors(t *testing.T) {
+	b := setup()
+	defer tearDown(b, topicUserCreated, topicUserDeleted)
+
+	b.RegisterTopicDescriptors(
+		bus.TopicDescriptor{Name: topicUserCreated, Owner: "identity"},
+		bus.TopicDescriptor{Name: topicUserDeleted, Owner: "gdpr"},
+	)
+
+	assert.ElementsMatch(t, []string{topicUserCreated, topicUserDeleted}, b.Topics())
+	got, _ := b.TopicInfo(topicUserDeleted)
+	assert.Equal(t, "gdpr", got.Owner)
+}
+
+func TestEmitTopicOptions(t *testing.T) {
+	var warnings []string
+	b, err := bus.NewBus(bus.Next(func() string { return "fakeid" }),
+		bus.WithWarnFunc(func(_ context.Context, topic, msg string) {
+			warnings = append(warnings, msg)
+		}),
+	)
+	require.Nil(t, err)
+	defer tearDown(b, topicUserCreated, topicUserDeleted)
+
+	b.RegisterTopicWithOpts(topicUserCreated, bus.WithPayloadType(fakeUserV3{}))
+	b.RegisterTopicWithOpts(topicUserDeleted, bus.WithDeprecation("use user.removed"))
+
+	ctx := context.Background()
+
+	t.Run("enforces payload type", func(t *testing.T) {
+		assert.Nil(t, b.Emit(ctx, topicUserCreated, fakeUserV3{}))
+
+		err := b.EmitWithOpts(ctx, topicUserCreated, fakeUserV1{})
+		assert.EqualError(t, err, "bus: topic(user.created) payload type(bus_test.fakeUserV1) does not match type(bus_test.fakeUserV3)")
+	})
+
+	t.Run("warns deprecated topics", func(t *testing.T) {
+		assert.Nil(t, b.Emit(ctx, topicUserDeleted, "1"))
+		assert.Nil(t, b.EmitWithOpts(ctx, topicUserDeleted, "2"))
+		want := "topic(user.deleted) is deprecated: use user.removed"
+		assert.Equal(t, []string{want, want}, warnings)
+	})
+}
+
+func TestEmitKeyFunc(t *testing.T) {
+	b := setup()
+	defer tearDown(b, topicUserCreated)
+
+	b.RegisterTopicWithOpts(topicUserCreated,
+		bus.WithPayloadType(fakeUserV1{}),
+		bus.WithKeyFunc(func(e bus.Event) string { return e.Data.(fakeUserV1).Name }),
+	)
+
+	var events []bus.Event
+	b.RegisterHandler("test.handler", bus.Handler{
+		Handle:  func(_ context.Context, e bus.Event) { events = append(events, e) },
+		Matcher: topicUserCreated,
+	})
+
+	ctx := context.Background()
+	require.Nil(t, b.Emit(ctx, topicUserCreated, fakeUserV1{Name: "a"}))
+	require.Nil(t, b.EmitWithOpts(ctx, topicUserCreated, fakeUserV1{Name: "b"}))
+	require.Nil(t, b.EmitWithOpts(ctx, topicUserCreated, fakeUserV1{Name: "c"}, bus.WithKey("custom")))
+	require.Nil(t, b.EmitWithOpts(ctx, topicUserCreated, nil, bus.WithKey("a")))
+
+	require.Len(t, events, 4)
+	assert.Equal(t, []string{"a", "b", "custom", "a"}, []string{events[0].Key, events[1].Key, events[2].Key, events[3].Key})
+	assert.False(t, events[0].IsTombstone())
+	assert.True(t, events[3].IsTombstone())
+
+	t.Run("with nil data without key", func(t *testing.T) {
+		err := b.EmitWithOpts(ctx, topicUserCreated, nil)
+		assert.EqualError(t, err, "bus: topic(user.created) payload type(<nil>) does not match type(bus_test.fakeUserV1)")
+	})
+	t.Run("with nil data without payload type", func(t *testing.T) {
+		defer tearDown(b, topicUserDeleted)
+		b.RegisterTopicWithOpts(topicUserDeleted,
+			bus.WithKeyFunc(func(e bus.Event) string { return e.Data.(fakeUserV1).Name }),
+		)
+
+		require.Nil(t, b.Emit(ctx, topicUserDeleted, nil))
+		require.Nil(t, b.EmitWithOpts(ctx, topicUserDeleted, nil))
+	})
+}
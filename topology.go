@@ -0,0 +1,130 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package bus
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+type (
+	// Topology is a point in time snapshot of the bus wiring
+	Topology struct {
+		Topics   []TopicNode    `json:"topics"`
+		Handlers []HandlerNode  `json:"handlers"`
+		Edges    []Subscription `json:"edges"`
+	}
+
+	// TopicNode is a topic in the topology with its metadata
+	TopicNode struct {
+		Name          string        `json:"name"`
+		Description   string        `json:"description,omitempty"`
+		Owner         string        `json:"owner,omitempty"`
+		Retention     time.Duration `json:"retention,omitempty"`
+		Internal      bool          `json:"internal,omitempty"`
+		Deprecation   string        `json:"deprecation,omitempty"`
+		PayloadType   string        `json:"payloadType,omitempty"`
+		SchemaVersion int           `json:"schemaVersion,omitempty"`
+		Keyed         bool          `json:"keyed,omitempty"`
+	}
+
+	// HandlerNode is a handler in the topology
+	HandlerNode struct {
+		Key     string `json:"key"`
+		Matcher string `json:"matcher"`
+		Group   string `json:"group,omitempty"`
+		Tenant  string `json:"tenant,omitempty"`
+	}
+)
+
+// Topology returns the snapshot of the topics, handlers and subscriptions
+// sorted by name, so the snapshots can be diffed
+func (b *Bus) Topology() Topology {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	t := Topology{
+		Topics:   make([]TopicNode, 0, len(b.topics)),
+		Handlers: make([]HandlerNode, 0, len(b.handlers)),
+		Edges:    make([]Subscription, 0),
+	}
+
+	for name, handlers := range b.topics {
+		d := b.descriptors[name]
+		n := TopicNode{
+			Name:          name,
+			Description:   d.Description,
+			Owner:         d.Owner,
+			Retention:     d.Retention,
+			Internal:      d.Internal,
+			Deprecation:   d.Deprecation,
+			SchemaVersion: b.upcasters[name].version,
+			Keyed:         d.KeyFunc != nil,
+		}
+		if d.PayloadType != nil {
+			n.PayloadType = d.PayloadType.String()
+		}
+		t.Topics = append(t.Topics, n)
+		t.Edges = append(t.Edges, topicSubscriptions(name, handlers)...)
+	}
+
+	for key, h := range b.handlers {
+		t.Handlers = append(t.Handlers, HandlerNode{Key: key, Matcher: h.Matcher, Group: h.Group, Tenant: h.Tenant})
+	}
+
+	sort.Slice(t.Topics, func(i, j int) bool { return t.Topics[i].Name < t.Topics[j].Name })
+	sort.Slice(t.Handlers, func(i, j int) bool { return t.Handlers[i].Key < t.Handlers[j].Key })
+	sortSubscriptions(t.Edges)
+
+	return t
+}
+
+// DOT returns the topology as a Graphviz DOT digraph; topics are drawn as
+// boxes, handlers as ellipses and subscriptions as edges from topics to
+// handlers
+func (t Topology) DOT() string {
+	var sb strings.Builder
+
+	sb.WriteString("digraph bus {\n")
+	sb.WriteString("\trankdir=LR;\n")
+
+	for _, n := range t.Topics {
+		label := n.Name
+		if n.Owner != empty {
+			label += "\n(" + n.Owner + ")"
+		}
+		style := "solid"
+		if n.Deprecation != empty {
+			style = "dashed"
+		}
+		fmt.Fprintf(&sb, "\t%s [label=%s shape=box style=%s];\n", dotTopicID(n.Name), dotQuote(label), style)
+	}
+
+	for _, n := range t.Handlers {
+		fmt.Fprintf(&sb, "\t%s [label=%s shape=ellipse];\n", dotHandlerID(n.Key), dotQuote(n.Key+"\n"+n.Matcher))
+	}
+
+	for _, e := range t.Edges {
+		fmt.Fprintf(&sb, "\t%s -> %s;\n", dotTopicID(e.Topic), dotHandlerID(e.HandlerKey))
+	}
+
+	sb.WriteString("}\n")
+	return sb.String()
+}
+
+func dotTopicID(name string) string {
+	return dotQuote("topic:" + name)
+}
+
+func dotHandlerID(key string) string {
+	return dotQuote("handler:" + key)
+}
+
+func dotQuote(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	return `"` + r.Replace(s) + `"`
+}
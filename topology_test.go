@@ -0,0 +1,94 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package bus_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/mustafaturan/bus/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTopology(t *testing.T) {
+	b := setupTopology(t)
+	defer tearDown(b, topicUserCreated, topicUserDeleted)
+
+	want := bus.Topology{
+		Topics: []bus.TopicNode{
+			{Name: topicUserCreated, Owner: "identity", PayloadType: "bus_test.fakeUserV3", SchemaVersion: 3},
+			{Name: topicUserDeleted, Deprecation: "use user.removed"},
+		},
+		Handlers: []bus.HandlerNode{
+			{Key: "audit", Matcher: ".*"},
+			{Key: "mailer", Matcher: "created$"},
+		},
+		Edges: []bus.Subscription{
+			{Topic: topicUserCreated, HandlerKey: "audit"},
+			{Topic: topicUserCreated, HandlerKey: "mailer"},
+			{Topic: topicUserDeleted, HandlerKey: "audit"},
+		},
+	}
+	assert.Equal(t, want, b.Topology())
+}
+
+func TestTopologyJSON(t *testing.T) {
+	b := setupTopology(t)
+	defer tearDown(b, topicUserCreated, topicUserDeleted)
+
+	data, err := json.Marshal(b.Topology())
+	require.Nil(t, err)
+
+	want := `{
+		"topics": [
+			{"name": "user.created", "owner": "identity", "payloadType": "bus_test.fakeUserV3", "schemaVersion": 3},
+			{"name": "user.deleted", "deprecation": "use user.removed"}
+		],
+		"handlers": [
+			{"key": "audit", "matcher": ".*"},
+			{"key": "mailer", "matcher": "created$"}
+		],
+		"edges": [
+			{"topic": "user.created", "handler": "audit"},
+			{"topic": "user.created", "handler": "mailer"},
+			{"topic": "user.deleted", "handler": "audit"}
+		]
+	}`
+	assert.JSONEq(t, want, string(data))
+}
+
+func TestTopologyDOT(t *testing.T) {
+	b := setupTopology(t)
+	defer tearDown(b, topicUserCreated, topicUserDeleted)
+
+	want := `digraph bus {
+	rankdir=LR;
+	"topic:user.created" [label="user.created\n(identity)" shape=box style=solid];
+	"topic:user.deleted" [label="user.deleted" shape=box style=dashed];
+	"handler:audit" [label="audit\n.*" shape=ellipse];
+	"handler:mailer" [label="mailer\ncreated$" shape=ellipse];
+	"topic:user.created" -> "handler:audit";
+	"topic:user.created" -> "handler:mailer";
+	"topic:user.deleted" -> "handler:audit";
+}
+`
+	assert.Equal(t, want, b.Topology().DOT())
+
+	t.Run("escapes quotes", func(t *testing.T) {
+		topology := bus.Topology{Handlers: []bus.HandlerNode{{Key: `a"b`, Matcher: `\d`}}}
+		assert.Contains(t, topology.DOT(), `"handler:a\"b" [label="a\"b\n\\d" shape=ellipse];`)
+	})
+}
+
+func setupTopology(t *testing.T) *bus.Bus {
+	b := setup()
+	b.RegisterTopicWithOpts(topicUserCreated, bus.WithOwner("identity"), bus.WithPayloadType(fakeUserV3{}))
+	b.RegisterTopicWithOpts(topicUserDeleted, bus.WithDeprecation("use user.removed"))
+	require.Nil(t, b.RegisterUpcaster(topicUserCreated, 2, upcastUserV2))
+	b.RegisterHandler("audit", fakeHandler(".*"))
+	b.RegisterHandler("mailer", fakeHandler("created$"))
+	return b
+}
@@ -0,0 +1,94 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package bus
+
+import "fmt"
+
+type (
+	// Upcaster transforms an event payload from a schema version to the next
+	// one; the bus bumps the event's SchemaVersion after a successful call
+	Upcaster func(e Event) (Event, error)
+
+	upcasterChain struct {
+		version int              // current schema version of the topic
+		fns     map[int]Upcaster // upcasters by the source schema version
+	}
+)
+
+// RegisterUpcaster registers the upcaster transforming the topic events from
+// the given schema version to the next one; the highest target version
+// becomes the current schema version of the topic
+func (b *Bus) RegisterUpcaster(topic string, from int, fn Upcaster) error {
+	if from < 1 {
+		return fmt.Errorf("bus: upcaster schema version(%d) must be positive", from)
+	}
+	if fn == nil {
+		return fmt.Errorf("bus: upcaster func can't be nil")
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	// copy on write, emits read the chain without holding the lock
+	c := b.upcasters[topic]
+	fns := make(map[int]Upcaster, len(c.fns)+1)
+	for v, u := range c.fns {
+		fns[v] = u
+	}
+	fns[from] = fn
+
+	if from+1 > c.version {
+		c.version = from + 1
+	}
+	c.fns = fns
+	b.upcasters[topic] = c
+	return nil
+}
+
+// TopicSchemaVersion returns the current schema version of the topic, 0 when
+// the topic has no upcasters
+func (b *Bus) TopicSchemaVersion(topic string) int {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	return b.upcasters[topic].version
+}
+
+// Upcast transforms the event to the current schema version of its topic by
+// chaining the upcasters; unversioned events are stamped with the current
+// version as is
+func (b *Bus) Upcast(e Event) (Event, error) {
+	b.mutex.RLock()
+	c := b.upcasters[e.Topic]
+	b.mutex.RUnlock()
+
+	return c.upcast(e)
+}
+
+func (c upcasterChain) upcast(e Event) (Event, error) {
+	if c.version == 0 {
+		return e, nil
+	}
+	if e.SchemaVersion == 0 {
+		e.SchemaVersion = c.version
+		return e, nil
+	}
+
+	for e.SchemaVersion < c.version {
+		from := e.SchemaVersion
+		fn, ok := c.fns[from]
+		if !ok {
+			return e, fmt.Errorf("bus: topic(%s) upcaster from schema version(%d) not found", e.Topic, from)
+		}
+
+		upcasted, err := fn(e)
+		if err != nil {
+			return e, fmt.Errorf("bus: topic(%s) upcast from schema version(%d) failed: %w", e.Topic, from, err)
+		}
+		upcasted.SchemaVersion = from + 1
+		e = upcasted
+	}
+	return e, nil
+}
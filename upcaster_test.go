@@ -0,0 +1,143 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package bus_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/mustafaturan/bus/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type (
+	fakeUserV1 struct{ Name string }
+	fakeUserV2 struct{ FirstName, LastName string }
+	fakeUserV3 struct {
+		FirstName, LastName string
+		Active              bool
+	}
+)
+
+func TestRegisterUpcaster(t *testing.T) {
+	b := setup()
+
+	t.Run("with invalid version", func(t *testing.T) {
+		err := b.RegisterUpcaster(topicUserCreated, 0, upcastUserV1)
+		assert.EqualError(t, err, "bus: upcaster schema version(0) must be positive")
+	})
+
+	t.Run("with nil func", func(t *testing.T) {
+		err := b.RegisterUpcaster(topicUserCreated, 1, nil)
+		assert.EqualError(t, err, "bus: upcaster func can't be nil")
+	})
+
+	t.Run("bumps topic schema version", func(t *testing.T) {
+		assert.Equal(t, 0, b.TopicSchemaVersion(topicUserCreated))
+		require.Nil(t, b.RegisterUpcaster(topicUserCreated, 2, upcastUserV2))
+		assert.Equal(t, 3, b.TopicSchemaVersion(topicUserCreated))
+		require.Nil(t, b.RegisterUpcaster(topicUserCreated, 1, upcastUserV1))
+		assert.Equal(t, 3, b.TopicSchemaVersion(topicUserCreated))
+	})
+}
+
+func TestUpcast(t *testing.T) {
+	b := setupUpcasters(t)
+
+	t.Run("chains upcasters", func(t *testing.T) {
+		e := bus.Event{Topic: topicUserCreated, Data: fakeUserV1{Name: "Jane Doe"}, SchemaVersion: 1}
+		got, err := b.Upcast(e)
+		require.Nil(t, err)
+		assert.Equal(t, 3, got.SchemaVersion)
+		assert.Equal(t, fakeUserV3{FirstName: "Jane", LastName: "Doe", Active: true}, got.Data)
+	})
+
+	t.Run("stamps unversioned events", func(t *testing.T) {
+		e := bus.Event{Topic: topicUserCreated, Data: fakeUserV3{}}
+		got, err := b.Upcast(e)
+		require.Nil(t, err)
+		assert.Equal(t, 3, got.SchemaVersion)
+	})
+
+	t.Run("without upcasters", func(t *testing.T) {
+		e := bus.Event{Topic: topicUserDeleted, Data: "data", SchemaVersion: 1}
+		got, err := b.Upcast(e)
+		require.Nil(t, err)
+		assert.Equal(t, e, got)
+	})
+
+	t.Run("with failing upcaster", func(t *testing.T) {
+		require.Nil(t, b.RegisterUpcaster(topicUserUpdated, 1, func(e bus.Event) (bus.Event, error) {
+			return e, errors.New("boom")
+		}))
+		_, err := b.Upcast(bus.Event{Topic: topicUserUpdated, SchemaVersion: 1})
+		assert.EqualError(t, err, "bus: topic(user.updated) upcast from schema version(1) failed: boom")
+	})
+
+	t.Run("with missing upcaster", func(t *testing.T) {
+		require.Nil(t, b.RegisterUpcaster(topicCommentCreated, 2, upcastUserV2))
+		_, err := b.Upcast(bus.Event{Topic: topicCommentCreated, SchemaVersion: 1})
+		assert.EqualError(t, err, "bus: topic(comment.created) upcaster from schema version(1) not found")
+	})
+}
+
+func TestEmitMixedVersions(t *testing.T) {
+	b := setupUpcasters(t)
+	b.RegisterTopics(topicUserCreated)
+	defer tearDown(b, topicUserCreated)
+
+	var received []bus.Event
+	b.RegisterHandler("test.handler", bus.Handler{
+		Handle:  func(_ context.Context, e bus.Event) { received = append(received, e) },
+		Matcher: topicUserCreated,
+	})
+	defer b.DeregisterHandler("test.handler")
+
+	ctx := context.Background()
+	require.Nil(t, b.EmitWithOpts(ctx, topicUserCreated, fakeUserV1{Name: "Jane Doe"}, bus.WithSchemaVersion(1)))
+	require.Nil(t, b.EmitWithOpts(ctx, topicUserCreated, fakeUserV2{FirstName: "John", LastName: "Doe"}, bus.WithSchemaVersion(2)))
+	require.Nil(t, b.EmitWithOpts(ctx, topicUserCreated, fakeUserV3{FirstName: "Joe"}, bus.WithSchemaVersion(3)))
+	require.Nil(t, b.Emit(ctx, topicUserCreated, fakeUserV3{FirstName: "Jim"}))
+
+	want := []interface{}{
+		fakeUserV3{FirstName: "Jane", LastName: "Doe", Active: true},
+		fakeUserV3{FirstName: "John", LastName: "Doe", Active: true},
+		fakeUserV3{FirstName: "Joe"},
+		fakeUserV3{FirstName: "Jim"},
+	}
+	require.Len(t, received, len(want))
+	for i, e := range received {
+		assert.Equal(t, 3, e.SchemaVersion)
+		assert.Equal(t, want[i], e.Data)
+	}
+}
+
+func setupUpcasters(t *testing.T) *bus.Bus {
+	b := setup()
+	require.Nil(t, b.RegisterUpcaster(topicUserCreated, 1, upcastUserV1))
+	require.Nil(t, b.RegisterUpcaster(topicUserCreated, 2, upcastUserV2))
+	return b
+}
+
+func upcastUserV1(e bus.Event) (bus.Event, error) {
+	u := e.Data.(fakeUserV1)
+	first, last := u.Name, ""
+	for i, r := range u.Name {
+		if r == ' ' {
+			first, last = u.Name[:i], u.Name[i+1:]
+			break
+		}
+	}
+	e.Data = fakeUserV2{FirstName: first, LastName: last}
+	return e, nil
+}
+
+func upcastUserV2(e bus.Event) (bus.Event, error) {
+	u := e.Data.(fakeUserV2)
+	e.Data = fakeUserV3{FirstName: u.FirstName, LastName: u.LastName, Active: true}
+	return e, nil
+}
@@ -0,0 +1,288 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package bus
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+type (
+	// Validator validates event payloads of a topic
+	Validator interface {
+		Validate(data interface{}) error
+	}
+
+	// ValidatorFunc is an adapter to use ordinary funcs as validators
+	ValidatorFunc func(data interface{}) error
+
+	// ValidationError is returned on emit when the payload is rejected by the
+	// topic validator
+	ValidationError struct {
+		Topic  string
+		Errors []FieldError
+	}
+
+	// FieldError describes a single validation failure
+	FieldError struct {
+		Path    string // JSON path of the invalid field, `$` for the root
+		Message string
+	}
+
+	// Schema is a validator for a subset of the JSON Schema specification;
+	// supported keywords are type, properties, required,
+	// additionalProperties, items, enum, minimum, maximum, minLength,
+	// maxLength and pattern
+	//
+	// The patterns are compiled by ParseSchema; the schemas built in code
+	// should call Compile, otherwise the patterns are compiled on each
+	// validation.
+	Schema struct {
+		Type                 string             `json:"type,omitempty"`
+		Properties           map[string]*Schema `json:"properties,omitempty"`
+		Required             []string           `json:"required,omitempty"`
+		AdditionalProperties *bool              `json:"additionalProperties,omitempty"`
+		Items                *Schema            `json:"items,omitempty"`
+		Enum                 []interface{}      `json:"enum,omitempty"`
+		Minimum              *float64           `json:"minimum,omitempty"`
+		Maximum              *float64           `json:"maximum,omitempty"`
+		MinLength            *int               `json:"minLength,omitempty"`
+		MaxLength            *int               `json:"maxLength,omitempty"`
+		Pattern              string             `json:"pattern,omitempty"`
+
+		pattern *regexp.Regexp
+	}
+)
+
+const schemaRootPath = "$"
+
+// Validate calls the func
+func (fn ValidatorFunc) Validate(data interface{}) error {
+	return fn(data)
+}
+
+// Error returns the validation failures as a single line
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, fe := range e.Errors {
+		msgs[i] = fe.String()
+	}
+	return fmt.Sprintf("bus: topic(%s) payload is invalid: %s", e.Topic, strings.Join(msgs, "; "))
+}
+
+// String returns the path and the message of the field error
+func (fe FieldError) String() string {
+	if fe.Path == empty {
+		return fe.Message
+	}
+	return fe.Path + ": " + fe.Message
+}
+
+// ParseSchema decodes a JSON Schema document and compiles its patterns
+func ParseSchema(data []byte) (*Schema, error) {
+	var s Schema
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("bus: schema decode failed: %w", err)
+	}
+	if err := s.Compile(); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Compile compiles the patterns of the schema and its subschemas
+func (s *Schema) Compile() error {
+	return s.compile(schemaRootPath)
+}
+
+func (s *Schema) compile(path string) error {
+	if s.Pattern != empty {
+		pattern, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("bus: schema %s pattern(%s) is invalid: %w", path, s.Pattern, err)
+		}
+		s.pattern = pattern
+	}
+	for name, ps := range s.Properties {
+		if ps == nil {
+			continue
+		}
+		if err := ps.compile(path + "." + name); err != nil {
+			return err
+		}
+	}
+	if s.Items != nil {
+		return s.Items.compile(path + "[]")
+	}
+	return nil
+}
+
+// Validate checks the JSON representation of the data against the schema
+func (s *Schema) Validate(data interface{}) error {
+	raw, ok := data.(json.RawMessage)
+	if !ok {
+		var err error
+		if raw, err = json.Marshal(data); err != nil {
+			return &ValidationError{Errors: []FieldError{
+				{Path: schemaRootPath, Message: err.Error()},
+			}}
+		}
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return &ValidationError{Errors: []FieldError{
+			{Path: schemaRootPath, Message: err.Error()},
+		}}
+	}
+
+	if errs := s.validate(schemaRootPath, v, nil); len(errs) > 0 {
+		return &ValidationError{Errors: errs}
+	}
+	return nil
+}
+
+func (s *Schema) validate(path string, v interface{}, errs []FieldError) []FieldError {
+	if s.Type != empty && !schemaTypeMatches(s.Type, v) {
+		return append(errs, FieldError{
+			Path:    path,
+			Message: fmt.Sprintf("expected %s, got %s", s.Type, schemaTypeOf(v)),
+		})
+	}
+
+	if len(s.Enum) > 0 && !schemaEnumContains(s.Enum, v) {
+		errs = append(errs, FieldError{Path: path, Message: "value is not one of the enum values"})
+	}
+
+	switch val := v.(type) {
+	case map[string]interface{}:
+		errs = s.validateObject(path, val, errs)
+	case []interface{}:
+		if s.Items != nil {
+			for i, item := range val {
+				errs = s.Items.validate(fmt.Sprintf("%s[%d]", path, i), item, errs)
+			}
+		}
+	case string:
+		errs = s.validateString(path, val, errs)
+	case float64:
+		if s.Minimum != nil && val < *s.Minimum {
+			errs = append(errs, FieldError{Path: path, Message: fmt.Sprintf("must be >= %v", *s.Minimum)})
+		}
+		if s.Maximum != nil && val > *s.Maximum {
+			errs = append(errs, FieldError{Path: path, Message: fmt.Sprintf("must be <= %v", *s.Maximum)})
+		}
+	}
+	return errs
+}
+
+func (s *Schema) validateObject(path string, obj map[string]interface{}, errs []FieldError) []FieldError {
+	for _, name := range s.Required {
+		if _, ok := obj[name]; !ok {
+			errs = append(errs, FieldError{Path: path + "." + name, Message: "is required"})
+		}
+	}
+
+	names := make([]string, 0, len(obj))
+	for name := range obj {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		val := obj[name]
+		ps, ok := s.Properties[name]
+		if !ok {
+			if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+				errs = append(errs, FieldError{Path: path + "." + name, Message: "is not allowed"})
+			}
+			continue
+		}
+		errs = ps.validate(path+"."+name, val, errs)
+	}
+	return errs
+}
+
+func (s *Schema) validateString(path, str string, errs []FieldError) []FieldError {
+	l := len([]rune(str))
+	if s.MinLength != nil && l < *s.MinLength {
+		errs = append(errs, FieldError{Path: path, Message: fmt.Sprintf("length must be >= %d", *s.MinLength)})
+	}
+	if s.MaxLength != nil && l > *s.MaxLength {
+		errs = append(errs, FieldError{Path: path, Message: fmt.Sprintf("length must be <= %d", *s.MaxLength)})
+	}
+	if s.Pattern == empty {
+		return errs
+	}
+
+	pattern := s.pattern
+	if pattern == nil {
+		var err error
+		if pattern, err = regexp.Compile(s.Pattern); err != nil {
+			return append(errs, FieldError{Path: path, Message: fmt.Sprintf("pattern(%s) is invalid", s.Pattern)})
+		}
+	}
+	if !pattern.MatchString(str) {
+		errs = append(errs, FieldError{Path: path, Message: fmt.Sprintf("must match pattern(%s)", s.Pattern)})
+	}
+	return errs
+}
+
+func schemaTypeMatches(typ string, v interface{}) bool {
+	if typ == "integer" {
+		f, ok := v.(float64)
+		return ok && f == float64(int64(f))
+	}
+	if typ == "number" {
+		_, ok := v.(float64)
+		return ok
+	}
+	return typ == schemaTypeOf(v)
+}
+
+func schemaTypeOf(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "unknown"
+}
+
+func schemaEnumContains(enum []interface{}, v interface{}) bool {
+	for _, ev := range enum {
+		if reflect.DeepEqual(normalizeSchemaValue(ev), v) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeSchemaValue converts Go values declared in the schema to their
+// decoded JSON representation for comparison
+func normalizeSchemaValue(v interface{}) interface{} {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return v
+	}
+	var n interface{}
+	if err := json.Unmarshal(raw, &n); err != nil {
+		return v
+	}
+	return n
+}
@@ -0,0 +1,122 @@
+// Copyright 2021 Mustafa Turan. All rights reserved.
+// Use of this source code is governed by a Apache License 2.0 license that can
+// be found in the LICENSE file.
+
+package bus_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/mustafaturan/bus/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const fakeOrderSchema = `{
+	"type": "object",
+	"required": ["id", "amount"],
+	"additionalProperties": false,
+	"properties": {
+		"id": {"type": "string", "minLength": 1, "pattern": "^[0-9]+$"},
+		"amount": {"type": "number", "minimum": 0},
+		"currency": {"type": "string", "enum": ["USD", "EUR"]},
+		"items": {"type": "array", "items": {"type": "integer", "maximum": 10}}
+	}
+}`
+
+func TestSchemaValidate(t *testing.T) {
+	s, err := bus.ParseSchema([]byte(fakeOrderSchema))
+	require.Nil(t, err)
+
+	tests := []struct {
+		name string
+		data interface{}
+		want []bus.FieldError
+	}{
+		{
+			name: "valid",
+			data: map[string]interface{}{"id": "12", "amount": 1.5, "currency": "USD", "items": []int{1, 2}},
+		},
+		{
+			name: "valid raw message",
+			data: json.RawMessage(`{"id":"12","amount":0}`),
+		},
+		{
+			name: "wrong root type",
+			data: "order",
+			want: []bus.FieldError{{Path: "$", Message: "expected object, got string"}},
+		},
+		{
+			name: "missing required",
+			data: map[string]interface{}{"id": "12"},
+			want: []bus.FieldError{{Path: "$.amount", Message: "is required"}},
+		},
+		{
+			name: "invalid fields",
+			data: map[string]interface{}{
+				"id": "a", "amount": -1, "currency": "TRY", "items": []interface{}{1, 11, 1.5}, "note": "x",
+			},
+			want: []bus.FieldError{
+				{Path: "$.amount", Message: "must be >= 0"},
+				{Path: "$.currency", Message: "value is not one of the enum values"},
+				{Path: "$.id", Message: "must match pattern(^[0-9]+$)"},
+				{Path: "$.items[1]", Message: "must be <= 10"},
+				{Path: "$.items[2]", Message: "expected integer, got number"},
+				{Path: "$.note", Message: "is not allowed"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := s.Validate(test.data)
+			if test.want == nil {
+				assert.Nil(t, err)
+				return
+			}
+
+			var verr *bus.ValidationError
+			require.True(t, errors.As(err, &verr))
+			assert.Equal(t, test.want, verr.Errors)
+		})
+	}
+}
+
+func TestParseSchema(t *testing.T) {
+	t.Run("with invalid json", func(t *testing.T) {
+		_, err := bus.ParseSchema([]byte(`{"type":`))
+		assert.Error(t, err)
+	})
+
+	t.Run("with invalid pattern", func(t *testing.T) {
+		_, err := bus.ParseSchema([]byte(`{"properties": {"tags": {"items": {"pattern": "["}}}}`))
+		assert.EqualError(t, err, "bus: schema $.tags[] pattern([) is invalid: error parsing regexp: missing closing ]: `[`")
+	})
+}
+
+func TestSchemaCompile(t *testing.T) {
+	s := &bus.Schema{Type: "string", Pattern: "^[a-z]+$"}
+	require.Nil(t, s.Compile())
+	assert.Nil(t, s.Validate("abc"))
+	assert.Error(t, s.Validate("ABC"))
+
+	t.Run("validates without compile", func(t *testing.T) {
+		s := &bus.Schema{Type: "string", Pattern: "["}
+		err := s.Validate("abc")
+		assert.EqualError(t, err, "bus: topic() payload is invalid: $: pattern([) is invalid")
+	})
+}
+
+func TestValidationError(t *testing.T) {
+	err := &bus.ValidationError{
+		Topic: topicCommentCreated,
+		Errors: []bus.FieldError{
+			{Path: "$.id", Message: "is required"},
+			{Message: "too late"},
+		},
+	}
+	want := "bus: topic(comment.created) payload is invalid: $.id: is required; too late"
+	assert.Equal(t, want, err.Error())
+}